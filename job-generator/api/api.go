@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"log/slog"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,14 +26,96 @@ type GenerateRequestParam struct {
 	Height int `json:"height"`
 }
 
-var client = &http.Client{
-	Timeout: time.Duration(config.C.APITimeout) * time.Second,
-	Transport: &http.Transport{
-		ForceAttemptHTTP2: false,
-	},
+// StatusError is returned when the serve endpoint answers with a non 200 status
+type StatusError struct {
+	StatusCode int
+	Body       string
 }
 
-func GenerateImage(apiURL string, params GenerateRequestParam, id string) (time.Duration, error) {
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("image generation failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+// Client talks to ray serve, the autoscaler and the ray dashboard, every call is bounded by its context
+// and by the timeout of its kind so cancelling the context aborts the request in flight
+type Client struct {
+	AutoscalerURL string
+	DashboardURL  string
+	ControllerURL string // of the ray-serve controller app, defaults to AutoscalerURL
+
+	// the serve deployment that generates images, the import paths are only used for applications
+	// deployed imperatively, which have no declarative config to read them from
+	Application string
+	Deployment  string
+	ImportPath  string
+	ImportPaths map[string]string // of the other applications, which are kept when scaling
+
+	// the newest observation version to send, 0 for the latest one the client knows, the autoscaler
+	// may accept fewer
+	MaxObservationVersion int
+
+	observationVersion atomic.Int32 // negotiated, 0 until then
+	httpClient         *http.Client
+	generateTimeout    time.Duration
+	controlTimeout     time.Duration // for the autoscaler and the dashboard
+}
+
+func NewClient(autoscalerURL, dashboardURL string, httpClient *http.Client, generateTimeout, controlTimeout time.Duration) *Client {
+	return &Client{
+		AutoscalerURL:   autoscalerURL,
+		DashboardURL:    dashboardURL,
+		ControllerURL:   autoscalerURL,
+		httpClient:      httpClient,
+		generateTimeout: generateTimeout,
+		controlTimeout:  controlTimeout,
+	}
+}
+
+// NewClientFromConfig builds a client for the endpoints and timeouts in config.C
+func NewClientFromConfig() *Client {
+	client := NewClient(
+		"http://"+config.C.AutoscalerEndpoint,
+		"http://"+config.C.RayDashboardEndpoint,
+		&http.Client{
+			Transport: &http.Transport{
+				ForceAttemptHTTP2: false,
+			},
+		},
+		time.Duration(config.C.APITimeout)*time.Second,
+		time.Duration(config.C.ControlTimeout)*time.Second,
+	)
+	client.Application = config.C.ServeApplication
+	client.Deployment = config.C.ServeDeployment
+	client.ImportPath = config.C.ServeImportPath
+	client.ImportPaths = parseImportPaths(config.C.ServeImportPaths)
+	client.ControllerURL = "http://" + config.C.ControllerEndpoint
+	client.MaxObservationVersion = config.C.ObservationVersion
+	return client
+}
+
+func parseImportPaths(s string) map[string]string {
+	paths := map[string]string{}
+	for _, item := range strings.Split(s, ",") {
+		app, path, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if ok && app != "" && path != "" {
+			paths[app] = path
+		}
+	}
+	return paths
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// GenerateImage sends the job to the serve endpoint picked by the caller
+func (c *Client) GenerateImage(ctx context.Context, apiURL string, params GenerateRequestParam, id string) (time.Duration, error) {
+	ctx, cancel := withTimeout(ctx, c.generateTimeout)
+	defer cancel()
+
 	reqURL := fmt.Sprintf("%s/generate?prompt=%s&steps=%d&cfg_scale=%.1f&sampler_index=%s&width=%d&height=%d&id=%s",
 		apiURL,
 		url.QueryEscape(params.Prompt),
@@ -42,13 +127,13 @@ func GenerateImage(apiURL string, params GenerateRequestParam, id string) (time.
 		id,
 	)
 
-	req, err := http.NewRequest("GET", reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
 		slog.Error("Error creating request", "error", err)
 		return 0, err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		slog.Error("Error sending request", "error", err)
 		return 0, err
@@ -67,64 +152,29 @@ func GenerateImage(apiURL string, params GenerateRequestParam, id string) (time.
 		return time.Duration(r.Duration * float64(time.Second)), nil
 	} else {
 		body, _ := io.ReadAll(resp.Body)
-		slog.Error("Image generation failed", "response", string(body))
-		return 0, fmt.Errorf("image generation failed: %s", string(body))
+		slog.Error("Image generation failed", "status", resp.StatusCode, "response", string(body))
+		return 0, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 }
 
-func GetWorkerCount(apiURL string) (running, total int, err error) {
-	resp, err := http.Get(fmt.Sprintf("%s/api/serve/applications/", apiURL))
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return 0, 0, errors.New("unable to retrieve application configurations")
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	var data struct {
-		Applications map[string]map[string]interface{} `json:"applications"`
-	}
-	if err := json.Unmarshal(body, &data); err != nil {
-		return 0, 0, errors.New("invalid JSON from dashboard")
-	}
-
-	app, ok := data.Applications["text2img"]
-	if !ok {
-		return 0, 0, errors.New("application 'text2img' not found")
-	}
-
-	deployments, ok := app["deployments"].(map[string]interface{})
-	if !ok {
-		return 0, 0, errors.New("invalid deployments format")
-	}
-
-	deployment, ok := deployments["image_service"].(map[string]interface{})
-	if !ok {
-		return 0, 0, errors.New("deployment 'image_service' not found")
-	}
-
-	replicas, ok := deployment["replicas"].([]interface{})
-	if !ok {
-		return 0, 0, errors.New("replicas field missing or invalid")
-	}
-
-	total = len(replicas)
-
-	for _, replica := range replicas {
-		if rmap, ok := replica.(map[string]interface{}); ok {
-			if state, ok := rmap["state"].(string); ok && state == "RUNNING" {
-				running++
-			}
-		}
+// GetWorkerCount counts the running and all replicas of the served deployment
+func (c *Client) GetWorkerCount(ctx context.Context) (running, total int, err error) {
+	_, deployment, err := c.GetDeployment(ctx)
+	if err != nil {
+		return 0, 0, err
 	}
-
+	running, total = deployment.ReplicaCount(ReplicaRunning)
 	return running, total, nil
 }
 
 type CalcWorkerCountRequestParam struct {
-	Time   int         `json:"time"` // in seconds
-	Points []DataPoint `json:"points"`
+	Time    int         `json:"time"`              // in seconds
+	Version int         `json:"version,omitempty"` // of the observation schema, set by CalcWorkerCount
+	Points  []DataPoint `json:"points"`
 }
 
+// DataPoint is the observation of one metrics window, only the fields of the negotiated
+// observation version are sent to the autoscaler, see ObservationV1 and ObservationV2
 type DataPoint struct {
 	RunningWorker int     `json:"active_workers"`
 	NewJob        int     `json:"num_new_tasks"`
@@ -132,23 +182,60 @@ type DataPoint struct {
 	CompletedJob  int     `json:"num_completed_tasks"`
 	AvgDuration   float64 `json:"avg_duration"` // in milliseconds
 	AvgDelay      float64 `json:"avg_delay"`    // in milliseconds
+
+	ExpectedWorker int     `json:"expected_workers"`
+	TotalWorker    int     `json:"total_workers"`
+	PendingWorker  int     `json:"pending_workers"` // replicas not running yet or anymore
+	FailedJob      int     `json:"num_failed_tasks"`
+	AbandonedJob   int     `json:"num_abandoned_tasks"`
+	FailureRate    float64 `json:"failure_rate"`   // of the jobs finished in the window
+	P50Delay       float64 `json:"p50_delay"`      // in milliseconds
+	P95Delay       float64 `json:"p95_delay"`      // in milliseconds
+	P99Delay       float64 `json:"p99_delay"`      // in milliseconds
+	QueueAge       float64 `json:"queue_age"`      // of the oldest unfinished job, in milliseconds
+	PredictedWork  float64 `json:"predicted_work"` // of the queued and running jobs, in GPU seconds
+	Reward         float64 `json:"reward"`         // accumulated since the batch started
+	TimeOfDay      float64 `json:"time_of_day"`    // in seconds since local midnight
+	DayOfWeek      int     `json:"day_of_week"`    // 0 is sunday
 }
 
-func CalcWorkerCount(apiURL string, param CalcWorkerCountRequestParam) (int, error) {
+// CalcWorkerCount asks the autoscaler for the worker count, the observation is sent in the newest
+// schema version the autoscaler accepts
+func (c *Client) CalcWorkerCount(ctx context.Context, param CalcWorkerCountRequestParam) (int, error) {
+	ctx, cancel := withTimeout(ctx, c.controlTimeout)
+	defer cancel()
+
+	param.Version = c.ObservationVersion(ctx)
+	count, status, err := c.calcWorkerCount(ctx, param)
+	if status == http.StatusUnprocessableEntity && param.Version > ObservationV1 {
+		// the autoscaler may have been replaced by one that no longer accepts the version
+		if version, changed := c.renegotiateObservationVersion(ctx, param.Version); changed {
+			param.Version = version
+			count, _, err = c.calcWorkerCount(ctx, param)
+		}
+	}
+	return count, err
+}
+
+func (c *Client) calcWorkerCount(ctx context.Context, param CalcWorkerCountRequestParam) (int, int, error) {
 	bodyBytes, err := json.Marshal(param)
 	if err != nil {
-		return 0, errors.New("failed to encode input data")
+		return 0, 0, errors.New("failed to encode input data")
 	}
 
-	resp, err := http.Post(
-		fmt.Sprintf("%s/autoscaler/calc", apiURL),
-		"application/json",
-		bytes.NewReader(bodyBytes),
-	)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return 0, errors.New("failed to call autoscaler")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/autoscaler/calc", c.AutoscalerURL), bytes.NewReader(bodyBytes))
+	if err != nil {
+		return 0, 0, errors.New("failed to create autoscaler request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, 0, errors.New("failed to call autoscaler")
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, resp.StatusCode, errors.New("failed to call autoscaler")
+	}
 
 	respBody, _ := io.ReadAll(resp.Body)
 
@@ -156,77 +243,8 @@ func CalcWorkerCount(apiURL string, param CalcWorkerCountRequestParam) (int, err
 		Count int `json:"count"`
 	}
 	if err := json.Unmarshal(respBody, &result); err != nil {
-		return 0, errors.New("invalid JSON from autoscaler")
-	}
-
-	return result.Count, nil
-}
-
-func ScaleWorker(apiURL string, count int) error {
-	resp, err := http.Get(fmt.Sprintf("%s/api/serve/applications/", apiURL))
-	if err != nil || resp.StatusCode != http.StatusOK {
-		return errors.New("unable to retrieve application configurations")
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	var data struct {
-		Applications map[string]map[string]interface{} `json:"applications"`
-	}
-	if err := json.Unmarshal(body, &data); err != nil {
-		return errors.New("invalid JSON from dashboard")
-	}
-
-	app, ok := data.Applications["text2img"]
-	if !ok {
-		return errors.New("application 'text2img' not found")
-	}
-
-	deployments, ok := app["deployments"].(map[string]interface{})
-	if !ok {
-		return errors.New("invalid deployment format")
-	}
-
-	deploymentRaw, ok := deployments["image_service"].(map[string]interface{})
-	if !ok {
-		return errors.New("deployment 'image_service' not found")
-	}
-
-	deployment, ok := deploymentRaw["deployment_config"].(map[string]interface{})
-	if !ok {
-		deployment = map[string]interface{}{}
-	}
-
-	if _, hasAutoscaling := deployment["autoscaling_config"]; hasAutoscaling {
-		return errors.New("cannot set 'num_replicas' when 'autoscaling_config' is present")
-	}
-
-	deployment["num_replicas"] = count
-
-	payload := map[string]interface{}{
-		"applications": []map[string]interface{}{
-			{
-				"name":        "text2img",
-				"import_path": "core.image_service:entrypoint",
-				"deployments": []map[string]interface{}{
-					deployment,
-				},
-			},
-		},
-	}
-
-	jsonBytes, _ := json.Marshal(payload)
-	req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/api/serve/applications/", apiURL), bytes.NewReader(jsonBytes))
-	if err != nil {
-		return errors.New("failed to create PUT request")
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	putResp, err := http.DefaultClient.Do(req)
-	if err != nil || putResp.StatusCode >= 400 {
-		return errors.New("failed to update application configuration")
+		return 0, resp.StatusCode, errors.New("invalid JSON from autoscaler")
 	}
-	defer putResp.Body.Close()
 
-	return nil
+	return result.Count, resp.StatusCode, nil
 }
@@ -1,11 +1,36 @@
 package api
 
 import (
-	"log/slog"
+	"context"
+	"errors"
+	"github.com/paopaoyue/kscale/job-genrator/api/fakeserve"
+	"net/http"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
+func newTestClient(t *testing.T, options fakeserve.Options) (*fakeserve.Server, *Client) {
+	t.Helper()
+	server := fakeserve.New(options)
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL, server.URL, server.Client(), time.Second, time.Second)
+	client.Application = "text2img"
+	client.Deployment = "image_service"
+	client.ImportPath = "core.image_service:entrypoint"
+	client.ImportPaths = map[string]string{
+		"controller": "core.controller:controllerEntrypoint",
+		"autoscaler": "core.autoscaler:autoscalerEndpoint",
+	}
+	return server, client
+}
+
 func TestGenerateImage(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Latency = 5 * time.Millisecond
+	options.StepLatency = time.Millisecond
+	server, client := newTestClient(t, options)
 	param := GenerateRequestParam{
 		Prompt:       "a futuristic city at sunset",
 		Steps:        25,
@@ -14,29 +39,77 @@ func TestGenerateImage(t *testing.T) {
 		Width:        512,
 		Height:       512,
 	}
-	id := "test-123"
 
-	duration, err := GenerateImage("http://localhost:8000", param, id)
+	duration, err := client.GenerateImage(context.Background(), server.URL, param, "test-123")
 	if err != nil {
-		t.Errorf("GenerateImage failed: %v", err)
+		t.Fatalf("GenerateImage failed: %v", err)
 	}
-	if duration <= 0 {
-		t.Errorf("Expected positive duration, got %v", duration)
+	if duration != 30*time.Millisecond {
+		t.Errorf("Expected the server duration of 30ms, got %v", duration)
+	}
+
+	server.Fail(fakeserve.RouteGenerate, http.StatusTooManyRequests)
+	_, err = client.GenerateImage(context.Background(), server.URL, param, "test-124")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected a 429 status error, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	server.SetLatency(time.Second, 0)
+	if _, err := client.GenerateImage(ctx, server.URL, param, "test-125"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the request to be cancelled, got %v", err)
 	}
 }
 
 func TestGetWorkerCount(t *testing.T) {
-	running, total, err := GetWorkerCount("http://localhost:8265")
-	if err != nil {
-		t.Errorf("GetWorkerCount failed: %v", err)
+	clock := fakeserve.NewClock(time.Now())
+	options := fakeserve.DefaultOptions()
+	options.Replicas = 2
+	options.StartupDelay = 10 * time.Second
+	options.StopDelay = 5 * time.Second
+	options.Now = clock.Now
+	server, client := newTestClient(t, options)
+
+	assertWorkers := func(wantRunning, wantTotal int) {
+		t.Helper()
+		running, total, err := client.GetWorkerCount(context.Background())
+		if err != nil {
+			t.Fatalf("GetWorkerCount failed: %v", err)
+		}
+		if running != wantRunning || total != wantTotal {
+			t.Errorf("Expected %d running of %d, got %d of %d", wantRunning, wantTotal, running, total)
+		}
 	}
-	if total < running {
-		t.Errorf("Invalid state: running=%d > total=%d", running, total)
+	assertWorkers(2, 2)
+
+	if err := client.ScaleWorker(context.Background(), 3); err != nil {
+		t.Fatalf("ScaleWorker failed: %v", err)
+	}
+	assertWorkers(2, 3)
+	clock.Advance(10 * time.Second)
+	assertWorkers(3, 3)
+
+	if err := client.ScaleWorker(context.Background(), 1); err != nil {
+		t.Fatalf("ScaleWorker failed: %v", err)
+	}
+	assertWorkers(1, 3)
+	clock.Advance(5 * time.Second)
+	assertWorkers(1, 1)
+
+	server.Fail(fakeserve.RouteApplications, http.StatusInternalServerError)
+	if _, _, err := client.GetWorkerCount(context.Background()); err == nil {
+		t.Error("Expected an error from a failing dashboard")
 	}
-	slog.Info("GetWorkerCount", "running", running, "total", total)
 }
 
 func TestCalcWorkerCount(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Autoscale = func(req fakeserve.CalcRequest) (int, error) {
+		return int(req.Points[0]["num_ongoing_tasks"]) + 1, nil
+	}
+	server, client := newTestClient(t, options)
 	param := CalcWorkerCountRequestParam{
 		Time: 10,
 		Points: []DataPoint{
@@ -51,19 +124,73 @@ func TestCalcWorkerCount(t *testing.T) {
 		},
 	}
 
-	count, err := CalcWorkerCount("http://localhost:8000", param)
+	count, err := client.CalcWorkerCount(context.Background(), param)
 	if err != nil {
-		t.Errorf("CalcWorkerCount failed: %v", err)
+		t.Fatalf("CalcWorkerCount failed: %v", err)
+	}
+	if count != 6 {
+		t.Errorf("Expected 6 workers, got %d", count)
 	}
-	if count < 0 {
-		t.Errorf("Invalid count: %d", count)
+	if calcs := server.Calcs(); len(calcs) != 1 || calcs[0].Time != 10 || len(calcs[0].Points) != 1 {
+		t.Errorf("Unexpected autoscaler request %+v", calcs)
+	}
+
+	server.Fail(fakeserve.RouteCalc, http.StatusServiceUnavailable)
+	if _, err := client.CalcWorkerCount(context.Background(), param); err == nil {
+		t.Error("Expected an error from a failing autoscaler")
 	}
-	slog.Info("CalcWorkerCount", "count", count)
 }
 
 func TestScaleWorker(t *testing.T) {
-	err := ScaleWorker("http://localhost:8265", 1)
+	server, client := newTestClient(t, fakeserve.DefaultOptions())
+
+	if err := client.ScaleWorker(context.Background(), 4); err != nil {
+		t.Fatalf("ScaleWorker failed: %v", err)
+	}
+	if server.Target() != 4 || server.Requests(fakeserve.RouteApplications) != 3 {
+		t.Errorf("Expected 4 replicas after a read, a conflict check and a write, got %d after %d requests",
+			server.Target(), server.Requests(fakeserve.RouteApplications))
+	}
+
+	// the application is declarative now, its config is read back from serve
+	result, err := client.ScaleDeployment(context.Background(), 2, true)
 	if err != nil {
-		t.Errorf("ScaleWorker failed: %v", err)
+		t.Fatalf("ScaleDeployment failed: %v", err)
+	}
+	if len(result.Changes) != 1 || string(result.Changes[0].Old) != "4" || string(result.Changes[0].New) != "2" {
+		t.Errorf("Unexpected changes %+v", result.Changes)
+	}
+
+	server.Fail(fakeserve.RouteApplications, 0, 0, http.StatusBadGateway)
+	if err := client.ScaleWorker(context.Background(), 1); err == nil || server.Target() != 4 {
+		t.Errorf("Expected a failed write to keep 4 replicas, got %v and %d", err, server.Target())
+	}
+	if apps := server.Applications(); !slices.Equal(apps, []string{"autoscaler", "controller", "text2img"}) {
+		t.Errorf("Expected scaling to keep every application, got %v", apps)
+	}
+}
+
+func TestScaleWorkerKeepsImperativeApplications(t *testing.T) {
+	server, client := newTestClient(t, fakeserve.DefaultOptions())
+	client.ImportPaths = nil
+
+	if err := client.ScaleWorker(context.Background(), 2); err == nil {
+		t.Error("Expected a write that would delete the other applications to be refused")
+	}
+	if server.Requests(fakeserve.RouteApplications) != 1 || server.Target() != 1 {
+		t.Errorf("Expected nothing written, got %d requests and %d replicas", server.Requests(fakeserve.RouteApplications), server.Target())
+	}
+
+	// serve deletes the applications left out of a write, the autoscaler with them
+	put, _ := http.NewRequest(http.MethodPut, server.URL+fakeserve.RouteApplications,
+		strings.NewReader(`{"applications": [{"name": "text2img", "import_path": "core.image_service:entrypoint"}]}`))
+	if resp, err := server.Client().Do(put); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT failed: %v", err)
+	}
+	if apps := server.Applications(); !slices.Equal(apps, []string{"text2img"}) {
+		t.Errorf("Expected only text2img left, got %v", apps)
+	}
+	if _, err := client.CalcWorkerCount(context.Background(), CalcWorkerCountRequestParam{Points: []DataPoint{{}}}); err == nil {
+		t.Error("Expected the deleted autoscaler to be gone")
 	}
 }
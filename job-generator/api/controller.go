@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// GetControllerReplicas reads the replicas of the served deployment from the ray-serve controller app
+func (c *Client) GetControllerReplicas(ctx context.Context) (running, total int, err error) {
+	ctx, cancel := withTimeout(ctx, c.controlTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/controller/replicas", c.ControllerURL), nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create controller request: %w", err)
+	}
+	body, err := c.doControl(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	var result struct {
+		Running int `json:"running"`
+		Total   int `json:"total"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, 0, fmt.Errorf("invalid JSON from controller: %w", err)
+	}
+	return result.Running, result.Total, nil
+}
+
+// SetControllerReplicas asks the ray-serve controller app to set the replicas of the served deployment
+func (c *Client) SetControllerReplicas(ctx context.Context, count int) error {
+	ctx, cancel := withTimeout(ctx, c.controlTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/controller/replicas?count=%d", c.ControllerURL, count), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create controller request: %w", err)
+	}
+	_, err = c.doControl(req)
+	return err
+}
+
+func (c *Client) doControl(req *http.Request) ([]byte, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call controller: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to call controller: status %d: %s", resp.StatusCode, body)
+	}
+	return body, nil
+}
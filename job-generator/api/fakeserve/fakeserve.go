@@ -0,0 +1,559 @@
+// Package fakeserve is an in-process fake of the ray serve deployment that generates images, the
+// autoscaler app and the serve REST API of the ray dashboard, so tests run without a ray cluster.
+// It speaks the wire protocol only and does not use the api package, which tests it.
+package fakeserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RouteGenerate     = "/generate"
+	RouteCalc         = "/autoscaler/calc"
+	RouteSchema       = "/autoscaler/schema"
+	RouteApplications = "/api/serve/applications/"
+)
+
+type Options struct {
+	Application string
+	Deployment  string
+	Replicas    int // running when the server starts
+	// Applications are the other applications, deployed imperatively at /<name>. Like serve, a PUT
+	// deletes every application it leaves out and the routes of a deleted one answer 404
+	Applications []string
+
+	Latency      time.Duration // of every generate request
+	StepLatency  time.Duration // added to a generate request per step
+	StartupDelay time.Duration // a new replica is STARTING this long before it serves
+	StopDelay    time.Duration // a removed replica is STOPPING this long before it is gone
+	FailureRate  float64       // fraction of generate requests answered with a 500
+	Seed         uint64
+
+	// Autoscale answers /autoscaler/calc, the target replicas are kept by default
+	Autoscale func(req CalcRequest) (int, error)
+	// ObservationVersions are listed at /autoscaler/schema, nil for an autoscaler from before the
+	// route existed, which only accepts the legacy observation. Others are rejected with a 422
+	ObservationVersions []int
+	// Now is the clock of the replica transitions, time.Now by default
+	Now func() time.Time
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Application: "text2img",
+		Deployment:  "image_service",
+		Replicas:    1,
+		Seed:        1,
+
+		Applications:        []string{"controller", "autoscaler"},
+		ObservationVersions: []int{1, 2},
+	}
+}
+
+// CalcRequest is the body of /autoscaler/calc, points are kept by their json names so the fake
+// accepts every version of the observation
+type CalcRequest struct {
+	Time    int                  `json:"time"`
+	Version int                  `json:"version"` // 0 for a legacy request
+	Points  []map[string]float64 `json:"points"`
+}
+
+// Clock is a manual clock for Options.Now, safe to advance while the server reads it
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type application struct {
+	routePrefix string
+	config      json.RawMessage // of the last PUT, nil while the application is imperative
+}
+
+type replica struct {
+	id    string
+	start time.Time
+	stop  time.Time // zero unless the replica is being removed
+}
+
+// Server is started by New and closed with Close like the httptest.Server it embeds
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	options  Options
+	rng      *rand.Rand
+	replicas []*replica
+	nextID   int
+	target   int
+	apps     map[string]*application
+	failures map[string][]int
+	requests map[string]int
+	calcs    []CalcRequest
+	inflight int // generate requests being served
+	peak     int // of inflight
+}
+
+func New(options Options) *Server {
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	s := &Server{
+		options:  options,
+		rng:      rand.New(rand.NewPCG(options.Seed, options.Seed)),
+		apps:     map[string]*application{options.Application: {routePrefix: "/"}},
+		failures: map[string][]int{},
+		requests: map[string]int{},
+	}
+	for _, name := range options.Applications {
+		s.apps[name] = &application{routePrefix: "/" + name}
+	}
+	// the initial replicas are running from the start
+	now := options.Now().Add(-options.StartupDelay)
+	for i := 0; i < options.Replicas; i++ {
+		s.addReplica(now)
+	}
+	s.target = options.Replicas
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(RouteGenerate, s.handle(RouteGenerate, s.generate))
+	mux.HandleFunc(RouteCalc, s.handle(RouteCalc, s.calc))
+	mux.HandleFunc(RouteSchema, s.handle(RouteSchema, s.schema))
+	mux.HandleFunc(RouteApplications, s.handle(RouteApplications, s.applications))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Host is the address of the server without the scheme, as the endpoints are configured
+func (s *Server) Host() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// Fail answers the next requests of the route with the statuses, one status per request, 0 lets one through
+func (s *Server) Fail(route string, statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[route] = append(s.failures[route], statuses...)
+}
+
+func (s *Server) SetLatency(latency, stepLatency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options.Latency = latency
+	s.options.StepLatency = stepLatency
+}
+
+func (s *Server) SetFailureRate(rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.options.FailureRate = rate
+}
+
+// Applications lists the applications still deployed
+func (s *Server) Applications() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.apps))
+	for name := range s.apps {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Requests counts the requests of the route, including failed ones
+func (s *Server) Requests(route string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[route]
+}
+
+// PeakInflight is the most generate requests served at once
+func (s *Server) PeakInflight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak
+}
+
+// Calcs returns the bodies of every /autoscaler/calc request
+func (s *Server) Calcs() []CalcRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]CalcRequest{}, s.calcs...)
+}
+
+// Target is num_replicas of the deployment
+func (s *Server) Target() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.target
+}
+
+// Replicas counts the running replicas and all replicas, including starting and stopping ones
+func (s *Server) Replicas() (running, total int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.options.Now()
+	s.prune(now)
+	for _, r := range s.replicas {
+		if s.state(r, now) == "RUNNING" {
+			running++
+		}
+	}
+	return running, len(s.replicas)
+}
+
+func (s *Server) handle(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[route]++
+		var status int
+		if failures := s.failures[route]; len(failures) > 0 {
+			status = failures[0]
+			s.failures[route] = failures[1:]
+		}
+		deployed := route == RouteApplications || s.routed(route)
+		s.mu.Unlock()
+
+		if !deployed {
+			http.NotFound(w, r)
+			return
+		}
+		if status != 0 {
+			http.Error(w, fmt.Sprintf("injected failure of %s", route), status)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// routed tells whether the application serving the route is deployed, it is the one with the longest
+// matching route prefix of the applications the server started with
+func (s *Server) routed(route string) bool {
+	owner, longest := s.options.Application, 1
+	for _, name := range s.options.Applications {
+		if prefix := "/" + name; strings.HasPrefix(route, prefix) && len(prefix) > longest {
+			owner, longest = name, len(prefix)
+		}
+	}
+	_, ok := s.apps[owner]
+	return ok
+}
+
+func (s *Server) generate(w http.ResponseWriter, r *http.Request) {
+	steps, _ := strconv.Atoi(r.URL.Query().Get("steps"))
+
+	s.mu.Lock()
+	now := s.options.Now()
+	s.prune(now)
+	running := 0
+	for _, replica := range s.replicas {
+		if s.state(replica, now) == "RUNNING" {
+			running++
+		}
+	}
+	failed := s.options.FailureRate > 0 && s.rng.Float64() < s.options.FailureRate
+	latency := s.options.Latency + time.Duration(steps)*s.options.StepLatency
+	s.mu.Unlock()
+
+	if running == 0 {
+		http.Error(w, "no running replicas", http.StatusServiceUnavailable)
+		return
+	}
+	if failed {
+		http.Error(w, "injected generation failure", http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	s.inflight++
+	s.peak = max(s.peak, s.inflight)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inflight--
+		s.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(latency)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+	writeJSON(w, map[string]any{"duration": latency.Seconds()})
+}
+
+func (s *Server) calc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req CalcRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	s.mu.Lock()
+	s.calcs = append(s.calcs, req)
+	autoscale, count, versions := s.options.Autoscale, s.target, s.options.ObservationVersions
+	s.mu.Unlock()
+
+	if version := max(req.Version, 1); !slices.Contains(versions, version) && (versions != nil || version != 1) {
+		http.Error(w, fmt.Sprintf("unsupported observation version %d", version), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if autoscale != nil {
+		var err error
+		if count, err = autoscale(req); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, map[string]any{"count": count})
+}
+
+func (s *Server) schema(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	versions := s.options.ObservationVersions
+	s.mu.Unlock()
+	if versions == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, map[string]any{"versions": versions})
+}
+
+func (s *Server) applications(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		details := s.details()
+		s.mu.Unlock()
+		writeJSON(w, details)
+	case http.MethodPut:
+		s.put(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// put applies a declarative config, like serve the applications in it become declarative, the
+// replicas of the deployment follow its num_replicas and the applications missing from it are deleted
+func (s *Server) put(w http.ResponseWriter, r *http.Request) {
+	var config struct {
+		Applications []json.RawMessage `json:"applications"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	apps := map[string]*application{}
+	target := 0
+	for _, raw := range config.Applications {
+		var app struct {
+			Name        string `json:"name"`
+			RoutePrefix string `json:"route_prefix"`
+			ImportPath  string `json:"import_path"`
+			Deployments []struct {
+				Name        string          `json:"name"`
+				NumReplicas json.RawMessage `json:"num_replicas"`
+			} `json:"deployments"`
+		}
+		if err := json.Unmarshal(raw, &app); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if app.ImportPath == "" {
+			http.Error(w, fmt.Sprintf("application '%s' has no import_path", app.Name), http.StatusBadRequest)
+			return
+		}
+		if _, ok := apps[app.Name]; ok {
+			http.Error(w, fmt.Sprintf("application '%s' is listed twice", app.Name), http.StatusBadRequest)
+			return
+		}
+		routePrefix := app.RoutePrefix
+		if routePrefix == "" {
+			routePrefix = "/" + app.Name
+			if current, ok := s.apps[app.Name]; ok {
+				routePrefix = current.routePrefix
+			}
+		}
+		apps[app.Name] = &application{routePrefix: routePrefix, config: raw}
+		if app.Name != s.options.Application {
+			continue
+		}
+		// a deployment without num_replicas keeps the replicas it runs, a redeployed one gets its default of 1
+		target = 1
+		if _, ok := s.apps[app.Name]; ok {
+			target = s.target
+		}
+		for _, deployment := range app.Deployments {
+			if deployment.Name != s.options.Deployment || deployment.NumReplicas == nil {
+				continue
+			}
+			if err := json.Unmarshal(deployment.NumReplicas, &target); err != nil || target < 0 {
+				http.Error(w, fmt.Sprintf("invalid num_replicas %s", deployment.NumReplicas), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	s.apps = apps
+	s.scale(target)
+	w.WriteHeader(http.StatusOK)
+}
+
+// scale starts new replicas or stops the newest ones, which are the starting ones if there are any
+func (s *Server) scale(target int) {
+	now := s.options.Now()
+	s.prune(now)
+	s.target = target
+	active := []*replica{}
+	for _, r := range s.replicas {
+		if r.stop.IsZero() {
+			active = append(active, r)
+		}
+	}
+	for n := len(active); n < target; n++ {
+		s.addReplica(now)
+	}
+	for n := len(active); n > target; n-- {
+		active[n-1].stop = now
+	}
+}
+
+func (s *Server) addReplica(start time.Time) {
+	s.nextID++
+	s.replicas = append(s.replicas, &replica{id: fmt.Sprintf("replica-%d", s.nextID), start: start})
+}
+
+func (s *Server) state(r *replica, now time.Time) string {
+	switch {
+	case !r.stop.IsZero():
+		return "STOPPING"
+	case now.Before(r.start.Add(s.options.StartupDelay)):
+		return "STARTING"
+	default:
+		return "RUNNING"
+	}
+}
+
+// prune drops the replicas that finished stopping
+func (s *Server) prune(now time.Time) {
+	kept := s.replicas[:0]
+	for _, r := range s.replicas {
+		if r.stop.IsZero() || now.Before(r.stop.Add(s.options.StopDelay)) {
+			kept = append(kept, r)
+		}
+	}
+	s.replicas = kept
+}
+
+// details is the body of GET /api/serve/applications/
+func (s *Server) details() map[string]any {
+	now := s.options.Now()
+	s.prune(now)
+
+	replicas := []map[string]any{}
+	deploymentStatus := "HEALTHY"
+	for _, r := range s.replicas {
+		state := s.state(r, now)
+		switch state {
+		case "STARTING":
+			deploymentStatus = "UPSCALING"
+		case "STOPPING":
+			if deploymentStatus == "HEALTHY" {
+				deploymentStatus = "DOWNSCALING"
+			}
+		}
+		replicas = append(replicas, map[string]any{
+			"replica_id":   r.id,
+			"state":        state,
+			"node_id":      "fake-node",
+			"node_ip":      "127.0.0.1",
+			"actor_name":   "SERVE_REPLICA::" + s.options.Application + "#" + r.id,
+			"start_time_s": float64(r.start.UnixMilli()) / 1000,
+		})
+	}
+	appStatus := "RUNNING"
+	if deploymentStatus != "HEALTHY" {
+		appStatus = "DEPLOYING"
+	}
+
+	applications := map[string]any{}
+	for name, app := range s.apps {
+		details := map[string]any{
+			"name":                name,
+			"route_prefix":        app.routePrefix,
+			"status":              "RUNNING",
+			"message":             "",
+			"source":              "imperative",
+			"deployed_app_config": app.config,
+			"deployments":         map[string]any{},
+		}
+		if app.config != nil {
+			details["source"] = "declarative"
+		}
+		if name == s.options.Application {
+			details["status"] = appStatus
+			details["deployments"] = map[string]any{
+				s.options.Deployment: map[string]any{
+					"name":    s.options.Deployment,
+					"status":  deploymentStatus,
+					"message": "",
+					"deployment_config": map[string]any{
+						"name":                 s.options.Deployment,
+						"num_replicas":         s.target,
+						"max_ongoing_requests": 1,
+						"ray_actor_options":    map[string]any{"num_gpus": 1},
+					},
+					"target_num_replicas": s.target,
+					"replicas":            replicas,
+				},
+			}
+		}
+		applications[name] = details
+	}
+
+	return map[string]any{
+		"proxy_location": "EveryNode",
+		"http_options":   map[string]any{"host": "0.0.0.0", "port": 8000},
+		"grpc_options":   map[string]any{"port": 9000, "grpc_servicer_functions": []string{}},
+		"applications":   applications,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
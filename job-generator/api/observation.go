@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// Versions of the observation sent to /autoscaler/calc. The autoscaler lists the versions it accepts
+// at /autoscaler/schema, one without that route only knows ObservationV1
+const (
+	ObservationV1 = 1 // the six legacy fields the first models were trained on
+	ObservationV2 = 2 // adds the worker counts, failures, delay percentiles, queue age, predicted work, reward and time of day
+
+	LatestObservation = ObservationV2
+)
+
+// legacyDataPoint is a DataPoint in ObservationV1
+type legacyDataPoint struct {
+	RunningWorker int     `json:"active_workers"`
+	NewJob        int     `json:"num_new_tasks"`
+	OngoingJob    int     `json:"num_ongoing_tasks"`
+	CompletedJob  int     `json:"num_completed_tasks"`
+	AvgDuration   float64 `json:"avg_duration"`
+	AvgDelay      float64 `json:"avg_delay"`
+}
+
+// MarshalJSON sends the points in the schema of the version, a legacy request has no version field
+// so it is the request older autoscalers were built for
+func (p CalcWorkerCountRequestParam) MarshalJSON() ([]byte, error) {
+	if p.Version > ObservationV1 {
+		type plain CalcWorkerCountRequestParam
+		return json.Marshal(plain(p))
+	}
+	points := make([]legacyDataPoint, 0, len(p.Points))
+	for _, dp := range p.Points {
+		points = append(points, legacyDataPoint{
+			RunningWorker: dp.RunningWorker,
+			NewJob:        dp.NewJob,
+			OngoingJob:    dp.OngoingJob,
+			CompletedJob:  dp.CompletedJob,
+			AvgDuration:   dp.AvgDuration,
+			AvgDelay:      dp.AvgDelay,
+		})
+	}
+	return json.Marshal(struct {
+		Time   int               `json:"time"`
+		Points []legacyDataPoint `json:"points"`
+	}{p.Time, points})
+}
+
+// ObservationVersion negotiates the newest observation version both the client and the autoscaler
+// know, once per client. Until the autoscaler answers the legacy version is used
+func (c *Client) ObservationVersion(ctx context.Context) int {
+	if version := int(c.observationVersion.Load()); version != 0 {
+		return version
+	}
+	latest := c.latestObservationVersion()
+	if latest == ObservationV1 {
+		c.setObservationVersion(ObservationV1)
+		return ObservationV1
+	}
+
+	versions, err := c.getObservationVersions(ctx)
+	if err != nil {
+		slog.Warn("Failed to negotiate the observation version, using the legacy one", "err", err)
+		return ObservationV1
+	}
+	version := newestObservationVersion(versions, latest)
+	slog.Info("Negotiated the observation version", "version", version, "autoscaler", versions)
+	c.setObservationVersion(version)
+	return version
+}
+
+// renegotiateObservationVersion is called when the autoscaler rejected an observation in the version.
+// The version is only given up when the schema confirms the autoscaler no longer accepts it, a
+// rejection of a version still listed is a bad observation and not a reason to downgrade for good
+func (c *Client) renegotiateObservationVersion(ctx context.Context, rejected int) (int, bool) {
+	versions, err := c.getObservationVersions(ctx)
+	if err != nil {
+		slog.Warn("Failed to recheck the observation version, keeping it", "version", rejected, "err", err)
+		return rejected, false
+	}
+	if slices.Contains(versions, rejected) {
+		return rejected, false
+	}
+	version := newestObservationVersion(versions, min(rejected, c.latestObservationVersion()))
+	slog.Warn("Autoscaler no longer accepts the observation version, renegotiated", "rejected", rejected, "version", version, "autoscaler", versions)
+	c.setObservationVersion(version)
+	return version, version != rejected
+}
+
+func (c *Client) latestObservationVersion() int {
+	if c.MaxObservationVersion > 0 {
+		return min(c.MaxObservationVersion, LatestObservation)
+	}
+	return LatestObservation
+}
+
+// newestObservationVersion is the newest of the versions up to latest, the legacy one if none is
+func newestObservationVersion(versions []int, latest int) int {
+	version := ObservationV1
+	for _, v := range versions {
+		if v <= latest && v > version {
+			version = v
+		}
+	}
+	return version
+}
+
+func (c *Client) setObservationVersion(version int) {
+	c.observationVersion.Store(int32(version))
+}
+
+// getObservationVersions lists the observation versions the autoscaler accepts
+func (c *Client) getObservationVersions(ctx context.Context) ([]int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/autoscaler/schema", c.AutoscalerURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return []int{ObservationV1}, nil // an autoscaler from before the schema was versioned
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("autoscaler schema returned status %d", resp.StatusCode)
+	}
+	var schema struct {
+		Versions []int `json:"versions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&schema); err != nil {
+		return nil, fmt.Errorf("invalid autoscaler schema: %w", err)
+	}
+	return schema.Versions, nil
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/paopaoyue/kscale/job-genrator/api/fakeserve"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCalcRequestMarshalsPerVersion(t *testing.T) {
+	param := CalcWorkerCountRequestParam{Time: 10, Points: []DataPoint{{RunningWorker: 2, OngoingJob: 3, QueueAge: 1500, Reward: 1}}}
+
+	legacy, err := json.Marshal(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"time":10,"points":[{"active_workers":2,"num_new_tasks":0,"num_ongoing_tasks":3,"num_completed_tasks":0,"avg_duration":0,"avg_delay":0}]}`
+	if string(legacy) != want {
+		t.Errorf("expected the legacy request %s, got %s", want, legacy)
+	}
+
+	param.Version = ObservationV2
+	current, err := json.Marshal(param)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"version":2`, `"active_workers":2`, `"queue_age":1500`, `"reward":1`, `"time_of_day":0`} {
+		if !strings.Contains(string(current), field) {
+			t.Errorf("expected %s in %s", field, current)
+		}
+	}
+}
+
+func TestObservationVersionNegotiation(t *testing.T) {
+	param := CalcWorkerCountRequestParam{Time: 10, Points: []DataPoint{{OngoingJob: 3, QueueAge: 1500}}}
+	cases := []struct {
+		name     string
+		versions []int
+		max      int
+		want     int
+		schema   int // requests of the schema
+	}{
+		{"latest", []int{1, 2}, 0, ObservationV2, 1},
+		{"newer autoscaler", []int{1, 2, 7}, 0, ObservationV2, 1},
+		{"legacy autoscaler", nil, 0, ObservationV1, 1},
+		{"pinned", []int{1, 2}, ObservationV1, ObservationV1, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			options := fakeserve.DefaultOptions()
+			options.ObservationVersions = c.versions
+			server, client := newTestClient(t, options)
+			client.MaxObservationVersion = c.max
+
+			for i := 0; i < 2; i++ {
+				if _, err := client.CalcWorkerCount(context.Background(), param); err != nil {
+					t.Fatalf("CalcWorkerCount failed: %v", err)
+				}
+			}
+			calcs := server.Calcs()
+			if version := max(calcs[1].Version, ObservationV1); version != c.want {
+				t.Errorf("expected version %d, got %d", c.want, version)
+			}
+			if _, ok := calcs[1].Points[0]["queue_age"]; ok != (c.want == ObservationV2) {
+				t.Errorf("expected the queue age only in version 2, got %+v", calcs[1].Points[0])
+			}
+			if requests := server.Requests(fakeserve.RouteSchema); requests != c.schema {
+				t.Errorf("expected %d schema requests, got %d", c.schema, requests)
+			}
+		})
+	}
+}
+
+func TestObservationVersionFallsBackWhenRejected(t *testing.T) {
+	// an autoscaler that advertises a version it then fails to validate
+	options := fakeserve.DefaultOptions()
+	options.ObservationVersions = []int{1}
+	server, client := newTestClient(t, options)
+	client.setObservationVersion(ObservationV2)
+
+	param := CalcWorkerCountRequestParam{Time: 10, Points: []DataPoint{{OngoingJob: 3}}}
+	if _, err := client.CalcWorkerCount(context.Background(), param); err != nil {
+		t.Fatalf("CalcWorkerCount failed: %v", err)
+	}
+	if calcs := server.Calcs(); len(calcs) != 2 || calcs[0].Version != ObservationV2 || calcs[1].Version != 0 {
+		t.Fatalf("expected a rejected version 2 request and a legacy one, got %+v", calcs)
+	}
+	if version := client.ObservationVersion(context.Background()); version != ObservationV1 {
+		t.Errorf("expected the client to stay on version 1, got %d", version)
+	}
+	if requests := server.Requests(fakeserve.RouteSchema); requests != 1 {
+		t.Errorf("expected the schema to be checked once before falling back, got %d requests", requests)
+	}
+}
+
+func TestObservationVersionKeptWhenStillListed(t *testing.T) {
+	// a rejected observation of a version the autoscaler still lists is not a reason to downgrade
+	server, client := newTestClient(t, fakeserve.DefaultOptions())
+	server.Fail(fakeserve.RouteCalc, http.StatusUnprocessableEntity)
+
+	param := CalcWorkerCountRequestParam{Time: 10, Points: []DataPoint{{OngoingJob: 3}}}
+	if _, err := client.CalcWorkerCount(context.Background(), param); err == nil {
+		t.Fatal("expected the rejected observation to fail")
+	}
+	if version := client.ObservationVersion(context.Background()); version != ObservationV2 {
+		t.Fatalf("expected the client to keep version 2, got %d", version)
+	}
+
+	if _, err := client.CalcWorkerCount(context.Background(), param); err != nil {
+		t.Fatalf("CalcWorkerCount failed: %v", err)
+	}
+	if calcs := server.Calcs(); len(calcs) != 1 || calcs[0].Version != ObservationV2 {
+		t.Errorf("expected the next observation in version 2, got %+v", calcs)
+	}
+	if requests := server.Requests(fakeserve.RouteSchema); requests != 2 {
+		t.Errorf("expected the negotiation and one recheck of the schema, got %d requests", requests)
+	}
+}
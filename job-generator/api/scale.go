@@ -0,0 +1,275 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+)
+
+const maxScaleAttempts = 3
+
+var ErrConfigConflict = errors.New("serve config changed while scaling")
+
+// ConfigChange is one field of the declarative config changed by a scale action
+type ConfigChange struct {
+	Path string          `json:"path"`
+	Old  json.RawMessage `json:"old"` // null if the field was not set
+	New  json.RawMessage `json:"new"`
+}
+
+type ScaleResult struct {
+	Application string         `json:"application"`
+	Deployment  string         `json:"deployment"`
+	Replicas    int            `json:"replicas"`
+	Changes     []ConfigChange `json:"changes"`
+	DryRun      bool           `json:"dry_run"`
+	Applied     bool           `json:"applied"`
+}
+
+// ScaleWorker sets num_replicas of the served deployment
+func (c *Client) ScaleWorker(ctx context.Context, count int) error {
+	_, err := c.ScaleDeployment(ctx, count, false)
+	return err
+}
+
+// ScaleDeployment reads the complete declarative config of every application, patches only num_replicas
+// of the served deployment and writes it back. The config is read again right before writing and the
+// write is retried from scratch if anything changed meanwhile, the serve api has no precondition so a
+// change in between the second read and the write can still be lost. A dry run only returns the changes.
+func (c *Client) ScaleDeployment(ctx context.Context, count int, dryRun bool) (*ScaleResult, error) {
+	ctx, cancel := withTimeout(ctx, c.controlTimeout)
+	defer cancel()
+
+	result := &ScaleResult{Application: c.Application, Deployment: c.Deployment, Replicas: count, DryRun: dryRun}
+	for attempt := 1; attempt <= maxScaleAttempts; attempt++ {
+		current, err := c.readDeployConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		patched, err := c.patchReplicas(current, count)
+		if err != nil {
+			return nil, err
+		}
+		result.Changes, err = diffConfig(current, patched)
+		if err != nil {
+			return nil, err
+		}
+		if dryRun || len(result.Changes) == 0 {
+			return result, nil
+		}
+
+		latest, err := c.readDeployConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if same, err := sameConfig(current, latest); err != nil {
+			return nil, err
+		} else if !same {
+			slog.Warn("Serve config changed while scaling, retrying", "attempt", attempt)
+			continue
+		}
+
+		if err := c.putApplications(ctx, *patched); err != nil {
+			return nil, err
+		}
+		result.Applied = true
+		return result, nil
+	}
+	return nil, ErrConfigConflict
+}
+
+// readDeployConfig rebuilds the declarative config of all applications from the serve details, an
+// application deployed imperatively has no declarative config and is rebuilt from its configured
+// import path, without one it would be deleted by the write
+func (c *Client) readDeployConfig(ctx context.Context) (*ServeDeployConfig, error) {
+	details, err := c.GetServeDetails(ctx)
+	if err != nil {
+		return nil, err
+	}
+	app, err := details.Application(c.Application)
+	if err != nil {
+		return nil, err
+	}
+	deployment, err := app.Deployment(c.Deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	deployConfig := &ServeDeployConfig{ProxyLocation: details.ProxyLocation}
+	if !isNull(details.HTTPOptions) {
+		deployConfig.HTTPOptions = details.HTTPOptions
+	}
+	if !isNull(details.GRPCOptions) {
+		deployConfig.GRPCOptions = details.GRPCOptions
+	}
+	for _, name := range sortedKeys(details.Applications) {
+		app := details.Applications[name]
+		switch {
+		case app.DeployedAppConfig != nil:
+			deployConfig.Applications = append(deployConfig.Applications, *app.DeployedAppConfig)
+		case name == c.Application:
+			if c.ImportPath == "" {
+				return nil, fmt.Errorf("application '%s' was deployed imperatively and no import path is configured", name)
+			}
+			// all the runtime options of the deployment become overrides, as the old ScaleWorker did
+			deploymentConfig := deployment.DeploymentConfig
+			deploymentConfig.Name = c.Deployment
+			deployConfig.Applications = append(deployConfig.Applications, ApplicationConfig{
+				Name:        name,
+				RoutePrefix: app.RoutePrefix,
+				ImportPath:  c.ImportPath,
+				Deployments: []DeploymentConfig{deploymentConfig},
+			})
+		case c.ImportPaths[name] != "":
+			// rebuilt from the code alone, which is where its runtime options were set
+			deployConfig.Applications = append(deployConfig.Applications, ApplicationConfig{
+				Name:        name,
+				RoutePrefix: app.RoutePrefix,
+				ImportPath:  c.ImportPaths[name],
+			})
+		default:
+			return nil, fmt.Errorf("application '%s' was deployed imperatively and has no configured import path, writing the config would delete it", name)
+		}
+	}
+	return deployConfig, nil
+}
+
+func (c *Client) patchReplicas(current *ServeDeployConfig, count int) (*ServeDeployConfig, error) {
+	patched, err := copyConfig(current)
+	if err != nil {
+		return nil, err
+	}
+	for i := range patched.Applications {
+		app := &patched.Applications[i]
+		if app.Name != c.Application {
+			continue
+		}
+		for j := range app.Deployments {
+			deployment := &app.Deployments[j]
+			if deployment.Name != c.Deployment {
+				continue
+			}
+			if deployment.HasAutoscaling() {
+				return nil, errors.New("cannot set 'num_replicas' when 'autoscaling_config' is present")
+			}
+			deployment.NumReplicas = &NumReplicas{Count: count}
+			return patched, nil
+		}
+		// the declarative config only lists the deployments it overrides
+		app.Deployments = append(app.Deployments, DeploymentConfig{Name: c.Deployment, NumReplicas: &NumReplicas{Count: count}})
+		return patched, nil
+	}
+	return nil, fmt.Errorf("application '%s' not found in the serve config", c.Application)
+}
+
+func copyConfig(config *ServeDeployConfig) (*ServeDeployConfig, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var copied ServeDeployConfig
+	if err := json.Unmarshal(data, &copied); err != nil {
+		return nil, err
+	}
+	return &copied, nil
+}
+
+func sameConfig(a, b *ServeDeployConfig) (bool, error) {
+	changes, err := diffConfig(a, b)
+	return len(changes) == 0, err
+}
+
+// diffConfig lists the changed leaves of two configs, list items with a name are matched by name
+func diffConfig(old, new *ServeDeployConfig) ([]ConfigChange, error) {
+	oldFields, err := flattenConfig(old)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := flattenConfig(new)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := map[string]bool{}
+	for path := range oldFields {
+		paths[path] = true
+	}
+	for path := range newFields {
+		paths[path] = true
+	}
+	changes := []ConfigChange{}
+	for path := range paths {
+		oldValue, newValue := oldFields[path], newFields[path]
+		if !bytes.Equal(oldValue, newValue) {
+			changes = append(changes, ConfigChange{Path: path, Old: orNull(oldValue), New: orNull(newValue)})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes, nil
+}
+
+func flattenConfig(config *ServeDeployConfig) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	return fields, flatten("", value, fields)
+}
+
+func flatten(path string, value any, fields map[string]json.RawMessage) error {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			if err := flatten(joinPath(path, key), item, fields); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for i, item := range v {
+			key := strconv.Itoa(i)
+			if m, ok := item.(map[string]any); ok {
+				if name, ok := m["name"].(string); ok {
+					key = name
+				}
+			}
+			if err := flatten(path+"["+key+"]", item, fields); err != nil {
+				return err
+			}
+		}
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		fields[path] = data
+	}
+	return nil
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func isNull(data json.RawMessage) bool {
+	return len(data) == 0 || string(data) == "null"
+}
+
+func orNull(data json.RawMessage) json.RawMessage {
+	if data == nil {
+		return json.RawMessage("null")
+	}
+	return data
+}
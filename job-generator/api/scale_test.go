@@ -0,0 +1,158 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const declarativeAppJSON = `{
+  "name": "autoscaler",
+  "status": "RUNNING",
+  "deployed_app_config": {
+    "name": "autoscaler",
+    "route_prefix": "/autoscaler",
+    "import_path": "core.autoscaler:entrypoint",
+    "runtime_env": {"pip": ["torch"]},
+    "deployments": [{"name": "autoscaler_service", "num_replicas": 1, "user_config": {"model": "v2"}}]
+  },
+  "deployments": {}
+}`
+
+type fakeDashboard struct {
+	mu      sync.Mutex
+	details map[string]any
+	gets    int
+	puts    []string
+	// onGet may change the details between reads
+	onGet func(gets int, details map[string]any)
+}
+
+func newFakeDashboard(t *testing.T) (*fakeDashboard, *Client) {
+	var details map[string]any
+	if err := json.Unmarshal([]byte(serveDetailsJSON), &details); err != nil {
+		t.Fatal(err)
+	}
+	var app any
+	_ = json.Unmarshal([]byte(declarativeAppJSON), &app)
+	details["applications"].(map[string]any)["autoscaler"] = app
+
+	dashboard := &fakeDashboard{details: details}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dashboard.mu.Lock()
+		defer dashboard.mu.Unlock()
+		switch r.Method {
+		case http.MethodGet:
+			dashboard.gets++
+			if dashboard.onGet != nil {
+				dashboard.onGet(dashboard.gets, dashboard.details)
+			}
+			_ = json.NewEncoder(w).Encode(dashboard.details)
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			dashboard.puts = append(dashboard.puts, string(body))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient(server.URL, server.URL, server.Client(), time.Second, time.Second)
+	client.Application = "text2img"
+	client.Deployment = "image_service"
+	client.ImportPath = "core.image_service:entrypoint"
+	return dashboard, client
+}
+
+func TestScaleDeploymentPreservesConfig(t *testing.T) {
+	dashboard, client := newFakeDashboard(t)
+
+	result, err := client.ScaleDeployment(context.Background(), 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Applied || len(dashboard.puts) != 1 {
+		t.Fatalf("expected one write, got %+v and %d writes", result, len(dashboard.puts))
+	}
+	if len(result.Changes) != 1 || result.Changes[0].Path != "applications[text2img].deployments[image_service].num_replicas" ||
+		string(result.Changes[0].Old) != "2" || string(result.Changes[0].New) != "4" {
+		t.Fatalf("unexpected changes %+v", result.Changes)
+	}
+
+	var written ServeDeployConfig
+	if err := json.Unmarshal([]byte(dashboard.puts[0]), &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.ProxyLocation != "HeadOnly" || len(written.Applications) != 2 {
+		t.Fatalf("unexpected config %s", dashboard.puts[0])
+	}
+	for _, want := range []string{`"runtime_env":{"pip":["torch"]}`, `"user_config":{"model":"v2"}`, `"ray_actor_options":{"num_gpus":1}`} {
+		if !strings.Contains(dashboard.puts[0], want) {
+			t.Errorf("expected %s to be kept, got %s", want, dashboard.puts[0])
+		}
+	}
+}
+
+func TestScaleDeploymentDryRun(t *testing.T) {
+	dashboard, client := newFakeDashboard(t)
+
+	result, err := client.ScaleDeployment(context.Background(), 3, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Applied || len(result.Changes) != 1 || len(dashboard.puts) != 0 {
+		t.Fatalf("expected only a diff, got %+v and %d writes", result, len(dashboard.puts))
+	}
+
+	result, err = client.ScaleDeployment(context.Background(), 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Applied || len(result.Changes) != 0 || len(dashboard.puts) != 0 {
+		t.Fatalf("expected no write when nothing changes, got %+v", result)
+	}
+}
+
+func TestScaleDeploymentConflict(t *testing.T) {
+	dashboard, client := newFakeDashboard(t)
+	dashboard.onGet = func(gets int, details map[string]any) {
+		// someone else redeploys the autoscaler between every read
+		app := details["applications"].(map[string]any)["autoscaler"].(map[string]any)
+		app["deployed_app_config"].(map[string]any)["import_path"] = "core.autoscaler:v" + strconv.Itoa(gets)
+	}
+
+	_, err := client.ScaleDeployment(context.Background(), 4, false)
+	if !errors.Is(err, ErrConfigConflict) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if len(dashboard.puts) != 0 || dashboard.gets != 2*maxScaleAttempts {
+		t.Fatalf("expected %d reads and no write, got %d reads and %d writes", 2*maxScaleAttempts, dashboard.gets, len(dashboard.puts))
+	}
+}
+
+func TestScaleDeploymentRefusesImperativeApps(t *testing.T) {
+	dashboard, client := newFakeDashboard(t)
+	app := dashboard.details["applications"].(map[string]any)["autoscaler"].(map[string]any)
+	app["deployed_app_config"] = nil
+
+	if _, err := client.ScaleDeployment(context.Background(), 4, false); err == nil || !strings.Contains(err.Error(), "autoscaler") {
+		t.Fatalf("expected an error naming the imperative application, got %v", err)
+	}
+	if len(dashboard.puts) != 0 {
+		t.Fatal("expected no write")
+	}
+
+	client.ImportPaths = map[string]string{"autoscaler": "core.autoscaler:autoscalerEndpoint"}
+	if _, err := client.ScaleDeployment(context.Background(), 4, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(dashboard.puts) != 1 || !strings.Contains(dashboard.puts[0], `"import_path":"core.autoscaler:autoscalerEndpoint"`) {
+		t.Fatalf("expected the application to be rebuilt from its import path, got %v", dashboard.puts)
+	}
+}
@@ -0,0 +1,314 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Types of the Ray Serve REST API served by the dashboard at /api/serve/applications/, only the
+// fields the generator reads are typed
+
+type ApplicationStatus string
+
+const (
+	ApplicationNotStarted   ApplicationStatus = "NOT_STARTED"
+	ApplicationDeploying    ApplicationStatus = "DEPLOYING"
+	ApplicationDeployFailed ApplicationStatus = "DEPLOY_FAILED"
+	ApplicationRunning      ApplicationStatus = "RUNNING"
+	ApplicationUnhealthy    ApplicationStatus = "UNHEALTHY"
+	ApplicationDeleting     ApplicationStatus = "DELETING"
+)
+
+type DeploymentStatus string
+
+const (
+	DeploymentUpdating    DeploymentStatus = "UPDATING"
+	DeploymentHealthy     DeploymentStatus = "HEALTHY"
+	DeploymentUnhealthy   DeploymentStatus = "UNHEALTHY"
+	DeploymentUpscaling   DeploymentStatus = "UPSCALING"
+	DeploymentDownscaling DeploymentStatus = "DOWNSCALING"
+)
+
+type ReplicaState string
+
+const (
+	ReplicaStarting         ReplicaState = "STARTING"
+	ReplicaUpdating         ReplicaState = "UPDATING"
+	ReplicaRecovering       ReplicaState = "RECOVERING"
+	ReplicaRunning          ReplicaState = "RUNNING"
+	ReplicaStopping         ReplicaState = "STOPPING"
+	ReplicaPendingMigration ReplicaState = "PENDING_MIGRATION"
+)
+
+type ServeDetails struct {
+	ProxyLocation string                        `json:"proxy_location"`
+	HTTPOptions   json.RawMessage               `json:"http_options"`
+	GRPCOptions   json.RawMessage               `json:"grpc_options"`
+	Applications  map[string]ApplicationDetails `json:"applications"`
+}
+
+type ApplicationDetails struct {
+	Name              string                       `json:"name"`
+	RoutePrefix       *string                      `json:"route_prefix"`
+	Status            ApplicationStatus            `json:"status"`
+	Message           string                       `json:"message"`
+	Source            string                       `json:"source"` // declarative or imperative
+	DeployedAppConfig *ApplicationConfig           `json:"deployed_app_config"`
+	Deployments       map[string]DeploymentDetails `json:"deployments"`
+}
+
+// ApplicationConfig is an application of the declarative config
+type ApplicationConfig struct {
+	Name        string             `json:"name"`
+	RoutePrefix *string            `json:"route_prefix,omitempty"`
+	ImportPath  string             `json:"import_path"`
+	Deployments []DeploymentConfig `json:"deployments,omitempty"`
+
+	Extra Extra `json:"-"`
+}
+
+// ServeDeployConfig is the declarative config accepted by PUT /api/serve/applications/
+type ServeDeployConfig struct {
+	ProxyLocation string              `json:"proxy_location,omitempty"`
+	HTTPOptions   json.RawMessage     `json:"http_options,omitempty"`
+	GRPCOptions   json.RawMessage     `json:"grpc_options,omitempty"`
+	Applications  []ApplicationConfig `json:"applications"`
+}
+
+type DeploymentDetails struct {
+	Name              string           `json:"name"`
+	Status            DeploymentStatus `json:"status"`
+	Message           string           `json:"message"`
+	DeploymentConfig  DeploymentConfig `json:"deployment_config"`
+	TargetNumReplicas int              `json:"target_num_replicas"`
+	Replicas          []ReplicaDetails `json:"replicas"`
+}
+
+type DeploymentConfig struct {
+	Name               string          `json:"name"`
+	NumReplicas        *NumReplicas    `json:"num_replicas,omitempty"`
+	MaxOngoingRequests *int            `json:"max_ongoing_requests,omitempty"`
+	AutoscalingConfig  json.RawMessage `json:"autoscaling_config,omitempty"`
+
+	Extra Extra `json:"-"`
+}
+
+// HasAutoscaling reports whether serve autoscales the deployment, num_replicas cannot be set then
+func (c *DeploymentConfig) HasAutoscaling() bool {
+	return len(c.AutoscalingConfig) > 0 && string(c.AutoscalingConfig) != "null"
+}
+
+func (c *DeploymentConfig) UnmarshalJSON(data []byte) error {
+	type plain DeploymentConfig
+	return unmarshalWithExtra(data, (*plain)(c), &c.Extra)
+}
+
+func (c DeploymentConfig) MarshalJSON() ([]byte, error) {
+	type plain DeploymentConfig
+	return marshalWithExtra(plain(c), c.Extra)
+}
+
+func (c *ApplicationConfig) UnmarshalJSON(data []byte) error {
+	type plain ApplicationConfig
+	return unmarshalWithExtra(data, (*plain)(c), &c.Extra)
+}
+
+func (c ApplicationConfig) MarshalJSON() ([]byte, error) {
+	type plain ApplicationConfig
+	return marshalWithExtra(plain(c), c.Extra)
+}
+
+// Extra keeps the fields of a config the generator does not type, so a config read from serve
+// is written back without losing them
+type Extra map[string]json.RawMessage
+
+func unmarshalWithExtra(data []byte, typed any, extra *Extra) error {
+	if err := json.Unmarshal(data, typed); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	t := reflect.TypeOf(typed).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		delete(fields, name)
+	}
+	*extra = fields
+	return nil
+}
+
+func marshalWithExtra(typed any, extra Extra) ([]byte, error) {
+	data, err := json.Marshal(typed)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range extra {
+		if _, ok := fields[name]; !ok {
+			fields[name] = value
+		}
+	}
+	return json.Marshal(fields)
+}
+
+type ReplicaDetails struct {
+	ReplicaID  string       `json:"replica_id"`
+	State      ReplicaState `json:"state"`
+	NodeID     string       `json:"node_id"`
+	NodeIP     string       `json:"node_ip"`
+	ActorName  string       `json:"actor_name"`
+	PID        int          `json:"pid"`
+	StartTimeS float64      `json:"start_time_s"`
+}
+
+// NumReplicas is either a count or "auto", which lets serve pick the replicas
+type NumReplicas struct {
+	Count int
+	Auto  bool
+}
+
+func (n NumReplicas) MarshalJSON() ([]byte, error) {
+	if n.Auto {
+		return json.Marshal("auto")
+	}
+	return json.Marshal(n.Count)
+}
+
+func (n *NumReplicas) UnmarshalJSON(data []byte) error {
+	if string(data) == `"auto"` {
+		*n = NumReplicas{Auto: true}
+		return nil
+	}
+	count, err := strconv.Atoi(string(data))
+	if err != nil {
+		return fmt.Errorf("num_replicas must be an integer or \"auto\", got %s", data)
+	}
+	*n = NumReplicas{Count: count}
+	return nil
+}
+
+// Application returns the named application or an error listing the deployed ones
+func (d *ServeDetails) Application(name string) (*ApplicationDetails, error) {
+	if d.Applications == nil {
+		return nil, errors.New("serve details have no applications field")
+	}
+	app, ok := d.Applications[name]
+	if !ok {
+		return nil, fmt.Errorf("application '%s' not found, deployed applications: [%s]", name, strings.Join(sortedKeys(d.Applications), ", "))
+	}
+	return &app, nil
+}
+
+// Deployment returns the named deployment or an error listing the deployments of the application
+func (a *ApplicationDetails) Deployment(name string) (*DeploymentDetails, error) {
+	deployment, ok := a.Deployments[name]
+	if !ok {
+		return nil, fmt.Errorf("deployment '%s' not found in application '%s', deployments: [%s]", name, a.Name, strings.Join(sortedKeys(a.Deployments), ", "))
+	}
+	return &deployment, nil
+}
+
+// ReplicaCount counts all replicas of the deployment and those in the given state
+func (d *DeploymentDetails) ReplicaCount(state ReplicaState) (inState, total int) {
+	for _, replica := range d.Replicas {
+		if replica.State == state {
+			inState++
+		}
+	}
+	return inState, len(d.Replicas)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// GetServeDetails reads the status and config of every serve application
+func (c *Client) GetServeDetails(ctx context.Context) (*ServeDetails, error) {
+	ctx, cancel := withTimeout(ctx, c.controlTimeout)
+	defer cancel()
+
+	body, err := c.getApplications(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var details ServeDetails
+	if err := json.Unmarshal(body, &details); err != nil {
+		return nil, fmt.Errorf("invalid serve details from dashboard: %w", err)
+	}
+	return &details, nil
+}
+
+// GetDeployment reads the deployment the client scales
+func (c *Client) GetDeployment(ctx context.Context) (*ApplicationDetails, *DeploymentDetails, error) {
+	details, err := c.GetServeDetails(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	app, err := details.Application(c.Application)
+	if err != nil {
+		return nil, nil, err
+	}
+	deployment, err := app.Deployment(c.Deployment)
+	if err != nil {
+		return nil, nil, err
+	}
+	return app, deployment, nil
+}
+
+func (c *Client) putApplications(ctx context.Context, deployConfig ServeDeployConfig) error {
+	body, err := json.Marshal(deployConfig)
+	if err != nil {
+		return fmt.Errorf("failed to encode serve config: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/api/serve/applications/", c.DashboardURL), bytes.NewReader(body))
+	if err != nil {
+		return errors.New("failed to create PUT request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to update application configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to update application configuration: status %d: %s", resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+func (c *Client) getApplications(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/serve/applications/", c.DashboardURL), nil)
+	if err != nil {
+		return nil, errors.New("failed to create GET request")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve application configurations: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to retrieve application configurations: status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
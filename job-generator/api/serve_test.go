@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const serveDetailsJSON = `{
+  "proxy_location": "HeadOnly",
+  "applications": {
+    "text2img": {
+      "name": "text2img",
+      "route_prefix": "/",
+      "status": "RUNNING",
+      "source": "imperative",
+      "deployed_app_config": null,
+      "deployments": {
+        "image_service": {
+          "name": "image_service",
+          "status": "HEALTHY",
+          "deployment_config": {
+            "name": "image_service",
+            "num_replicas": 2,
+            "max_ongoing_requests": 1,
+            "ray_actor_options": {"num_gpus": 1}
+          },
+          "target_num_replicas": 2,
+          "replicas": [
+            {"replica_id": "a", "state": "RUNNING"},
+            {"replica_id": "b", "state": "STARTING"}
+          ]
+        }
+      }
+    },
+    "autoscaler": {
+      "name": "autoscaler",
+      "status": "RUNNING",
+      "deployments": {
+        "autoscaler_service": {
+          "name": "autoscaler_service",
+          "deployment_config": {"name": "autoscaler_service", "num_replicas": "auto", "autoscaling_config": {"min_replicas": 1}}
+        }
+      }
+    }
+  }
+}`
+
+func TestServeDetails(t *testing.T) {
+	var details ServeDetails
+	if err := json.Unmarshal([]byte(serveDetailsJSON), &details); err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := details.Application("text2img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment, err := app.Deployment("image_service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running, total := deployment.ReplicaCount(ReplicaRunning); running != 1 || total != 2 {
+		t.Fatalf("expected 1 of 2 replicas running, got %d of %d", running, total)
+	}
+	if deployment.DeploymentConfig.NumReplicas.Count != 2 || deployment.DeploymentConfig.HasAutoscaling() {
+		t.Fatalf("unexpected deployment config %+v", deployment.DeploymentConfig)
+	}
+
+	if _, err := details.Application("missing"); err == nil || !strings.Contains(err.Error(), "autoscaler, text2img") {
+		t.Fatalf("expected an error listing the applications, got %v", err)
+	}
+	if _, err := app.Deployment("missing"); err == nil || !strings.Contains(err.Error(), "image_service") {
+		t.Fatalf("expected an error listing the deployments, got %v", err)
+	}
+
+	autoscaler := details.Applications["autoscaler"].Deployments["autoscaler_service"].DeploymentConfig
+	if !autoscaler.NumReplicas.Auto || !autoscaler.HasAutoscaling() {
+		t.Fatalf("unexpected autoscaler config %+v", autoscaler)
+	}
+}
+
+func TestDeploymentConfigKeepsUntypedFields(t *testing.T) {
+	var config DeploymentConfig
+	if err := json.Unmarshal([]byte(`{"name":"image_service","num_replicas":2,"ray_actor_options":{"num_gpus":1}}`), &config); err != nil {
+		t.Fatal(err)
+	}
+	config.NumReplicas = &NumReplicas{Count: 5}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	_ = json.Unmarshal(data, &fields)
+	if fields["num_replicas"] != 5.0 || fields["ray_actor_options"] == nil || fields["name"] != "image_service" {
+		t.Fatalf("unexpected config %s", data)
+	}
+
+	if err := json.Unmarshal([]byte(`{"num_replicas":"many"}`), &config); err == nil {
+		t.Fatal("expected an error for an invalid num_replicas")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"net/http"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
@@ -25,9 +26,22 @@ func main() {
 	r := gin.Default()
 
 	r.POST("/submit-job", handler.SubmitJobHandler)
+	r.POST("/generate-job", handler.GenerateJobHandler)
+	r.POST("/simulate", handler.SimulateHandler)
 	r.GET("/download-result", handler.DownloadResultHandler)
 	r.GET("/download-metrics", handler.DownloadMetricsHandler)
+	r.GET("/download-manifest", handler.DownloadManifestHandler)
+	r.GET("/download-dispatch", handler.DownloadDispatchHandler)
+	r.GET("/download-attempts", handler.DownloadAttemptsHandler)
 	r.GET("/metrics", handler.MetricsHandler)
+	r.GET("/endpoints", handler.EndpointsHandler)
+	r.POST("/scale", handler.ScaleHandler)
+
+	r.GET("/batches", handler.ListBatchesHandler)
+	r.GET("/batches/:name", handler.GetBatchHandler)
+	r.POST("/batches/:name/pause", handler.PauseBatchHandler)
+	r.POST("/batches/:name/resume", handler.ResumeBatchHandler)
+	r.POST("/batches/:name/cancel", handler.CancelBatchHandler)
 
 	port := fmt.Sprintf(":%d", config.C.Port)
 	slog.Info("Server starting...", "port", config.C.Port)
@@ -40,7 +54,10 @@ func main() {
 		Handler: r,
 	}
 
-	initialize()
+	if err := initialize(); err != nil {
+		slog.Error("Failed to initialize", "error", err.Error())
+		os.Exit(1)
+	}
 	defer shutdown()
 
 	go func() {
@@ -62,16 +79,18 @@ func main() {
 	}
 }
 
-func initialize() {
+func initialize() error {
 	metrics.Client = metrics.NewInternalClient()
 
+	var k8sClient *kubernetes.Clientset
 	k8sConfig, err := rest.InClusterConfig()
 	if err != nil {
 		slog.Error("Failed to create in-cluster config", "error", err.Error())
 	} else {
-		k8sClient, err := kubernetes.NewForConfig(k8sConfig)
+		k8sClient, err = kubernetes.NewForConfig(k8sConfig)
 		if err != nil {
 			slog.Error("Failed to create Kubernetes client", "error", err.Error())
+			k8sClient = nil
 		} else {
 			if endpoint, _ := metrics.DiscoverDogStatsDEndpoint(k8sClient); err == nil {
 				metrics.DatadogClient, _ = metrics.NewDogStatsDClient(endpoint)
@@ -83,8 +102,8 @@ func initialize() {
 		metrics.DatadogClient = metrics.NewDummyClient()
 	}
 
-	core.Scheduler = core.NewJobScheduler()
-	core.Scheduler.Start()
+	core.Scheduler = core.NewJobScheduler(k8sClient)
+	return core.Scheduler.Start()
 }
 
 func shutdown() {
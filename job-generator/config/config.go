@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"os"
 	"strconv"
+	"strings"
 )
 
 var C Config
@@ -12,25 +13,60 @@ var C Config
 type Config struct {
 	Port                       int
 	RayDashboardEndpoint       string
-	APIEndpoint                string
+	ServeApplication           string
+	ServeDeployment            string
+	ServeImportPath            string
+	ServeImportPaths           string // comma separated app=import_path of the other applications deployed imperatively
+	APIEndpoint                string // comma separated list of ray serve endpoints
+	AutoscalerEndpoint         string // defaults to the first api endpoint
+	ControllerEndpoint         string // of the ray-serve controller app, defaults to the autoscaler endpoint
+	EndpointDiscovery          bool   // discover api endpoints from pods matching LabelSelector
+	DiscoveryInterval          int    // in seconds
+	LoadBalancePolicy          string // round_robin, least_outstanding or power_of_two
 	Environment                string
 	LabelSelector              string
 	OutputFilePath             string
-	MaxRetryCount              int
-	MetricsAggregationInterval int // in seconds
+	MaxRetryCount              int     // max attempts of a job
+	RetryBaseDelay             int     // in milliseconds, doubled on every retry
+	RetryMaxDelay              int     // in milliseconds
+	RetryBudget                float64 // max retries of a batch as a fraction of its dispatched jobs
+	MetricsAggregationInterval int     // in seconds
 	MaxQueueSize               int
-	MaxRetryQueueSize          int
-	ShutdownPeriod             int // in seconds
+	MaxRetryQueueSize          int    // 0 for unlimited
+	RetryQueueOverflow         string // drop, block or fail
+	ShutdownPeriod             int    // in seconds, grace period for in-flight jobs on shutdown
 	ImageStorePath             string
 	APITimeout                 int // in seconds
+	ControlTimeout             int // in seconds, for autoscaler and dashboard calls
+	MaxInflightRequests        int // 0 for unlimited
+	MaxInflightPerEndpoint     int // 0 for unlimited
 
-	EnableAutoScaling bool
-	InitWorkerCount   int
-	MetricsWindow     int // in seconds
-	ForecastWindow    int // how many data points to observe
-	WorkerCostPerHour float64
-	JobReward         float64
-	LatencyThreshold  int // in milliseconds
+	EnableAutoScaling   bool
+	ScaleActuator       string // ray_serve, kubernetes, controller or record
+	ScaleTarget         string // the Kubernetes Deployment scaled by the kubernetes actuator
+	ScaleTargetHPA      string // the HPA of ScaleTarget, pinned to the replicas instead of scaling the Deployment
+	InitWorkerCount     int
+	ScalePolicy         string  // remote, target_queue, target_utilization, littles_law or step
+	FallbackPolicy      string  // used while the scale policy fails, empty for none
+	TargetJobsPerWorker float64 // of the target_queue policy
+	TargetUtilization   float64 // of the target_utilization policy
+	StepUpThreshold     float64 // ongoing jobs per worker above which the step policy adds one
+	StepDownThreshold   float64 // ongoing jobs per worker below which the step policy removes one
+	StepCooldown        int     // in seconds, between two steps of the step policy
+	MinReplicas         int
+	MaxReplicas         int // 0 for unlimited
+	ScaleUpCooldown     int // in seconds since the last scale action
+	ScaleDownCooldown   int // in seconds since the last scale action
+	MaxScaleStep        int // max workers added or removed at once, 0 for unlimited
+	StabilizationWindow int // in seconds, scaling down goes no lower than the highest recommendation in it
+	MetricsWindow       int // in seconds
+	ForecastWindow      int // how many data points to observe
+	ObservationVersion  int // of the observations sent to the autoscaler, 0 to negotiate the latest
+	WorkerCostPerHour   float64
+	JobReward           float64
+	LatencyThreshold    int     // in milliseconds
+	JobSLO              int     // in milliseconds, jobs unfinished this long after their request are abandoned, 0 to disable
+	AbandonPenalty      float64 // reward lost for every abandoned job
 }
 
 func LoadConfig() {
@@ -42,24 +78,72 @@ func LoadConfig() {
 	C = Config{
 		Port:                       getEnvInt("PORT", 8080),
 		RayDashboardEndpoint:       getEnv("RAY_DASHBOARD_ENDPOINT", "ray-service:8265"),
+		ServeApplication:           getEnv("SERVE_APPLICATION", "text2img"),
+		ServeDeployment:            getEnv("SERVE_DEPLOYMENT", "image_service"),
+		ServeImportPath:            getEnv("SERVE_IMPORT_PATH", "core.image_service:entrypoint"),
+		ServeImportPaths:           getEnv("SERVE_IMPORT_PATHS", "controller=core.controller:controllerEntrypoint,autoscaler=core.autoscaler:autoscalerEndpoint"),
 		APIEndpoint:                getEnv("API_ENDPOINT", "ray-service:8000"),
+		AutoscalerEndpoint:         getEnv("AUTOSCALER_ENDPOINT", ""),
+		ControllerEndpoint:         getEnv("CONTROLLER_ENDPOINT", ""),
+		EndpointDiscovery:          getEnvBool("ENDPOINT_DISCOVERY", false),
+		DiscoveryInterval:          getEnvInt("DISCOVERY_INTERVAL", 10),
+		LoadBalancePolicy:          getEnv("LOAD_BALANCE_POLICY", "round_robin"),
 		Environment:                getEnv("ENVIRONMENT", "ypp"),
 		LabelSelector:              getEnv("LABEL_SELECTOR", "worker"),
 		OutputFilePath:             getEnv("OUTPUT_FILE_PATH", "./tmp/output"),
 		MaxRetryCount:              getEnvInt("MAX_RETRY_COUNT", 1),
+		RetryBaseDelay:             getEnvInt("RETRY_BASE_DELAY", 500),
+		RetryMaxDelay:              getEnvInt("RETRY_MAX_DELAY", 30000),
+		RetryBudget:                getEnvFloat("RETRY_BUDGET", 0.1),
 		MetricsAggregationInterval: getEnvInt("METRICS_AGGREGATION_INTERVAL", 1),
 		MaxQueueSize:               getEnvInt("MAX_QUEUE_SIZE", 60000),
 		MaxRetryQueueSize:          getEnvInt("MAX_RETRY_QUEUE_SIZE", 1000),
+		RetryQueueOverflow:         getEnv("RETRY_QUEUE_OVERFLOW", "drop"),
 		ShutdownPeriod:             getEnvInt("SHUTDOWN_PERIOD", 2),
 		APITimeout:                 getEnvInt("API_TIMEOUT", 3600),
+		ControlTimeout:             getEnvInt("CONTROL_TIMEOUT", 10),
+		MaxInflightRequests:        getEnvInt("MAX_INFLIGHT_REQUESTS", 0),
+		MaxInflightPerEndpoint:     getEnvInt("MAX_INFLIGHT_PER_ENDPOINT", 0),
 
-		EnableAutoScaling: getEnvBool("ENABLE_AUTO_SCALING", false),
-		InitWorkerCount:   getEnvInt("INIT_WORKER_COUNT", 1),
-		MetricsWindow:     getEnvInt("METRICS_WINDOW", 10),
-		ForecastWindow:    getEnvInt("FORECAST_WINDOW", 36),
-		WorkerCostPerHour: getEnvFloat("WORKER_COST_PER_HOUR", 1),
-		JobReward:         getEnvFloat("JOB_REWARD", 0.002),
-		LatencyThreshold:  getEnvInt("LATENCY_THRESHOLD", 8000),
+		EnableAutoScaling:   getEnvBool("ENABLE_AUTO_SCALING", false),
+		ScaleActuator:       getEnv("SCALE_ACTUATOR", "ray_serve"),
+		ScaleTarget:         getEnv("SCALE_TARGET", "sd-webui"),
+		ScaleTargetHPA:      getEnv("SCALE_TARGET_HPA", ""),
+		InitWorkerCount:     getEnvInt("INIT_WORKER_COUNT", 1),
+		ScalePolicy:         getEnv("SCALE_POLICY", "remote"),
+		FallbackPolicy:      getEnv("FALLBACK_POLICY", ""),
+		TargetJobsPerWorker: getEnvFloat("TARGET_JOBS_PER_WORKER", 2),
+		TargetUtilization:   getEnvFloat("TARGET_UTILIZATION", 0.8),
+		StepUpThreshold:     getEnvFloat("STEP_UP_THRESHOLD", 4),
+		StepDownThreshold:   getEnvFloat("STEP_DOWN_THRESHOLD", 1),
+		StepCooldown:        getEnvInt("STEP_COOLDOWN", 60),
+		MinReplicas:         getEnvInt("MIN_REPLICAS", 1),
+		MaxReplicas:         getEnvInt("MAX_REPLICAS", 0),
+		ScaleUpCooldown:     getEnvInt("SCALE_UP_COOLDOWN", 0),
+		ScaleDownCooldown:   getEnvInt("SCALE_DOWN_COOLDOWN", 0),
+		MaxScaleStep:        getEnvInt("MAX_SCALE_STEP", 0),
+		StabilizationWindow: getEnvInt("STABILIZATION_WINDOW", 0),
+		MetricsWindow:       getEnvInt("METRICS_WINDOW", 10),
+		ForecastWindow:      getEnvInt("FORECAST_WINDOW", 36),
+		ObservationVersion:  getEnvInt("OBSERVATION_VERSION", 0),
+		WorkerCostPerHour:   getEnvFloat("WORKER_COST_PER_HOUR", 1),
+		JobReward:           getEnvFloat("JOB_REWARD", 0.002),
+		LatencyThreshold:    getEnvInt("LATENCY_THRESHOLD", 8000),
+		JobSLO:              getEnvInt("JOB_SLO", 0),
+		AbandonPenalty:      getEnvFloat("ABANDON_PENALTY", 0),
+	}
+
+	// a ticker panics on a non-positive interval
+	if C.DiscoveryInterval <= 0 {
+		slog.Error("DISCOVERY_INTERVAL must be positive, using the default", "value", C.DiscoveryInterval)
+		C.DiscoveryInterval = 10
+	}
+
+	if C.AutoscalerEndpoint == "" {
+		C.AutoscalerEndpoint = strings.TrimSpace(strings.Split(C.APIEndpoint, ",")[0])
+	}
+	if C.ControllerEndpoint == "" {
+		C.ControllerEndpoint = C.AutoscalerEndpoint
 	}
 
 	_ = os.MkdirAll(C.OutputFilePath, os.ModePerm)
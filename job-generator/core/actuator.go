@@ -0,0 +1,190 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"github.com/paopaoyue/kscale/job-genrator/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	ActuatorRayServe   = "ray_serve"
+	ActuatorKubernetes = "kubernetes"
+	ActuatorController = "controller"
+	ActuatorRecord     = "record"
+)
+
+// Actuator applies the worker count decided by the scaler and reports the workers actually there
+type Actuator interface {
+	Name() string
+	Scale(ctx context.Context, replicas int) error
+	Replicas(ctx context.Context) (running, total int, err error)
+}
+
+// NewActuator builds the actuator of the given kind, k8sClient is only needed by the kubernetes one
+func NewActuator(kind string, client *api.Client, k8sClient *kubernetes.Clientset, namespace, deployment, hpa string) (Actuator, error) {
+	switch kind {
+	case ActuatorRayServe:
+		return NewRayServeActuator(client), nil
+	case ActuatorKubernetes:
+		if k8sClient == nil {
+			return nil, fmt.Errorf("the %s actuator needs a Kubernetes client", kind)
+		}
+		// the guardrails keep the replicas at MinReplicas, an HPA cannot be pinned below one replica
+		if hpa != "" && config.C.MinReplicas < 1 {
+			return nil, fmt.Errorf("the hpa '%s' cannot be pinned to %d replicas, MIN_REPLICAS must be at least 1", hpa, config.C.MinReplicas)
+		}
+		return NewKubernetesActuator(k8sClient, namespace, deployment, hpa), nil
+	case ActuatorController:
+		return NewControllerActuator(client), nil
+	case ActuatorRecord:
+		return NewRecordActuator(config.C.InitWorkerCount), nil
+	default:
+		return nil, fmt.Errorf("unknown actuator '%s'", kind)
+	}
+}
+
+// RayServeActuator sets num_replicas of the served deployment through the ray dashboard
+type RayServeActuator struct {
+	client *api.Client
+}
+
+func NewRayServeActuator(client *api.Client) *RayServeActuator {
+	return &RayServeActuator{client: client}
+}
+
+func (a *RayServeActuator) Name() string { return ActuatorRayServe }
+
+func (a *RayServeActuator) Scale(ctx context.Context, replicas int) error {
+	return a.client.ScaleWorker(ctx, replicas)
+}
+
+func (a *RayServeActuator) Replicas(ctx context.Context) (int, int, error) {
+	return a.client.GetWorkerCount(ctx)
+}
+
+// ControllerActuator goes through the /replicas endpoint of the ray-serve controller app
+type ControllerActuator struct {
+	client *api.Client
+}
+
+func NewControllerActuator(client *api.Client) *ControllerActuator {
+	return &ControllerActuator{client: client}
+}
+
+func (a *ControllerActuator) Name() string { return ActuatorController }
+
+func (a *ControllerActuator) Scale(ctx context.Context, replicas int) error {
+	return a.client.SetControllerReplicas(ctx, replicas)
+}
+
+func (a *ControllerActuator) Replicas(ctx context.Context) (int, int, error) {
+	return a.client.GetControllerReplicas(ctx)
+}
+
+// KubernetesActuator scales a Deployment, such as the plain sd-webui one, through its scale subresource.
+// If an HPA manages the Deployment it would undo that, so its min and max replicas are pinned instead.
+type KubernetesActuator struct {
+	client     kubernetes.Interface
+	namespace  string
+	deployment string
+	hpa        string
+}
+
+func NewKubernetesActuator(client kubernetes.Interface, namespace, deployment, hpa string) *KubernetesActuator {
+	return &KubernetesActuator{client: client, namespace: namespace, deployment: deployment, hpa: hpa}
+}
+
+func (a *KubernetesActuator) Name() string { return ActuatorKubernetes }
+
+func (a *KubernetesActuator) Scale(ctx context.Context, replicas int) error {
+	if a.hpa != "" {
+		return a.pinHPA(ctx, int32(replicas))
+	}
+	deployments := a.client.AppsV1().Deployments(a.namespace)
+	scale, err := deployments.GetScale(ctx, a.deployment, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get scale of deployment '%s': %w", a.deployment, err)
+	}
+	scale.Spec.Replicas = int32(replicas)
+	// the resource version of the scale read above makes a concurrent change fail the update
+	if _, err := deployments.UpdateScale(ctx, a.deployment, scale, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to scale deployment '%s': %w", a.deployment, err)
+	}
+	return nil
+}
+
+// pinHPA fails below one replica, which an HPA cannot go to, so the scaler does not expect replicas
+// that are not there
+func (a *KubernetesActuator) pinHPA(ctx context.Context, replicas int32) error {
+	if replicas < 1 {
+		return fmt.Errorf("failed to pin hpa '%s' to %d replicas, it cannot go below one", a.hpa, replicas)
+	}
+	hpas := a.client.AutoscalingV1().HorizontalPodAutoscalers(a.namespace)
+	hpa, err := hpas.Get(ctx, a.hpa, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get hpa '%s': %w", a.hpa, err)
+	}
+	if hpa.Spec.ScaleTargetRef.Name != a.deployment {
+		slog.Warn("HPA does not target the scaled deployment", "hpa", a.hpa, "target", hpa.Spec.ScaleTargetRef.Name, "deployment", a.deployment)
+	}
+	hpa.Spec.MinReplicas = &replicas
+	hpa.Spec.MaxReplicas = replicas
+	if _, err := hpas.Update(ctx, hpa, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update hpa '%s': %w", a.hpa, err)
+	}
+	return nil
+}
+
+func (a *KubernetesActuator) Replicas(ctx context.Context) (int, int, error) {
+	deployment, err := a.client.AppsV1().Deployments(a.namespace).Get(ctx, a.deployment, metav1.GetOptions{})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get deployment '%s': %w", a.deployment, err)
+	}
+	return int(deployment.Status.ReadyReplicas), int(deployment.Status.Replicas), nil
+}
+
+type ScaleDecision struct {
+	Time     time.Time `json:"time"`
+	Replicas int       `json:"replicas"`
+}
+
+// RecordActuator only records the decisions, for shadow experiments that must not touch the cluster.
+// The recorded workers come up at once, so the scaler sees its own decisions as applied.
+type RecordActuator struct {
+	mu        *sync.Mutex
+	decisions []ScaleDecision
+	replicas  int
+}
+
+func NewRecordActuator(replicas int) *RecordActuator {
+	return &RecordActuator{mu: &sync.Mutex{}, decisions: []ScaleDecision{}, replicas: replicas}
+}
+
+func (a *RecordActuator) Name() string { return ActuatorRecord }
+
+func (a *RecordActuator) Scale(ctx context.Context, replicas int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.decisions = append(a.decisions, ScaleDecision{Time: time.Now(), Replicas: replicas})
+	a.replicas = replicas
+	slog.Info("Recorded scale decision", "replicas", replicas)
+	return nil
+}
+
+func (a *RecordActuator) Replicas(ctx context.Context) (int, int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.replicas, a.replicas, nil
+}
+
+func (a *RecordActuator) Decisions() []ScaleDecision {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]ScaleDecision{}, a.decisions...)
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"context"
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"github.com/paopaoyue/kscale/job-genrator/config"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKubernetesActuator(t *testing.T) {
+	replicas := int32(1)
+	client := fake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "sd-webui", Namespace: "ypp"},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			Status:     appsv1.DeploymentStatus{Replicas: 2, ReadyReplicas: 1},
+		},
+		&autoscalingv1.HorizontalPodAutoscaler{
+			ObjectMeta: metav1.ObjectMeta{Name: "sd-webui", Namespace: "ypp"},
+			Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+				ScaleTargetRef: autoscalingv1.CrossVersionObjectReference{Kind: "Deployment", Name: "sd-webui"},
+				MaxReplicas:    4,
+			},
+		},
+	)
+	ctx := context.Background()
+	// the fake clientset does not serve the scale subresource, back it by the deployment
+	client.PrependReactor("get", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		name := action.(k8stesting.GetAction).GetName()
+		deployment, err := client.Tracker().Get(appsv1.SchemeGroupVersion.WithResource("deployments"), "ypp", name)
+		if err != nil {
+			return true, nil, err
+		}
+		return true, &autoscalingv1.Scale{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ypp"},
+			Spec:       autoscalingv1.ScaleSpec{Replicas: *deployment.(*appsv1.Deployment).Spec.Replicas},
+		}, nil
+	})
+	client.PrependReactor("update", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		scale := action.(k8stesting.UpdateAction).GetObject().(*autoscalingv1.Scale)
+		obj, err := client.Tracker().Get(appsv1.SchemeGroupVersion.WithResource("deployments"), "ypp", scale.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		deployment := obj.(*appsv1.Deployment)
+		deployment.Spec.Replicas = &scale.Spec.Replicas
+		return true, scale, client.Tracker().Update(appsv1.SchemeGroupVersion.WithResource("deployments"), deployment, "ypp")
+	})
+
+	actuator := NewKubernetesActuator(client, "ypp", "sd-webui", "")
+	if running, total, err := actuator.Replicas(ctx); err != nil || running != 1 || total != 2 {
+		t.Fatalf("expected 1 of 2 replicas ready, got %d of %d, %v", running, total, err)
+	}
+	if err := actuator.Scale(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	deployment, _ := client.AppsV1().Deployments("ypp").Get(ctx, "sd-webui", metav1.GetOptions{})
+	if *deployment.Spec.Replicas != 3 {
+		t.Fatalf("expected 3 replicas, got %d", *deployment.Spec.Replicas)
+	}
+
+	actuator = NewKubernetesActuator(client, "ypp", "sd-webui", "sd-webui")
+	if err := actuator.Scale(ctx, 0); err == nil {
+		t.Fatal("expected pinning the hpa to 0 replicas to fail")
+	}
+	if err := actuator.Scale(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	hpa, _ := client.AutoscalingV1().HorizontalPodAutoscalers("ypp").Get(ctx, "sd-webui", metav1.GetOptions{})
+	if *hpa.Spec.MinReplicas != 2 || hpa.Spec.MaxReplicas != 2 {
+		t.Fatalf("expected the hpa pinned to 2 replicas, got %d-%d", *hpa.Spec.MinReplicas, hpa.Spec.MaxReplicas)
+	}
+}
+
+func TestNewActuatorRejectsHPAWithoutReplicas(t *testing.T) {
+	saved := config.C
+	t.Cleanup(func() { config.C = saved })
+	config.C.MinReplicas = 0
+	if _, err := NewActuator(ActuatorKubernetes, nil, &kubernetes.Clientset{}, "ypp", "sd-webui", "sd-webui"); err == nil {
+		t.Fatal("expected an hpa with 0 min replicas rejected")
+	}
+	if _, err := NewActuator(ActuatorKubernetes, nil, &kubernetes.Clientset{}, "ypp", "sd-webui", ""); err != nil {
+		t.Fatalf("expected the deployment scaled to 0 replicas without an hpa, got %v", err)
+	}
+}
+
+func TestControllerActuator(t *testing.T) {
+	var scaled string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/controller/replicas" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == http.MethodPost {
+			scaled = r.URL.Query().Get("count")
+			_, _ = w.Write([]byte(`{"result":"ok"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"running":2,"total":3}`))
+	}))
+	defer server.Close()
+
+	actuator := NewControllerActuator(api.NewClient(server.URL, server.URL, server.Client(), time.Second, time.Second))
+	if err := actuator.Scale(context.Background(), 5); err != nil || scaled != "5" {
+		t.Fatalf("expected a request for 5 replicas, got %q, %v", scaled, err)
+	}
+	if running, total, err := actuator.Replicas(context.Background()); err != nil || running != 2 || total != 3 {
+		t.Fatalf("expected 2 of 3 replicas running, got %d of %d, %v", running, total, err)
+	}
+}
+
+func TestRecordActuator(t *testing.T) {
+	actuator := NewRecordActuator(1)
+	if running, total, _ := actuator.Replicas(context.Background()); running != 1 || total != 1 {
+		t.Fatalf("expected the initial replicas, got %d of %d", running, total)
+	}
+	_ = actuator.Scale(context.Background(), 4)
+	_ = actuator.Scale(context.Background(), 2)
+	if running, _, _ := actuator.Replicas(context.Background()); running != 2 {
+		t.Fatalf("expected the last decision to be applied, got %d", running)
+	}
+	if decisions := actuator.Decisions(); len(decisions) != 2 || decisions[0].Replicas != 4 {
+		t.Fatalf("unexpected decisions %+v", decisions)
+	}
+}
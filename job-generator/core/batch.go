@@ -0,0 +1,492 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/paopaoyue/kscale/job-genrator/config"
+	"github.com/paopaoyue/kscale/job-genrator/util"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type BatchState string
+
+const (
+	BatchRunning   BatchState = "running"
+	BatchPaused    BatchState = "paused"
+	BatchCompleted BatchState = "completed"
+	BatchCancelled BatchState = "cancelled"
+	BatchFailed    BatchState = "failed"
+)
+
+var (
+	ErrBatchNotFound     = errors.New("job batch not found")
+	ErrBatchNotRunning   = errors.New("job batch is not running")
+	ErrBatchNotPaused    = errors.New("job batch is not paused")
+	ErrBatchAlreadyEnded = errors.New("job batch has already ended")
+)
+
+type JobBatch struct {
+	Name      string
+	Size      int
+	Options   ReplayOptions
+	TraceTime time.Duration
+	StartTime time.Time
+	EndTime   time.Time
+
+	iter   JobSource
+	rand   *util.Rand // seeded by the manifest, for the retry jitter and the endpoint picks of its jobs
+	scaler *Scaler
+	scope  *scope // of the batch in the scaler once started
+	clock  Clock  // the clock of the scaler, which observes the batch
+
+	jobChan      chan<- Job
+	outputChan   chan Job
+	ctx          context.Context // cancelled once the batch ends, aborting its requests in flight
+	cancel       context.CancelFunc
+	stopChan     chan struct{}
+	resumeChan   chan struct{}
+	dispatchChan chan struct{} // closed once the trace is fully dispatched
+	doneChan     chan struct{} // closed once the result of every dispatched job is written
+
+	dispatched atomic.Int32
+	completed  atomic.Int32
+	failed     atomic.Int32
+	abandoned  atomic.Int32
+	retries    retryBudget
+
+	mu             *sync.Mutex
+	state          BatchState
+	pausedAt       time.Time
+	pausedDuration time.Duration
+	jobTicker      Ticker
+	manifest       RunManifest
+	skew           skewStats
+}
+
+type JobBatchStatus struct {
+	Name       string        `json:"name"`
+	State      BatchState    `json:"state"`
+	Options    ReplayOptions `json:"options"`
+	Submitted  int           `json:"submitted"`
+	Dispatched int           `json:"dispatched"`
+	Completed  int           `json:"completed"`
+	Failed     int           `json:"failed"`
+	Abandoned  int           `json:"abandoned"`
+	Retries    int           `json:"retries"`
+	StartTime  time.Time     `json:"start_time"`
+	Elapsed    float64       `json:"elapsed"`    // in seconds
+	TraceTime  float64       `json:"trace_time"` // in seconds
+	ETA        float64       `json:"eta"`        // in seconds
+}
+
+func NewJobBatch(manifest RunManifest, iter JobSource, scaler *Scaler, jobChan chan<- Job) *JobBatch {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobBatch{
+		Name:      manifest.Batch,
+		Size:      iter.Size(),
+		Options:   manifest.Options,
+		TraceTime: iter.Duration(),
+
+		iter:   iter,
+		rand:   util.NewRand(manifest.Seed, 2), // a workload draws from the streams 0 and 1
+		scaler: scaler,
+		clock:  scaler.clock,
+
+		jobChan:      jobChan,
+		outputChan:   make(chan Job),
+		ctx:          ctx,
+		cancel:       cancel,
+		stopChan:     make(chan struct{}),
+		dispatchChan: make(chan struct{}),
+		doneChan:     make(chan struct{}),
+
+		mu:       &sync.Mutex{},
+		manifest: manifest,
+	}
+}
+
+func (b *JobBatch) Active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == BatchRunning || b.state == BatchPaused
+}
+
+func (b *JobBatch) Start() {
+	b.begin()
+	b.scope = b.scaler.Attach(b.Name, b.StartTime)
+
+	b.processOutput()
+
+	go func() {
+		// catch panic
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("Ticker recovered from panic", "batch", b.Name, "error", r)
+			}
+		}()
+		b.dispatch()
+	}()
+}
+
+// begin marks the batch running from now and writes its manifest
+func (b *JobBatch) begin() {
+	b.mu.Lock()
+	b.state = BatchRunning
+	b.StartTime = b.clock.Now()
+	b.manifest.StartTime = b.StartTime
+	b.manifest.State = b.state
+	manifest := b.manifest
+	b.mu.Unlock()
+	writeManifest(manifest)
+}
+
+func (b *JobBatch) Pause() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BatchRunning {
+		return ErrBatchNotRunning
+	}
+	b.state = BatchPaused
+	b.pausedAt = b.clock.Now()
+	b.resumeChan = make(chan struct{})
+	slog.Info("Job batch paused", "Name", b.Name)
+	return nil
+}
+
+func (b *JobBatch) Resume() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BatchPaused {
+		return ErrBatchNotPaused
+	}
+	b.state = BatchRunning
+	b.pausedDuration += b.clock.Now().Sub(b.pausedAt)
+	b.pausedAt = time.Time{}
+	close(b.resumeChan)
+	b.resumeChan = nil
+	slog.Info("Job batch resumed", "Name", b.Name)
+	return nil
+}
+
+func (b *JobBatch) Cancel() error {
+	if !b.finish(BatchCancelled) {
+		return ErrBatchAlreadyEnded
+	}
+	slog.Info("Job batch cancelled", "Name", b.Name, "Dispatched", b.dispatched.Load(), "Size", b.Size)
+	return nil
+}
+
+func (b *JobBatch) fail(reason string) {
+	if b.finish(BatchFailed) {
+		slog.Error("Job batch failed", "Name", b.Name, "reason", reason, "Dispatched", b.dispatched.Load(), "Size", b.Size)
+	}
+}
+
+func (b *JobBatch) Status() JobBatchStatus {
+	b.mu.Lock()
+	state := b.state
+	startTime := b.StartTime
+	elapsed := b.elapsed(b.clock.Now())
+	b.mu.Unlock()
+
+	status := JobBatchStatus{
+		Name:       b.Name,
+		State:      state,
+		Options:    b.Options,
+		Submitted:  b.Size,
+		Dispatched: int(b.dispatched.Load()),
+		Completed:  int(b.completed.Load()),
+		Failed:     int(b.failed.Load()),
+		Abandoned:  int(b.abandoned.Load()),
+		Retries:    int(b.retries.retries.Load()),
+		StartTime:  startTime,
+		Elapsed:    elapsed.Seconds(),
+		TraceTime:  b.TraceTime.Seconds(),
+	}
+	if state == BatchRunning || state == BatchPaused {
+		status.ETA = b.eta(elapsed, status.Completed+status.Failed+status.Abandoned).Seconds()
+	}
+	return status
+}
+
+// eta is the remaining trace time, or once the trace is fully dispatched,
+// the time to drain the outstanding jobs at the throughput observed so far
+func (b *JobBatch) eta(elapsed time.Duration, finished int) time.Duration {
+	if remaining := b.TraceTime - elapsed; remaining > 0 {
+		return remaining
+	}
+	outstanding := b.Size - finished
+	if outstanding <= 0 || finished == 0 {
+		return 0
+	}
+	return time.Duration(float64(elapsed) / float64(finished) * float64(outstanding))
+}
+
+// elapsed returns the replay time of the batch excluding paused periods, must be called with mu held
+func (b *JobBatch) elapsed(now time.Time) time.Duration {
+	if b.StartTime.IsZero() {
+		return 0
+	}
+	if !b.EndTime.IsZero() {
+		now = b.EndTime
+	}
+	paused := b.pausedDuration
+	if !b.pausedAt.IsZero() {
+		paused += now.Sub(b.pausedAt)
+	}
+	return now.Sub(b.StartTime) - paused
+}
+
+func (b *JobBatch) finish(state BatchState) bool {
+	b.mu.Lock()
+	if b.state != BatchRunning && b.state != BatchPaused {
+		b.mu.Unlock()
+		return false
+	}
+	b.state = state
+	b.EndTime = b.clock.Now()
+	if !b.pausedAt.IsZero() {
+		b.pausedDuration += b.EndTime.Sub(b.pausedAt)
+		b.pausedAt = time.Time{}
+	}
+	close(b.stopChan)
+	b.cancel()
+
+	b.manifest.EndTime = &b.EndTime
+	b.manifest.State = state
+	b.manifest.Dispatch = b.skew.accuracy()
+	manifest := b.manifest
+	b.mu.Unlock()
+
+	b.scaler.Detach(b.scope)
+	writeManifest(manifest)
+	return true
+}
+
+func (b *JobBatch) finished() int32 {
+	return b.completed.Load() + b.failed.Load() + b.abandoned.Load()
+}
+
+// allowRetry takes one retry from the budget of the batch
+func (b *JobBatch) allowRetry(fraction float64) bool {
+	return b.retries.acquire(fraction, b.dispatched.Load())
+}
+
+func (b *JobBatch) Manifest() RunManifest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.manifest
+}
+
+// waitResume blocks while the batch is paused, returns false if the batch is stopped meanwhile
+func (b *JobBatch) waitResume() bool {
+	b.mu.Lock()
+	resumeChan := b.resumeChan
+	b.mu.Unlock()
+	if resumeChan == nil {
+		return true
+	}
+	select {
+	case <-resumeChan:
+		return true
+	case <-b.stopChan:
+		return false
+	}
+}
+
+func (b *JobBatch) dispatch() {
+	b.jobTicker = b.clock.NewTicker(1 * time.Millisecond)
+	defer b.jobTicker.Stop()
+	defer b.iter.Close()
+	defer close(b.dispatchChan)
+
+	file := OpenCSVAndWriteHeader(filepath.Join(config.C.OutputFilePath, b.Name+"-dispatch.csv"), dispatchHeader)
+	defer file.Close()
+
+	var (
+		job     Job
+		hasNext bool
+	)
+	if job, hasNext = b.iter.Next(); !hasNext {
+		return
+	}
+	for {
+		select {
+		case <-b.stopChan:
+			return
+		case <-b.jobTicker.C():
+			if !b.waitResume() {
+				return
+			}
+			current := b.clock.Now()
+			b.mu.Lock()
+			timeElapsed := b.elapsed(current)
+			b.mu.Unlock()
+			jobTime := job.RequestTime.Sub(time.UnixMilli(0))
+			for timeElapsed >= jobTime {
+				b.prepare(&job, jobTime, current)
+				select {
+				case b.jobChan <- job:
+				case <-b.stopChan:
+					return
+				}
+				b.dispatched.Add(1)
+				b.recordDispatch(file, job.Id, jobTime, timeElapsed)
+				if job, hasNext = b.iter.Next(); hasNext {
+					jobTime = job.RequestTime.Sub(time.UnixMilli(0))
+				} else {
+					break
+				}
+			}
+			if hasNext {
+				b.jobTicker.Reset(jobTime - timeElapsed)
+			}
+		}
+		if !hasNext {
+			if err := b.iter.Err(); err != nil {
+				slog.Error("Job batch trace ended early", "Name", b.Name, "Dispatched", b.dispatched.Load(), "err", err)
+			}
+			return
+		}
+	}
+}
+
+// prepare stamps a job of the trace leaving the scheduler at current and counts it as new
+func (b *JobBatch) prepare(job *Job, jobTime time.Duration, current time.Time) {
+	job.batch = b
+	job.ReplayOffset = jobTime
+	job.RequestTime = current
+	job.readyAt = current
+	if config.C.JobSLO > 0 {
+		job.Deadline = current.Add(time.Duration(config.C.JobSLO) * time.Millisecond)
+	}
+	b.scope.PreProcessJob(*job)
+}
+
+var dispatchHeader = []string{
+	"Id",
+	"ScheduledOffset",
+	"DispatchOffset",
+	"Skew",
+}
+
+// recordDispatch logs how late a job left the scheduler compared to its replay offset
+func (b *JobBatch) recordDispatch(file *os.File, id string, scheduled, dispatched time.Duration) {
+	b.mu.Lock()
+	b.skew.add(dispatched - scheduled)
+	b.mu.Unlock()
+
+	AppendCSV(file, []string{
+		id,
+		strconv.FormatFloat(float64(scheduled)/float64(time.Millisecond), 'f', 3, 64),
+		strconv.FormatFloat(float64(dispatched)/float64(time.Millisecond), 'f', 3, 64),
+		strconv.FormatFloat(float64(dispatched-scheduled)/float64(time.Millisecond), 'f', 3, 64),
+	})
+}
+
+func (b *JobBatch) processOutput() {
+	file := OpenCSVAndWriteHeader(filepath.Join(config.C.OutputFilePath, b.Name+"-result.csv"), resultHeader)
+	attemptFile := OpenCSVAndWriteHeader(filepath.Join(config.C.OutputFilePath, b.Name+"-attempts.csv"), attemptHeader)
+	go func() {
+		defer close(b.doneChan)
+		defer file.Close()
+		defer attemptFile.Close()
+		// the jobs dispatched before the batch stopped are still finished or cancelled by the worker
+		dispatchChan, stopChan := b.dispatchChan, b.stopChan
+		for dispatchChan != nil || b.finished() < b.dispatched.Load() {
+			select {
+			case <-stopChan:
+				stopChan = nil
+				slog.Info("Job batch stopped", "Name", b.Name, "Completed", b.completed.Load(), "Failed", b.failed.Load(), "Abandoned", b.abandoned.Load(), "Size", b.Size)
+			case <-dispatchChan:
+				dispatchChan = nil
+			case job := <-b.outputChan:
+				b.writeOutput(file, attemptFile, job)
+			}
+		}
+
+		if b.finish(BatchCompleted) {
+			slog.Info("Job batch completed", "Name", b.Name, "Size", b.Size, "Duration", b.clock.Now().Sub(b.StartTime))
+		}
+	}()
+}
+
+// writeOutput records the result and the attempts of a finished job
+func (b *JobBatch) writeOutput(file, attemptFile *os.File, job Job) {
+	b.scope.PostProcessJob(job)
+	AppendCSV(file, resultRow(job))
+	for _, attempt := range job.Attempts {
+		AppendCSV(attemptFile, attemptRow(job.Id, attempt))
+	}
+	if job.Success {
+		b.completed.Add(1)
+	} else if job.Abandoned {
+		b.abandoned.Add(1)
+	} else {
+		b.failed.Add(1)
+	}
+}
+
+var resultHeader = []string{
+	"Id",
+	"Success",
+	"Retry",
+	"RequestTime",
+	"EndTime",
+	"Duration",
+	"Latency",
+	"TraceOffset",
+	"ReplayOffset",
+	"Abandoned",
+	"Cancelled",
+}
+
+func resultRow(job Job) []string {
+	return []string{
+		job.Id,
+		strconv.FormatBool(job.Success),
+		strconv.Itoa(job.Retry),
+		formatTimeWithMillis(job.RequestTime),
+		formatTimeWithMillis(job.EndTime),
+		strconv.FormatInt(job.Duration.Milliseconds(), 10),
+		strconv.FormatInt(job.EndTime.Sub(job.RequestTime).Milliseconds(), 10),
+		strconv.FormatInt(job.TraceOffset.Milliseconds(), 10),
+		strconv.FormatInt(job.ReplayOffset.Milliseconds(), 10),
+		strconv.FormatBool(job.Abandoned),
+		strconv.FormatBool(job.Cancelled),
+	}
+}
+
+var attemptHeader = []string{
+	"Id",
+	"Attempt",
+	"Endpoint",
+	"StartTime",
+	"EndTime",
+	"StatusCode",
+	"ErrorClass",
+	"Error",
+	"ServerDuration",
+	"QueueDelay",
+}
+
+func attemptRow(id string, attempt Attempt) []string {
+	return []string{
+		id,
+		strconv.Itoa(attempt.Number),
+		attempt.Endpoint,
+		formatTimeWithMillis(attempt.StartTime),
+		formatTimeWithMillis(attempt.EndTime),
+		strconv.Itoa(attempt.StatusCode),
+		string(attempt.ErrorClass),
+		attempt.Error,
+		strconv.FormatInt(attempt.ServerDuration.Milliseconds(), 10),
+		strconv.FormatInt(attempt.QueueDelay.Milliseconds(), 10),
+	}
+}
@@ -0,0 +1,245 @@
+package core
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and makes timers, so what waits on time can run on a clock of its own in tests
+// and in simulations
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is the part of time.Timer the clock users need
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker is the part of time.Ticker the clock users need
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+// WallClock is the real time
+var WallClock Clock = wallClock{}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time { return time.Now() }
+
+func (wallClock) NewTimer(d time.Duration) Timer { return wallTimer{timer: time.NewTimer(d)} }
+
+func (wallClock) NewTicker(d time.Duration) Ticker { return wallTicker{ticker: time.NewTicker(d)} }
+
+type wallTimer struct {
+	timer *time.Timer
+}
+
+func (t wallTimer) C() <-chan time.Time { return t.timer.C }
+
+func (t wallTimer) Stop() bool { return t.timer.Stop() }
+
+type wallTicker struct {
+	ticker *time.Ticker
+}
+
+func (t wallTicker) C() <-chan time.Time { return t.ticker.C }
+
+func (t wallTicker) Stop() { t.ticker.Stop() }
+
+func (t wallTicker) Reset(d time.Duration) { t.ticker.Reset(d) }
+
+// SimClock is the virtual time of a simulation. It stands still while the simulation handles an event
+// and jumps to the next one when asked to, so a run never depends on how fast the host is. Events at
+// the same time run in the order they were scheduled
+type SimClock struct {
+	mu     *sync.Mutex
+	now    time.Time
+	seq    int
+	events simEventHeap
+}
+
+// simEvent runs f when the clock reaches it, it is the timer of AfterFunc and NewTimer
+type simEvent struct {
+	clock *SimClock
+	at    time.Time
+	seq   int
+	index int // in the heap, -1 once run or stopped
+	f     func()
+	c     chan time.Time // nil unless made by NewTimer
+}
+
+type simEventHeap []*simEvent
+
+func (h simEventHeap) Len() int { return len(h) }
+func (h simEventHeap) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h simEventHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *simEventHeap) Push(x any) {
+	event := x.(*simEvent)
+	event.index = len(*h)
+	*h = append(*h, event)
+}
+func (h *simEventHeap) Pop() any {
+	old := *h
+	event := old[len(old)-1]
+	old[len(old)-1] = nil
+	event.index = -1
+	*h = old[:len(old)-1]
+	return event
+}
+
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{mu: &sync.Mutex{}, now: start}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc runs f on the goroutine running the events once the clock reaches d from now
+func (c *SimClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.schedule(d, f)
+}
+
+func (c *SimClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	event := c.schedule(d, nil)
+	event.c = make(chan time.Time, 1)
+	event.f = func() { event.c <- c.Now() }
+	return event
+}
+
+func (c *SimClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	t := &simTicker{clock: c, c: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// schedule must be called with mu held
+func (c *SimClock) schedule(d time.Duration, f func()) *simEvent {
+	c.seq++
+	event := &simEvent{clock: c, at: c.now.Add(max(d, 0)), seq: c.seq, f: f}
+	heap.Push(&c.events, event)
+	return event
+}
+
+// Next moves the clock to the first event and runs it, it returns false if no event is left
+func (c *SimClock) Next() bool {
+	c.mu.Lock()
+	if len(c.events) == 0 {
+		c.mu.Unlock()
+		return false
+	}
+	event := heap.Pop(&c.events).(*simEvent)
+	c.now = event.at
+	c.mu.Unlock()
+	event.f()
+	return true
+}
+
+// Advance runs the events up to d from now and leaves the clock there
+func (c *SimClock) Advance(d time.Duration) {
+	end := c.Now().Add(d)
+	for {
+		c.mu.Lock()
+		if len(c.events) == 0 || c.events[0].at.After(end) {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+		c.Next()
+	}
+}
+
+func (e *simEvent) C() <-chan time.Time { return e.c }
+
+func (e *simEvent) Stop() bool {
+	e.clock.mu.Lock()
+	defer e.clock.mu.Unlock()
+	return e.stop()
+}
+
+// stop must be called with the mutex of the clock held
+func (e *simEvent) stop() bool {
+	if e.index < 0 {
+		return false
+	}
+	heap.Remove(&e.clock.events, e.index)
+	return true
+}
+
+// simTicker ticks every interval after it was reset and drops the ticks nobody received, as time.Ticker does
+type simTicker struct {
+	clock *SimClock
+	c     chan time.Time
+
+	// guarded by the mutex of the clock
+	interval time.Duration
+	event    *simEvent // of the next tick, nil once stopped
+}
+
+func (t *simTicker) C() <-chan time.Time { return t.c }
+
+func (t *simTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if t.event != nil {
+		t.event.stop()
+		t.event = nil
+	}
+}
+
+func (t *simTicker) Reset(d time.Duration) {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if t.event != nil {
+		t.event.stop()
+	}
+	t.interval = d
+	t.arm()
+}
+
+// arm must be called with the mutex of the clock held
+func (t *simTicker) arm() {
+	event := t.clock.schedule(t.interval, nil)
+	event.f = func() { t.tick(event) }
+	t.event = event
+}
+
+func (t *simTicker) tick(event *simEvent) {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	if t.event != event {
+		return // stopped or reset while the tick was due
+	}
+	select {
+	case t.c <- t.clock.now:
+	default:
+	}
+	t.arm()
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSimClockRunsEventsInOrder(t *testing.T) {
+	clock := NewSimClock(simEpoch)
+	ran := []string{}
+	at := func(name string) func() {
+		return func() { ran = append(ran, name+"@"+clock.Now().Sub(simEpoch).String()) }
+	}
+	clock.AfterFunc(2*time.Second, at("b"))
+	clock.AfterFunc(time.Second, at("a"))
+	// events at the same time run in the order they were scheduled
+	clock.AfterFunc(2*time.Second, at("c"))
+	stopped := clock.AfterFunc(time.Second, at("stopped"))
+	clock.AfterFunc(time.Second, func() {
+		at("d")()
+		clock.AfterFunc(0, at("e"))
+	})
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("expected only the first Stop of a scheduled event to stop it")
+	}
+
+	for clock.Next() {
+	}
+	if want := []string{"a@1s", "d@1s", "e@1s", "b@2s", "c@2s"}; !slices.Equal(ran, want) {
+		t.Errorf("expected the events to run as %v, got %v", want, ran)
+	}
+}
+
+func TestSimClockAdvance(t *testing.T) {
+	clock := NewSimClock(simEpoch)
+	timer := clock.NewTimer(2 * time.Second)
+
+	clock.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("expected the timer to wait 2s")
+	default:
+	}
+	clock.Advance(1500 * time.Millisecond)
+	select {
+	case fired := <-timer.C():
+		if fired != simEpoch.Add(2*time.Second) {
+			t.Errorf("expected the timer to fire at 2s, fired at %v", fired.Sub(simEpoch))
+		}
+	default:
+		t.Fatal("expected the timer to fire")
+	}
+	if now := clock.Now().Sub(simEpoch); now != 2500*time.Millisecond {
+		t.Errorf("expected the clock at 2.5s, got %v", now)
+	}
+}
+
+func TestSimTickerTicksOnSchedule(t *testing.T) {
+	clock := NewSimClock(simEpoch)
+	ticker := clock.NewTicker(time.Second)
+
+	// a tick nobody received is dropped
+	clock.Advance(3 * time.Second)
+	if tick := <-ticker.C(); tick != simEpoch.Add(time.Second) {
+		t.Errorf("expected the first tick kept, got %v", tick.Sub(simEpoch))
+	}
+	clock.Advance(time.Second)
+	if tick := <-ticker.C(); tick != simEpoch.Add(4*time.Second) {
+		t.Errorf("expected a tick at 4s, got %v", tick.Sub(simEpoch))
+	}
+
+	// a reset ticker waits the new interval from the reset
+	clock.Advance(500 * time.Millisecond)
+	ticker.Reset(time.Hour)
+	clock.Advance(time.Hour - time.Millisecond)
+	select {
+	case tick := <-ticker.C():
+		t.Fatalf("expected no tick within the new interval, got one at %v", tick.Sub(simEpoch))
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	if tick := <-ticker.C(); tick != simEpoch.Add(time.Hour+4500*time.Millisecond) {
+		t.Errorf("expected a tick an hour after the reset, got %v", tick.Sub(simEpoch))
+	}
+
+	ticker.Stop()
+	if clock.Next() {
+		t.Error("expected no event left once the ticker stopped")
+	}
+}
@@ -1,61 +1,145 @@
 package core
 
 import (
+	"bufio"
 	"encoding/csv"
-	"github.com/paopaoyue/kscale/job-genrator/api"
+	"errors"
+	"io"
 	"log/slog"
-	"mime/multipart"
 	"os"
-	"strconv"
 	"time"
 )
 
 type CSVIterator struct {
-	reader       *csv.Reader
-	lines        [][]string
-	currentIndex int
+	traceStats
+	columns []column
+	spool   *os.File
+	reader  *csv.Reader
+	schema  *jobSchema
+	line    int // of the last record read
+	err     error
 }
 
-func ReadJobCSV(file multipart.File) (*CSVIterator, error) {
-	reader := csv.NewReader(file)
+// ReadJobCSV spools the uploaded trace to disk while validating its structure,
+// the returned iterator then reads the jobs lazily from the spooled file
+func ReadJobCSV(file io.Reader) (*CSVIterator, error) {
+	return readCSV(file, jobColumns)
+}
 
-	lines, err := reader.ReadAll()
+func readCSV(file io.Reader, columns []column) (*CSVIterator, error) {
+	it := &CSVIterator{columns: columns}
+	spool, hash, err := spoolTrace(file, "job-trace-*.csv", it.scan)
 	if err != nil {
-		slog.Error("Error reading CSV header", "err", err)
 		return nil, err
 	}
 
-	_ = file.Close()
+	it.spool = spool
+	it.hash = hash
+	if err := it.Reset(); err != nil {
+		it.Close()
+		return nil, err
+	}
+	return it, nil
+}
 
-	return &CSVIterator{
-		reader:       reader,
-		lines:        lines,
-		currentIndex: 1, // Skip header
-	}, nil
+// Reset rewinds the iterator to the first job of the spooled trace
+func (it *CSVIterator) Reset() error {
+	if it.spool == nil {
+		return os.ErrClosed
+	}
+	if _, err := it.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	it.reader = csv.NewReader(bufio.NewReader(it.spool))
+	it.reader.FieldsPerRecord = -1
+	if _, err := it.reader.Read(); err != nil { // skip header
+		return err
+	}
+	it.err = nil
+	return nil
+}
+
+// scan validates every row against the header schema and finds the size and duration
+// of the trace without keeping any row in memory
+func (it *CSVIterator) scan(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		slog.Error("Error reading CSV header", "err", err)
+		return err
+	}
+	schema, schemaErr := newJobSchema(header, it.columns)
+	if schemaErr != nil {
+		return schemaErr
+	}
+	it.schema = schema
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			slog.Error("Error reading CSV row", "err", err)
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				it.issues.add(SchemaIssue{Row: parseErr.StartLine, Reason: parseErr.Err.Error()})
+				return &it.issues
+			}
+			return err
+		}
+		// the line the record starts at, blank lines and quoted newlines included
+		line, _ := reader.FieldPos(0)
+		it.add(schema.parse(record, line))
+	}
+	return it.traceStats.err()
 }
 
 func (it *CSVIterator) Next() (Job, bool) {
-	if it.currentIndex >= len(it.lines) {
-		return Job{}, false
+	for it.reader != nil {
+		record, err := it.reader.Read()
+		if err != nil {
+			if err != io.EOF {
+				slog.Error("Error reading CSV row", "err", err)
+				it.err = err
+			}
+			it.reader = nil
+			return Job{}, false
+		}
+		it.line, _ = it.reader.FieldPos(0)
+		job, issues := it.schema.parse(record, it.line)
+		if len(issues) > 0 {
+			slog.Warn("Skipping invalid CSV row", "line", it.line, "issues", issues)
+			continue
+		}
+		return job, true
 	}
-	record := it.lines[it.currentIndex]
-	it.currentIndex++
-	return Job{
-		Id: record[0],
-		Param: api.GenerateRequestParam{
-			Prompt:       record[1],
-			Steps:        parseInt(record[2], 20),
-			Scale:        parseFloat(record[3], 7.0),
-			SamplerIndex: convertToSamplerIndex(record[4]),
-			Width:        parseInt(record[5], 512),
-			Height:       parseInt(record[6], 512),
-		},
-		RequestTime: time.UnixMilli(int64(parseInt(record[8], 0))),
-	}, true
+	return Job{}, false
 }
 
 func (it *CSVIterator) Size() int {
-	return len(it.lines) - 1
+	return it.size
+}
+
+func (it *CSVIterator) Duration() time.Duration {
+	return it.duration
+}
+
+func (it *CSVIterator) Err() error {
+	return it.err
+}
+
+// Close removes the spooled trace, it is safe to call more than once
+func (it *CSVIterator) Close() {
+	if it.spool == nil {
+		return
+	}
+	removeSpool(it.spool)
+	it.spool = nil
+	it.reader = nil
 }
 
 func OpenCSVAndWriteHeader(csvFilePath string, header []string) *os.File {
@@ -85,20 +169,6 @@ func AppendCSV(file *os.File, row []string) {
 	}
 }
 
-func parseInt(value string, defaultValue int) int {
-	if v, err := strconv.Atoi(value); err == nil {
-		return v
-	}
-	return defaultValue
-}
-
-func parseFloat(value string, defaultValue float64) float64 {
-	if v, err := strconv.ParseFloat(value, 64); err == nil {
-		return v
-	}
-	return defaultValue
-}
-
 func formatTimeWithMillis(t time.Time) string {
 	return t.Format("2006-01-02 15:04:05.000")
 }
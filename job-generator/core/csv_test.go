@@ -0,0 +1,132 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadJobCSVReorderedColumns(t *testing.T) {
+	trace := "timestamp,prompt,extra,id,width\n" +
+		"0,a cat ,x,1,768\n" +
+		"1500,a dog,y,2,\n"
+
+	iter, err := ReadJobCSV(strings.NewReader(trace))
+	if err != nil {
+		t.Fatalf("ReadJobCSV failed: %v", err)
+	}
+	defer iter.Close()
+
+	if iter.Size() != 2 {
+		t.Errorf("Expected size 2, got %d", iter.Size())
+	}
+	if iter.Duration() != 1500*time.Millisecond {
+		t.Errorf("Expected duration 1.5s, got %v", iter.Duration())
+	}
+
+	job, ok := iter.Next()
+	if !ok || job.Id != "1" || job.Param.Prompt != "a cat " || job.Param.Width != 768 || job.Param.Steps != 20 {
+		t.Errorf("Unexpected first job: %+v", job)
+	}
+	job, ok = iter.Next()
+	if !ok || job.Id != "2" || job.Param.Width != 512 || job.RequestTime != time.UnixMilli(1500) {
+		t.Errorf("Unexpected second job: %+v", job)
+	}
+	if _, ok = iter.Next(); ok {
+		t.Errorf("Expected end of trace")
+	}
+}
+
+func TestCSVIteratorStreamsSpooledTrace(t *testing.T) {
+	trace := "id,prompt,timestamp\n"
+	for i := 0; i < 1000; i++ {
+		trace += strconv.Itoa(i) + ",p," + strconv.Itoa(i*10) + "\n"
+	}
+	iter, err := ReadJobCSV(strings.NewReader(trace))
+	if err != nil {
+		t.Fatalf("ReadJobCSV failed: %v", err)
+	}
+	spool := iter.spool.Name()
+	if iter.Size() != 1000 || iter.Duration() != 9990*time.Millisecond {
+		t.Fatalf("expected the size and duration known before reading, got %d and %v", iter.Size(), iter.Duration())
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		count := 0
+		for job, ok := iter.Next(); ok; job, ok = iter.Next() {
+			if job.Id != strconv.Itoa(count) {
+				t.Fatalf("expected job %d, got %+v", count, job)
+			}
+			count++
+		}
+		if count != 1000 || iter.Err() != nil {
+			t.Fatalf("expected 1000 jobs in pass %d, got %d: %v", pass+1, count, iter.Err())
+		}
+		// the spooled trace is read again from the first job
+		if err := iter.Reset(); err != nil {
+			t.Fatalf("Reset failed: %v", err)
+		}
+	}
+
+	iter.Close()
+	iter.Close()
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("expected the spooled trace removed, got %v", err)
+	}
+	if _, ok := iter.Next(); ok || iter.Reset() == nil {
+		t.Error("expected a closed iterator to read nothing")
+	}
+}
+
+func TestReadJobCSVValidationReport(t *testing.T) {
+	trace := "id,prompt,step,timestamp\n" +
+		"1,a cat,20,0\n" +
+		"2,a dog,abc,10\n" +
+		"3,a bird,20\n"
+
+	_, err := ReadJobCSV(strings.NewReader(trace))
+	var schemaErr *SchemaError
+	if !errors.As(err, &schemaErr) {
+		t.Fatalf("Expected SchemaError, got %v", err)
+	}
+	if schemaErr.Count != 2 {
+		t.Fatalf("Expected 2 issues, got %d: %+v", schemaErr.Count, schemaErr.Issues)
+	}
+	if issue := schemaErr.Issues[0]; issue.Row != 3 || issue.Column != "step" || issue.Value != "abc" {
+		t.Errorf("Unexpected issue: %+v", issue)
+	}
+	if issue := schemaErr.Issues[1]; issue.Row != 4 || issue.Column != "" {
+		t.Errorf("Unexpected issue: %+v", issue)
+	}
+}
+
+func TestReadJobCSVReportsPhysicalLines(t *testing.T) {
+	// a quoted prompt spans two lines and a blank line follows it
+	trace := "id,prompt,step,timestamp\n" +
+		"1,\"a cat\non a mat\",20,0\n" +
+		"\n" +
+		"2,a dog,abc,10\n"
+
+	_, err := ReadJobCSV(strings.NewReader(trace))
+	var schemaErr *SchemaError
+	if !errors.As(err, &schemaErr) {
+		t.Fatalf("Expected SchemaError, got %v", err)
+	}
+	if issue := schemaErr.Issues[0]; schemaErr.Count != 1 || issue.Row != 5 || issue.Column != "step" {
+		t.Errorf("Expected the issue at line 5, got %+v", schemaErr.Issues)
+	}
+}
+
+func TestReadJobCSVMissingColumn(t *testing.T) {
+	_, err := ReadJobCSV(strings.NewReader("id,prompt\n1,a cat\n"))
+	var schemaErr *SchemaError
+	if !errors.As(err, &schemaErr) {
+		t.Fatalf("Expected SchemaError, got %v", err)
+	}
+	if issue := schemaErr.Issues[0]; issue.Row != 1 || issue.Column != "timestamp" {
+		t.Errorf("Unexpected issue: %+v", issue)
+	}
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"github.com/paopaoyue/kscale/job-genrator/config"
+)
+
+const (
+	ClampMinReplicas   = "min_replicas"
+	ClampMaxReplicas   = "max_replicas"
+	ClampStabilization = "stabilization"
+	ClampMaxStep       = "max_step"
+	ClampUpCooldown    = "scale_up_cooldown"
+	ClampDownCooldown  = "scale_down_cooldown"
+)
+
+// Guardrails bound the worker count a policy asks for before it is applied, times are in seconds
+// of observation so they follow the scaler clock
+type Guardrails struct {
+	MinReplicas         int
+	MaxReplicas         int // 0 for unlimited
+	ScaleUpCooldown     int // since the last scale action
+	ScaleDownCooldown   int
+	MaxStep             int // 0 for unlimited
+	StabilizationWindow int // scaling down goes no lower than the highest recommendation in the window
+
+	recommendations []recommendation
+	lastScale       *int
+}
+
+type recommendation struct {
+	time     int
+	replicas int
+}
+
+func NewGuardrailsFromConfig() *Guardrails {
+	return &Guardrails{
+		MinReplicas:         config.C.MinReplicas,
+		MaxReplicas:         config.C.MaxReplicas,
+		ScaleUpCooldown:     config.C.ScaleUpCooldown,
+		ScaleDownCooldown:   config.C.ScaleDownCooldown,
+		MaxStep:             config.C.MaxScaleStep,
+		StabilizationWindow: config.C.StabilizationWindow,
+	}
+}
+
+// Apply returns the worker count to scale to from the current and the desired one, with the
+// guardrails that changed the desired count in the order they applied
+func (g *Guardrails) Apply(now, current, desired int) (int, []string) {
+	clamps := []string{}
+	replicas := desired
+
+	if replicas < g.MinReplicas {
+		replicas = g.MinReplicas
+		clamps = append(clamps, ClampMinReplicas)
+	}
+	if g.MaxReplicas > 0 && replicas > g.MaxReplicas {
+		replicas = g.MaxReplicas
+		clamps = append(clamps, ClampMaxReplicas)
+	}
+
+	// the bounded recommendation is remembered before stabilization so one low value cannot hide a later one
+	g.recommendations = append(g.recommendations, recommendation{time: now, replicas: replicas})
+	highest := replicas
+	kept := g.recommendations[:0]
+	for _, r := range g.recommendations {
+		if now-r.time < g.StabilizationWindow || r.time == now {
+			kept = append(kept, r)
+			highest = max(highest, r.replicas)
+		}
+	}
+	g.recommendations = kept
+	if replicas < current && highest > replicas {
+		replicas = min(highest, current)
+		clamps = append(clamps, ClampStabilization)
+	}
+
+	if g.MaxStep > 0 && replicas > current+g.MaxStep {
+		replicas = current + g.MaxStep
+		clamps = append(clamps, ClampMaxStep)
+	} else if g.MaxStep > 0 && replicas < current-g.MaxStep {
+		replicas = current - g.MaxStep
+		clamps = append(clamps, ClampMaxStep)
+	}
+
+	if g.lastScale != nil {
+		if replicas > current && now-*g.lastScale < g.ScaleUpCooldown {
+			replicas = current
+			clamps = append(clamps, ClampUpCooldown)
+		} else if replicas < current && now-*g.lastScale < g.ScaleDownCooldown {
+			replicas = current
+			clamps = append(clamps, ClampDownCooldown)
+		}
+	}
+
+	// the bounds are hard limits, the step and cooldowns never keep the workers outside them
+	replicas = max(replicas, g.MinReplicas)
+	if g.MaxReplicas > 0 {
+		replicas = min(replicas, g.MaxReplicas)
+	}
+
+	return replicas, clamps
+}
+
+// Reset forgets the recommendations and the last scale action
+func (g *Guardrails) Reset() {
+	g.recommendations = nil
+	g.lastScale = nil
+}
+
+// Scaled starts the cooldowns, it is called once a scale action was applied
+func (g *Guardrails) Scaled(now int) {
+	g.lastScale = &now
+}
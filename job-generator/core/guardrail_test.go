@@ -0,0 +1,68 @@
+package core
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestGuardrailBounds(t *testing.T) {
+	g := &Guardrails{MinReplicas: 1, MaxReplicas: 6}
+	if replicas, clamps := g.Apply(10, 2, 0); replicas != 1 || !slices.Equal(clamps, []string{ClampMinReplicas}) {
+		t.Fatalf("expected the min replicas, got %d %v", replicas, clamps)
+	}
+	if replicas, clamps := g.Apply(20, 2, 500); replicas != 6 || !slices.Equal(clamps, []string{ClampMaxReplicas}) {
+		t.Fatalf("expected the max replicas, got %d %v", replicas, clamps)
+	}
+	if replicas, clamps := g.Apply(30, 2, 4); replicas != 4 || len(clamps) != 0 {
+		t.Fatalf("expected the desired replicas, got %d %v", replicas, clamps)
+	}
+}
+
+func TestGuardrailMaxStepAndCooldowns(t *testing.T) {
+	g := &Guardrails{MinReplicas: 1, MaxReplicas: 10, MaxStep: 2, ScaleUpCooldown: 30, ScaleDownCooldown: 60}
+	if replicas, clamps := g.Apply(10, 2, 8); replicas != 4 || !slices.Equal(clamps, []string{ClampMaxStep}) {
+		t.Fatalf("expected a step of 2, got %d %v", replicas, clamps)
+	}
+	g.Scaled(10)
+	if replicas, clamps := g.Apply(20, 4, 8); replicas != 4 || !slices.Equal(clamps, []string{ClampMaxStep, ClampUpCooldown}) {
+		t.Fatalf("expected the scale up cooldown, got %d %v", replicas, clamps)
+	}
+	if replicas, _ := g.Apply(40, 4, 5); replicas != 5 {
+		t.Fatalf("expected a scale up after the cooldown, got %d", replicas)
+	}
+	g.Scaled(40)
+	if replicas, clamps := g.Apply(60, 5, 3); replicas != 5 || !slices.Equal(clamps, []string{ClampDownCooldown}) {
+		t.Fatalf("expected the scale down cooldown, got %d %v", replicas, clamps)
+	}
+	if replicas, _ := g.Apply(100, 5, 3); replicas != 3 {
+		t.Fatalf("expected a scale down after the cooldown, got %d", replicas)
+	}
+}
+
+func TestGuardrailCooldownNeedsAppliedScale(t *testing.T) {
+	g := &Guardrails{ScaleUpCooldown: 30}
+	g.Apply(10, 2, 4)
+	// the scale to 4 failed, so nothing was applied that could start the cooldown
+	if replicas, clamps := g.Apply(20, 2, 4); replicas != 4 || len(clamps) != 0 {
+		t.Fatalf("expected no cooldown without an applied scale, got %d %v", replicas, clamps)
+	}
+}
+
+func TestGuardrailStabilization(t *testing.T) {
+	g := &Guardrails{MinReplicas: 1, StabilizationWindow: 30}
+	g.Apply(10, 2, 5)
+	if replicas, clamps := g.Apply(20, 5, 2); replicas != 5 || !slices.Equal(clamps, []string{ClampStabilization}) {
+		t.Fatalf("expected the scale down held by the window, got %d %v", replicas, clamps)
+	}
+	if replicas, clamps := g.Apply(30, 5, 3); replicas != 5 || len(clamps) != 1 {
+		t.Fatalf("expected the scale down still held, got %d %v", replicas, clamps)
+	}
+	// the recommendation of 5 left the window, the highest one left is 3
+	if replicas, clamps := g.Apply(45, 5, 2); replicas != 3 || !slices.Equal(clamps, []string{ClampStabilization}) {
+		t.Fatalf("expected a scale down to the highest recommendation in the window, got %d %v", replicas, clamps)
+	}
+	// scaling up is never held
+	if replicas, clamps := g.Apply(50, 3, 6); replicas != 6 || len(clamps) != 0 {
+		t.Fatalf("expected an immediate scale up, got %d %v", replicas, clamps)
+	}
+}
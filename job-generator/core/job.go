@@ -6,13 +6,36 @@ import (
 )
 
 type Job struct {
-	Id          string
-	Success     bool
-	Param       api.GenerateRequestParam
-	Retry       int
-	RequestTime time.Time
-	EndTime     time.Time
-	Duration    time.Duration
+	Id           string
+	Success      bool
+	Param        api.GenerateRequestParam
+	TokenCount   int
+	Retry        int
+	RequestTime  time.Time
+	TraceOffset  time.Duration // request time offset recorded in the trace
+	ReplayOffset time.Duration // request time offset after applying the replay options
+	EndTime      time.Time
+	Duration     time.Duration
+	Deadline     time.Time // zero if the job has no SLO
+	Abandoned    bool      // the deadline passed before the job succeeded
+	Cancelled    bool      // the batch or the scheduler stopped before the job finished, also abandoned
+	Attempts     []Attempt
+
+	batch   *JobBatch
+	readyAt time.Time // when the job was dispatched or its retry backoff passed
+}
+
+// Attempt is the outcome of one request of a job
+type Attempt struct {
+	Number         int
+	Endpoint       string
+	StartTime      time.Time
+	EndTime        time.Time
+	StatusCode     int // 0 if no response was received
+	ErrorClass     ErrorClass
+	Error          string
+	ServerDuration time.Duration // generation time reported by the server
+	QueueDelay     time.Duration // time the job waited in the client before the request was sent
 }
 
 func NewJob(id string, param api.GenerateRequestParam) *Job {
@@ -0,0 +1,155 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+type JSONLIterator struct {
+	traceStats
+	spool  *os.File
+	reader *bufio.Reader
+	schema *jobSchema
+	line   int
+	err    error
+}
+
+// ReadJobJSONL spools a JSON Lines trace to disk while validating it, every line holds one job object
+// keyed by the same column names as the CSV header
+func ReadJobJSONL(file io.Reader) (*JSONLIterator, error) {
+	return readJSONL(file, jobColumns)
+}
+
+func readJSONL(file io.Reader, columns []column) (*JSONLIterator, error) {
+	it := &JSONLIterator{}
+	it.schema, _ = newJobSchema(canonicalHeader(columns), columns)
+	spool, hash, err := spoolTrace(file, "job-trace-*.jsonl", it.scan)
+	if err != nil {
+		return nil, err
+	}
+
+	it.spool = spool
+	it.hash = hash
+	if err := it.Reset(); err != nil {
+		it.Close()
+		return nil, err
+	}
+	return it, nil
+}
+
+// Reset rewinds the iterator to the first job of the spooled trace
+func (it *JSONLIterator) Reset() error {
+	if it.spool == nil {
+		return os.ErrClosed
+	}
+	if _, err := it.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	it.reader = bufio.NewReader(it.spool)
+	it.line = 0
+	it.err = nil
+	return nil
+}
+
+func (it *JSONLIterator) scan(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	for row := 1; ; row++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			it.add(it.parse(line, row))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			slog.Error("Error reading JSONL row", "err", err)
+			return err
+		}
+	}
+	return it.traceStats.err()
+}
+
+func (it *JSONLIterator) parse(line []byte, row int) (Job, []SchemaIssue) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return Job{}, []SchemaIssue{{Row: row, Reason: "invalid JSON object: " + err.Error()}}
+	}
+
+	fields := make(map[string]string, len(object))
+	for key, value := range object {
+		switch v := value.(type) {
+		case nil:
+			fields[key] = ""
+		case string:
+			fields[key] = v
+		case json.Number:
+			fields[key] = v.String()
+		case bool:
+			fields[key] = strconv.FormatBool(v)
+		default:
+			return Job{}, []SchemaIssue{{Row: row, Column: key, Reason: fmt.Sprintf("unsupported value type %T", value)}}
+		}
+	}
+
+	record, issues := canonicalRecord(it.schema.columns, fields, row)
+	if len(issues) > 0 {
+		return Job{}, issues
+	}
+	return it.schema.parse(record, row)
+}
+
+func (it *JSONLIterator) Next() (Job, bool) {
+	for it.reader != nil {
+		line, err := it.reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			it.line++
+			job, issues := it.parse(line, it.line)
+			if len(issues) == 0 {
+				return job, true
+			}
+			slog.Warn("Skipping invalid JSONL row", "line", it.line, "issues", issues)
+			continue
+		}
+		it.line++
+		if err != nil {
+			if err != io.EOF {
+				slog.Error("Error reading JSONL row", "line", it.line, "err", err)
+				it.err = err
+			}
+			it.reader = nil
+		}
+	}
+	return Job{}, false
+}
+
+func (it *JSONLIterator) Size() int {
+	return it.size
+}
+
+func (it *JSONLIterator) Duration() time.Duration {
+	return it.duration
+}
+
+func (it *JSONLIterator) Err() error {
+	return it.err
+}
+
+// Close removes the spooled trace, it is safe to call more than once
+func (it *JSONLIterator) Close() {
+	if it.spool == nil {
+		return
+	}
+	removeSpool(it.spool)
+	it.spool = nil
+	it.reader = nil
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"encoding/json"
+	"github.com/paopaoyue/kscale/job-genrator/config"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const maxSkewBucket = 10000 // in milliseconds
+
+// RunManifest records everything needed to reproduce a batch, it is written next to the result
+// and metrics files when the batch starts and rewritten when it ends
+type RunManifest struct {
+	Batch      string        `json:"batch"`
+	Version    string        `json:"version"`
+	Source     string        `json:"source"` // uploaded file name, empty for synthetic workloads
+	TraceHash  string        `json:"trace_hash"`
+	Seed       uint64        `json:"seed"` // of the batch, and of the workload if generated
+	Workload   *WorkloadSpec `json:"workload,omitempty"`
+	Options    ReplayOptions `json:"options"`
+	Simulation *SimOptions   `json:"simulation,omitempty"` // nil unless the batch was simulated offline
+	Size       int           `json:"size"`
+	Config     config.Config `json:"config"`
+
+	StartTime time.Time         `json:"start_time"`
+	EndTime   *time.Time        `json:"end_time,omitempty"`
+	State     BatchState        `json:"state"`
+	Dispatch  *DispatchAccuracy `json:"dispatch,omitempty"`
+}
+
+// DispatchAccuracy summarizes how late jobs were dispatched relative to their replay offset
+type DispatchAccuracy struct {
+	Count    int     `json:"count"`
+	MeanSkew float64 `json:"mean_skew"` // in milliseconds
+	P50Skew  float64 `json:"p50_skew"`  // in milliseconds
+	P95Skew  float64 `json:"p95_skew"`  // in milliseconds
+	P99Skew  float64 `json:"p99_skew"`  // in milliseconds
+	MaxSkew  float64 `json:"max_skew"`  // in milliseconds
+}
+
+func writeManifest(manifest RunManifest) {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		slog.Error("Error encoding run manifest", "err", err)
+		return
+	}
+	path := filepath.Join(config.C.OutputFilePath, manifest.Batch+"-manifest.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		slog.Error("Error writing run manifest", "err", err)
+	}
+}
+
+// skewStats keeps a histogram of 1ms buckets so percentiles stay cheap for traces of any length
+type skewStats struct {
+	count   int
+	sum     float64
+	max     float64
+	buckets [maxSkewBucket + 1]int
+}
+
+func (s *skewStats) add(skew time.Duration) {
+	ms := float64(skew) / float64(time.Millisecond)
+	s.count++
+	s.sum += ms
+	s.max = math.Max(s.max, ms)
+	s.buckets[min(max(int(math.Ceil(ms)), 0), maxSkewBucket)]++
+}
+
+func (s *skewStats) percentile(p float64) float64 {
+	target := int(math.Ceil(p * float64(s.count)))
+	seen := 0
+	for bucket, n := range s.buckets {
+		seen += n
+		if seen >= target {
+			return math.Min(float64(bucket), s.max)
+		}
+	}
+	return s.max
+}
+
+func (s *skewStats) accuracy() *DispatchAccuracy {
+	if s.count == 0 {
+		return &DispatchAccuracy{}
+	}
+	return &DispatchAccuracy{
+		Count:    s.count,
+		MeanSkew: s.sum / float64(s.count),
+		P50Skew:  s.percentile(0.5),
+		P95Skew:  s.percentile(0.95),
+		P99Skew:  s.percentile(0.99),
+		MaxSkew:  s.max,
+	}
+}
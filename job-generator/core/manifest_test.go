@@ -0,0 +1,39 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSkewStats(t *testing.T) {
+	var stats skewStats
+	if accuracy := stats.accuracy(); *accuracy != (DispatchAccuracy{}) {
+		t.Fatalf("expected an empty report, got %+v", accuracy)
+	}
+
+	// 1ms to 100ms, then one job dispatched 20s late beyond the last bucket
+	for i := 1; i <= 100; i++ {
+		stats.add(time.Duration(i) * time.Millisecond)
+	}
+	stats.add(20 * time.Second)
+	// a job dispatched early counts in the first bucket
+	stats.add(-time.Millisecond)
+
+	accuracy := stats.accuracy()
+	if accuracy.Count != 102 || accuracy.MeanSkew != (5050+20000-1)/102.0 {
+		t.Errorf("unexpected count or mean %+v", accuracy)
+	}
+	if accuracy.P50Skew != 50 || accuracy.P95Skew != 96 || accuracy.P99Skew != 100 || accuracy.MaxSkew != 20000 {
+		t.Errorf("unexpected percentiles %+v", accuracy)
+	}
+}
+
+func TestSkewPercentileRoundsUp(t *testing.T) {
+	var stats skewStats
+	stats.add(1500 * time.Microsecond)
+	stats.add(2500 * time.Microsecond)
+	// a bucket holds the skews up to its millisecond, and no percentile exceeds the max
+	if accuracy := stats.accuracy(); accuracy.P50Skew != 2 || accuracy.P99Skew != 2.5 {
+		t.Errorf("unexpected percentiles %+v", accuracy)
+	}
+}
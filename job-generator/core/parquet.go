@@ -0,0 +1,201 @@
+package core
+
+import (
+	"github.com/parquet-go/parquet-go"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+const parquetReadBatch = 256
+
+type ParquetIterator struct {
+	traceStats
+	columns []column
+	spool   *os.File
+	reader  *parquet.Reader
+	schema  *jobSchema
+	done    bool
+	rows    []parquet.Row
+	buffer  [][]string
+	row     int
+	err     error
+}
+
+// ReadJobParquet spools a Parquet trace to disk, the footer of a Parquet file must be read first so
+// the rows are validated in a second pass over the spooled file
+func ReadJobParquet(file io.Reader) (*ParquetIterator, error) {
+	return readParquet(file, jobColumns)
+}
+
+func readParquet(file io.Reader, columns []column) (*ParquetIterator, error) {
+	spool, hash, err := spoolTrace(file, "job-trace-*.parquet", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	it := &ParquetIterator{columns: columns, spool: spool}
+	it.hash = hash
+	if err := it.scan(); err != nil {
+		it.Close()
+		return nil, err
+	}
+	if it.reader, err = openParquetReader(spool); err != nil {
+		it.Close()
+		return nil, err
+	}
+	it.rows = make([]parquet.Row, parquetReadBatch)
+	return it, nil
+}
+
+func openParquetReader(spool *os.File) (*parquet.Reader, error) {
+	info, err := spool.Stat()
+	if err != nil {
+		return nil, err
+	}
+	file, err := parquet.OpenFile(spool, info.Size())
+	if err != nil {
+		slog.Error("Error opening Parquet file", "err", err)
+		return nil, err
+	}
+	return parquet.NewReader(file), nil
+}
+
+func (it *ParquetIterator) scan() error {
+	reader, err := openParquetReader(it.spool)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	header := parquetHeader(reader.Schema())
+	schema, schemaErr := newJobSchema(header, it.columns)
+	if schemaErr != nil {
+		return schemaErr
+	}
+	it.schema = schema
+
+	rows := make([]parquet.Row, parquetReadBatch)
+	for row := 1; ; {
+		n, err := reader.ReadRows(rows)
+		for _, r := range rows[:n] {
+			row++
+			it.add(schema.parse(parquetRecord(r, len(header)), row))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			slog.Error("Error reading Parquet rows", "err", err)
+			return err
+		}
+	}
+	return it.traceStats.err()
+}
+
+// Reset rewinds the iterator to the first job of the spooled trace
+func (it *ParquetIterator) Reset() error {
+	if it.reader == nil {
+		return os.ErrClosed
+	}
+	if err := it.reader.SeekToRow(0); err != nil {
+		return err
+	}
+	it.buffer = nil
+	it.row = 0
+	it.done = false
+	it.err = nil
+	return nil
+}
+
+func (it *ParquetIterator) Next() (Job, bool) {
+	for it.reader != nil && !it.done {
+		if len(it.buffer) == 0 && !it.fill() {
+			return Job{}, false
+		}
+		record := it.buffer[0]
+		it.buffer = it.buffer[1:]
+		it.row++
+		job, issues := it.schema.parse(record, it.row+1)
+		if len(issues) > 0 {
+			slog.Warn("Skipping invalid Parquet row", "row", it.row, "issues", issues)
+			continue
+		}
+		return job, true
+	}
+	return Job{}, false
+}
+
+// fill reads the next batch of rows, converting them to records before the row buffer is reused
+func (it *ParquetIterator) fill() bool {
+	n, err := it.reader.ReadRows(it.rows)
+	for _, r := range it.rows[:n] {
+		it.buffer = append(it.buffer, parquetRecord(r, it.schema.fields))
+	}
+	if err != nil && err != io.EOF {
+		slog.Error("Error reading Parquet rows", "row", it.row, "err", err)
+		it.err = err
+	}
+	if n == 0 {
+		it.done = true
+		return false
+	}
+	return true
+}
+
+func (it *ParquetIterator) Size() int {
+	return it.size
+}
+
+func (it *ParquetIterator) Duration() time.Duration {
+	return it.duration
+}
+
+func (it *ParquetIterator) Err() error {
+	return it.err
+}
+
+// Close removes the spooled trace, it is safe to call more than once
+func (it *ParquetIterator) Close() {
+	if it.reader != nil {
+		_ = it.reader.Close()
+		it.reader = nil
+	}
+	if it.spool != nil {
+		removeSpool(it.spool)
+		it.spool = nil
+	}
+}
+
+// parquetHeader names the leaf columns of a flat Parquet schema
+func parquetHeader(schema *parquet.Schema) []string {
+	columns := schema.Columns()
+	header := make([]string, len(columns))
+	for i, path := range columns {
+		header[i] = path[len(path)-1]
+	}
+	return header
+}
+
+func parquetRecord(row parquet.Row, fields int) []string {
+	record := make([]string, fields)
+	for _, value := range row {
+		if i := value.Column(); i >= 0 && i < fields && !value.IsNull() {
+			record[i] = parquetString(value)
+		}
+	}
+	return record
+}
+
+func parquetString(value parquet.Value) string {
+	switch value.Kind() {
+	case parquet.Float:
+		return strconv.FormatFloat(float64(value.Float()), 'f', -1, 32)
+	case parquet.Double:
+		return strconv.FormatFloat(value.Double(), 'f', -1, 64)
+	default:
+		return value.String()
+	}
+}
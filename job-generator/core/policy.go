@@ -0,0 +1,216 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"github.com/paopaoyue/kscale/job-genrator/config"
+	"math"
+)
+
+const (
+	PolicyRemote            = "remote"
+	PolicyTargetQueue       = "target_queue"
+	PolicyTargetUtilization = "target_utilization"
+	PolicyLittlesLaw        = "littles_law"
+	PolicyStep              = "step"
+)
+
+// Policy decides the worker count from the window of the latest data points, the last one is the newest,
+// current is the worker count the scaler targets now
+type Policy interface {
+	Name() string
+	CalcWorkerCount(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error)
+}
+
+// scaledPolicy is a policy that keeps the time of the last scale action, the scaler tells it once a
+// scale action was applied and when its observation time starts over
+type scaledPolicy interface {
+	Scaled(now int)
+	Reset()
+}
+
+// NewPolicy builds the named policy, the remote one asks the model served at /autoscaler/calc. It fails on
+// an unknown name or a setting the policy cannot scale with
+func NewPolicy(name string, client *api.Client) (Policy, error) {
+	window := float64(config.C.MetricsWindow)
+	if window <= 0 {
+		return nil, fmt.Errorf("policy '%s' needs a positive metrics window, got %v", name, window)
+	}
+	switch name {
+	case PolicyRemote:
+		return &RemotePolicy{client: client}, nil
+	case PolicyTargetQueue:
+		if config.C.TargetJobsPerWorker <= 0 {
+			return nil, fmt.Errorf("policy '%s' needs positive target jobs per worker, got %v", name, config.C.TargetJobsPerWorker)
+		}
+		return &TargetQueuePolicy{JobsPerWorker: config.C.TargetJobsPerWorker}, nil
+	case PolicyTargetUtilization:
+		if config.C.TargetUtilization <= 0 || config.C.TargetUtilization > 1 {
+			return nil, fmt.Errorf("policy '%s' needs a target utilization in (0, 1], got %v", name, config.C.TargetUtilization)
+		}
+		return &TargetUtilizationPolicy{Utilization: config.C.TargetUtilization, Window: window}, nil
+	case PolicyLittlesLaw:
+		if config.C.LatencyThreshold <= 0 {
+			return nil, fmt.Errorf("policy '%s' needs a positive latency threshold, got %v", name, config.C.LatencyThreshold)
+		}
+		return &LittlesLawPolicy{TargetLatency: float64(config.C.LatencyThreshold), Window: window}, nil
+	case PolicyStep:
+		if config.C.StepDownThreshold < 0 || config.C.StepUpThreshold <= config.C.StepDownThreshold || config.C.StepCooldown < 0 {
+			return nil, fmt.Errorf("policy '%s' needs 0 <= down threshold < up threshold and a cooldown of at least 0, got %v, %v and %v",
+				name, config.C.StepDownThreshold, config.C.StepUpThreshold, config.C.StepCooldown)
+		}
+		return &StepPolicy{
+			UpThreshold:   config.C.StepUpThreshold,
+			DownThreshold: config.C.StepDownThreshold,
+			Cooldown:      config.C.StepCooldown,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown policy '%s'", name)
+	}
+}
+
+type RemotePolicy struct {
+	client *api.Client
+}
+
+func (p *RemotePolicy) Name() string { return PolicyRemote }
+
+func (p *RemotePolicy) CalcWorkerCount(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error) {
+	return p.client.CalcWorkerCount(ctx, param)
+}
+
+// TargetQueuePolicy keeps a fixed number of ongoing jobs per worker
+type TargetQueuePolicy struct {
+	JobsPerWorker float64
+}
+
+func (p *TargetQueuePolicy) Name() string { return PolicyTargetQueue }
+
+func (p *TargetQueuePolicy) CalcWorkerCount(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error) {
+	last, err := lastPoint(param)
+	if err != nil {
+		return 0, err
+	}
+	return ceilWorkers(float64(last.OngoingJob) / p.JobsPerWorker)
+}
+
+// TargetUtilizationPolicy sizes the workers so the offered load, arrival rate times service time,
+// keeps them busy the target fraction of the time
+type TargetUtilizationPolicy struct {
+	Utilization float64
+	Window      float64 // in seconds, covered by one data point
+}
+
+func (p *TargetUtilizationPolicy) Name() string { return PolicyTargetUtilization }
+
+func (p *TargetUtilizationPolicy) CalcWorkerCount(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error) {
+	last, err := lastPoint(param)
+	if err != nil {
+		return 0, err
+	}
+	if last.NewJob == 0 {
+		return 0, nil
+	}
+	service, err := serviceTime(param)
+	if err != nil {
+		return 0, err
+	}
+	load := float64(last.NewJob) / p.Window * service
+	return ceilWorkers(load / p.Utilization)
+}
+
+// LittlesLawPolicy serves the offered load and drains the jobs in the system within the target latency,
+// by Little's law L = λW the L ongoing jobs need a throughput of L / W on top of the arrivals
+type LittlesLawPolicy struct {
+	TargetLatency float64 // in milliseconds
+	Window        float64 // in seconds, covered by one data point
+}
+
+func (p *LittlesLawPolicy) Name() string { return PolicyLittlesLaw }
+
+func (p *LittlesLawPolicy) CalcWorkerCount(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error) {
+	last, err := lastPoint(param)
+	if err != nil {
+		return 0, err
+	}
+	if last.NewJob == 0 && last.OngoingJob == 0 {
+		return 0, nil
+	}
+	service, err := serviceTime(param)
+	if err != nil {
+		return 0, err
+	}
+	load := float64(last.NewJob) / p.Window * service
+	drain := float64(last.OngoingJob) * service / (p.TargetLatency / 1000)
+	return ceilWorkers(load + drain)
+}
+
+// StepPolicy adds or removes one worker when the ongoing jobs per worker cross a threshold, then waits
+// for the cooldown after the scale action before the next step
+type StepPolicy struct {
+	UpThreshold   float64 // ongoing jobs per targeted worker
+	DownThreshold float64
+	Cooldown      int // in seconds
+
+	lastStep *int
+}
+
+func (p *StepPolicy) Name() string { return PolicyStep }
+
+func (p *StepPolicy) CalcWorkerCount(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error) {
+	last, err := lastPoint(param)
+	if err != nil {
+		return 0, err
+	}
+	if p.lastStep != nil && param.Time-*p.lastStep < p.Cooldown {
+		return current, nil
+	}
+
+	perWorker := float64(last.OngoingJob) / math.Max(float64(current), 1)
+	var workers int
+	switch {
+	case perWorker > p.UpThreshold:
+		workers = current + 1
+	case perWorker < p.DownThreshold && current > 0:
+		workers = current - 1
+	default:
+		return current, nil
+	}
+	return workers, nil
+}
+
+// Scaled starts the cooldown, a step that was clamped away or failed to scale does not
+func (p *StepPolicy) Scaled(now int) {
+	p.lastStep = &now
+}
+
+func (p *StepPolicy) Reset() {
+	p.lastStep = nil
+}
+
+func lastPoint(param api.CalcWorkerCountRequestParam) (api.DataPoint, error) {
+	if len(param.Points) == 0 {
+		return api.DataPoint{}, fmt.Errorf("no data points at %ds", param.Time)
+	}
+	return param.Points[len(param.Points)-1], nil
+}
+
+// serviceTime is the latest known job duration in seconds, windows without completed jobs have none
+// and it is unknown until a job completed, so a policy sizing on it fails over to the fallback
+func serviceTime(param api.CalcWorkerCountRequestParam) (float64, error) {
+	for i := len(param.Points) - 1; i >= 0; i-- {
+		if param.Points[i].AvgDuration > 0 {
+			return param.Points[i].AvgDuration / 1000, nil
+		}
+	}
+	return 0, fmt.Errorf("no service time at %ds, no job completed in the last %d data points", param.Time, len(param.Points))
+}
+
+// ceilWorkers rounds a worker count up, a count that is not a number is an error rather than no workers
+func ceilWorkers(workers float64) (int, error) {
+	if math.IsNaN(workers) || math.IsInf(workers, 0) {
+		return 0, fmt.Errorf("undefined worker count %v", workers)
+	}
+	return int(math.Ceil(max(workers, 0))), nil
+}
@@ -0,0 +1,200 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"github.com/paopaoyue/kscale/job-genrator/config"
+	"github.com/paopaoyue/kscale/job-genrator/metrics"
+	"math"
+	"testing"
+)
+
+func calc(t *testing.T, policy Policy, current int, points ...api.DataPoint) int {
+	t.Helper()
+	count, err := policy.CalcWorkerCount(context.Background(), api.CalcWorkerCountRequestParam{Time: 10, Points: points}, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestBaselinePolicies(t *testing.T) {
+	// 20 new jobs in a 10s window taking 3s each offer a load of 6 busy workers
+	points := []api.DataPoint{
+		{NewJob: 10, OngoingJob: 4, AvgDuration: 3000},
+		{NewJob: 20, OngoingJob: 8, AvgDuration: 0},
+	}
+
+	if count := calc(t, &TargetQueuePolicy{JobsPerWorker: 3}, 1, points...); count != 3 {
+		t.Errorf("target queue: expected 3 workers, got %d", count)
+	}
+	if count := calc(t, &TargetUtilizationPolicy{Utilization: 0.75, Window: 10}, 1, points...); count != 8 {
+		t.Errorf("target utilization: expected 8 workers, got %d", count)
+	}
+	// 6 for the arrivals and 8 jobs of 3s drained within 6s take 4 more
+	if count := calc(t, &LittlesLawPolicy{TargetLatency: 6000, Window: 10}, 1, points...); count != 10 {
+		t.Errorf("littles law: expected 10 workers, got %d", count)
+	}
+	if count := calc(t, &TargetUtilizationPolicy{Utilization: 0.75, Window: 10}, 1, api.DataPoint{}); count != 0 {
+		t.Errorf("target utilization: expected no workers without load, got %d", count)
+	}
+
+	if _, err := (&TargetQueuePolicy{JobsPerWorker: 1}).CalcWorkerCount(context.Background(), api.CalcWorkerCountRequestParam{}, 1); err == nil {
+		t.Error("expected an error without data points")
+	}
+}
+
+func TestBaselinePoliciesNeedServiceTime(t *testing.T) {
+	// no job completed yet, so the load of the arrivals is unknown rather than none
+	param := api.CalcWorkerCountRequestParam{Time: 10, Points: []api.DataPoint{{NewJob: 20, OngoingJob: 8}}}
+	for _, policy := range []Policy{
+		&TargetUtilizationPolicy{Utilization: 0.75, Window: 10},
+		&LittlesLawPolicy{TargetLatency: 6000, Window: 10},
+	} {
+		if count, err := policy.CalcWorkerCount(context.Background(), param, 3); err == nil {
+			t.Errorf("%s: expected an error without a service time, got %d workers", policy.Name(), count)
+		}
+	}
+
+	if _, err := ceilWorkers(math.Inf(1)); err == nil {
+		t.Error("expected an error for an infinite worker count")
+	}
+	if _, err := ceilWorkers(math.NaN()); err == nil {
+		t.Error("expected an error for a worker count that is not a number")
+	}
+	if count, err := ceilWorkers(-1); err != nil || count != 0 {
+		t.Errorf("expected no workers for a negative count, got %d, %v", count, err)
+	}
+}
+
+func TestNewPolicyValidatesConfig(t *testing.T) {
+	saved := config.C
+	t.Cleanup(func() { config.C = saved })
+	valid := func() {
+		config.C.MetricsWindow = 10
+		config.C.TargetJobsPerWorker = 2
+		config.C.TargetUtilization = 0.8
+		config.C.LatencyThreshold = 8000
+		config.C.StepUpThreshold = 4
+		config.C.StepDownThreshold = 1
+		config.C.StepCooldown = 60
+	}
+	for _, name := range []string{PolicyRemote, PolicyTargetQueue, PolicyTargetUtilization, PolicyLittlesLaw, PolicyStep} {
+		valid()
+		if _, err := NewPolicy(name, nil); err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+
+	for i, tc := range []struct {
+		policy string
+		set    func()
+	}{
+		{PolicyTargetQueue, func() { config.C.TargetJobsPerWorker = 0 }},
+		{PolicyTargetUtilization, func() { config.C.TargetUtilization = 0 }},
+		{PolicyTargetUtilization, func() { config.C.TargetUtilization = 1.5 }},
+		{PolicyTargetUtilization, func() { config.C.MetricsWindow = 0 }},
+		{PolicyLittlesLaw, func() { config.C.LatencyThreshold = 0 }},
+		{PolicyStep, func() { config.C.StepDownThreshold = 4 }},
+		{PolicyStep, func() { config.C.StepCooldown = -1 }},
+		{"target-queue", func() {}},
+	} {
+		valid()
+		tc.set()
+		if _, err := NewPolicy(tc.policy, nil); err == nil {
+			t.Errorf("%s: expected case %d to fail", tc.policy, i)
+		}
+	}
+}
+
+func TestStepPolicy(t *testing.T) {
+	policy := &StepPolicy{UpThreshold: 4, DownThreshold: 1, Cooldown: 30}
+	step := func(time, current, ongoing int) int {
+		count, _ := policy.CalcWorkerCount(context.Background(), api.CalcWorkerCountRequestParam{
+			Time:   time,
+			Points: []api.DataPoint{{OngoingJob: ongoing}},
+		}, current)
+		return count
+	}
+
+	if count := step(10, 2, 10); count != 3 {
+		t.Fatalf("expected a step up to 3, got %d", count)
+	}
+	// a step that was not applied starts no cooldown
+	if count := step(20, 2, 10); count != 3 {
+		t.Fatalf("expected the step up to 3 again, got %d", count)
+	}
+	policy.Scaled(20)
+	if count := step(30, 3, 30); count != 3 {
+		t.Fatalf("expected no step within the cooldown, got %d", count)
+	}
+	if count := step(50, 3, 30); count != 4 {
+		t.Fatalf("expected a step up to 4 after the cooldown, got %d", count)
+	}
+	policy.Scaled(50)
+	if count := step(90, 4, 8); count != 4 {
+		t.Fatalf("expected no step between the thresholds, got %d", count)
+	}
+	if count := step(100, 4, 2); count != 3 {
+		t.Fatalf("expected a step down to 3, got %d", count)
+	}
+	policy.Scaled(100)
+	policy.Reset()
+	if count := step(10, 3, 30); count != 4 {
+		t.Fatalf("expected a step up to 4 once the observation time started over, got %d", count)
+	}
+}
+
+func TestScalerStartsStepCooldownOnceScaled(t *testing.T) {
+	policy := &StepPolicy{UpThreshold: 4, DownThreshold: 1, Cooldown: 30}
+	s := newTestScaler(t, policy, &failingActuator{*NewRecordActuator(1)})
+	s.guardrails = &Guardrails{MaxReplicas: 1}
+	point := func(time int) decision {
+		return decision{version: s.version.Add(1), time: time, param: api.CalcWorkerCountRequestParam{
+			Time:   time,
+			Points: []api.DataPoint{{OngoingJob: 10}},
+		}}
+	}
+
+	// neither a step clamped by the guardrails nor one the actuator failed to apply starts the cooldown
+	s.decide(point(10))
+	s.guardrails.MaxReplicas = 0
+	s.decide(point(20))
+	if policy.lastStep != nil {
+		t.Fatalf("expected no cooldown without a scale action, got one from %ds", *policy.lastStep)
+	}
+	s.actuator = NewRecordActuator(1)
+	s.decide(point(30))
+	if s.expectedWorker.Load() != 2 || policy.lastStep == nil || *policy.lastStep != 30 {
+		t.Fatalf("expected the step to 2 workers to start the cooldown, got %d workers", s.expectedWorker.Load())
+	}
+	s.decide(point(40))
+	if s.expectedWorker.Load() != 2 {
+		t.Fatalf("expected no step within the cooldown, got %d workers", s.expectedWorker.Load())
+	}
+}
+
+type failingPolicy struct{}
+
+func (p *failingPolicy) Name() string { return "failing" }
+
+func (p *failingPolicy) CalcWorkerCount(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error) {
+	return 0, errors.New("autoscaler unavailable")
+}
+
+func TestScalerFallsBackToPolicy(t *testing.T) {
+	useDummyMetrics()
+
+	s := &Scaler{policy: &failingPolicy{}, fallback: &TargetQueuePolicy{JobsPerWorker: 2},
+		metrics: metrics.Client, datadog: metrics.DatadogClient}
+	param := api.CalcWorkerCountRequestParam{Time: 10, Points: []api.DataPoint{{OngoingJob: 7}}}
+	if count, err := s.calcWorkerCount(context.Background(), param, 1); err != nil || count != 4 {
+		t.Fatalf("expected 4 workers from the fallback, got %d, %v", count, err)
+	}
+
+	s.fallback = nil
+	if _, err := s.calcWorkerCount(context.Background(), param, 1); err == nil {
+		t.Fatal("expected the error without a fallback")
+	}
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+type ReplayOptions struct {
+	Speed       float64       // 2 replays the trace twice as fast
+	StartOffset time.Duration // jobs before this trace offset are skipped
+	EndOffset   time.Duration // jobs from this trace offset on are skipped, 0 for the end of the trace
+	Repeat      int           // how many times the trace window is replayed
+	Seed        uint64        // of the retry jitter and the endpoint picks, 0 picks a random one recorded in the run manifest
+}
+
+func DefaultReplayOptions() ReplayOptions {
+	return ReplayOptions{
+		Speed:  1,
+		Repeat: 1,
+	}
+}
+
+func (o ReplayOptions) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Speed       float64 `json:"speed"`
+		StartOffset float64 `json:"start_offset"` // in seconds
+		EndOffset   float64 `json:"end_offset"`   // in seconds
+		Repeat      int     `json:"repeat"`
+	}{o.Speed, o.StartOffset.Seconds(), o.EndOffset.Seconds(), o.Repeat})
+}
+
+func (o ReplayOptions) Validate() error {
+	if o.Speed <= 0 {
+		return errors.New("speed must be positive")
+	}
+	if o.StartOffset < 0 || o.EndOffset < 0 {
+		return errors.New("offsets must not be negative")
+	}
+	if o.EndOffset > 0 && o.EndOffset <= o.StartOffset {
+		return errors.New("end offset must be after start offset")
+	}
+	if o.Repeat < 1 {
+		return errors.New("repeat must be at least 1")
+	}
+	return nil
+}
+
+// replaySource applies ReplayOptions on top of a trace, the request time of every job it yields is
+// the scaled replay offset while TraceOffset keeps the offset recorded in the trace
+type replaySource struct {
+	JobSource
+	options ReplayOptions
+
+	window   time.Duration // trace time between the starts of two loops
+	span     time.Duration // trace time from the start of a loop to its end
+	size     int
+	loop     int
+	finished bool
+}
+
+// repeatGap separates the loops of a window holding a single job, which has no inter-arrival gap
+const repeatGap = time.Second
+
+func newReplaySource(source JobSource, options ReplayOptions) (*replaySource, error) {
+	rs := &replaySource{
+		JobSource: source,
+		options:   options,
+	}
+
+	// scan the jobs inside the window once, the source is a spooled file so this stays cheap
+	size, first, last := source.Size(), time.Duration(0), source.Duration()
+	if options.StartOffset > 0 || options.EndOffset > 0 || options.Repeat > 1 {
+		size, last = 0, 0
+		for job, ok := source.Next(); ok; job, ok = source.Next() {
+			if !rs.inWindow(job) {
+				continue
+			}
+			offset := job.RequestTime.Sub(time.UnixMilli(0))
+			if size == 0 {
+				first = offset
+			}
+			last = max(last, offset)
+			size++
+		}
+		if err := source.Err(); err != nil {
+			return nil, err
+		}
+		if err := source.Reset(); err != nil {
+			return nil, err
+		}
+	}
+	rs.size = size * options.Repeat
+
+	// a loop covers the whole window, without an end offset it ends where the next job of the trace
+	// would have arrived, one mean inter-arrival gap after the last job, so loops never overlap
+	rs.span = max(last-options.StartOffset, 0)
+	switch {
+	case options.EndOffset > 0:
+		rs.span = options.EndOffset - options.StartOffset
+		rs.window = rs.span
+	case size > 1:
+		rs.window = rs.span + (last-first)/time.Duration(size-1)
+	default:
+		rs.window = rs.span + repeatGap
+	}
+	return rs, nil
+}
+
+func (rs *replaySource) inWindow(job Job) bool {
+	offset := job.RequestTime.Sub(time.UnixMilli(0))
+	return offset >= rs.options.StartOffset && (rs.options.EndOffset == 0 || offset < rs.options.EndOffset)
+}
+
+func (rs *replaySource) Next() (Job, bool) {
+	for !rs.finished {
+		job, ok := rs.JobSource.Next()
+		if !ok {
+			if rs.JobSource.Err() != nil || rs.loop+1 >= rs.options.Repeat {
+				rs.finished = true
+				return Job{}, false
+			}
+			if err := rs.JobSource.Reset(); err != nil {
+				rs.finished = true
+				return Job{}, false
+			}
+			rs.loop++
+			continue
+		}
+		if !rs.inWindow(job) {
+			continue
+		}
+
+		job.TraceOffset = job.RequestTime.Sub(time.UnixMilli(0))
+		offset := job.TraceOffset - rs.options.StartOffset + time.Duration(rs.loop)*rs.window
+		job.RequestTime = time.UnixMilli(0).Add(time.Duration(float64(offset) / rs.options.Speed))
+		if rs.loop > 0 {
+			job.Id = job.Id + "-" + strconv.Itoa(rs.loop)
+		}
+		return job, true
+	}
+	return Job{}, false
+}
+
+func (rs *replaySource) Size() int {
+	return rs.size
+}
+
+func (rs *replaySource) Duration() time.Duration {
+	return time.Duration(float64(rs.window*time.Duration(rs.options.Repeat-1)+rs.span) / rs.options.Speed)
+}
+
+func (rs *replaySource) Reset() error {
+	rs.loop = 0
+	rs.finished = false
+	return rs.JobSource.Reset()
+}
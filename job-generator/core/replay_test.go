@@ -0,0 +1,103 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplaySource(t *testing.T) {
+	trace := "id,prompt,timestamp\n" +
+		"1,a,0\n" +
+		"2,b,1000\n" +
+		"3,c,2000\n" +
+		"4,d,3000\n"
+	source, err := ReadJobCSV(strings.NewReader(trace))
+	if err != nil {
+		t.Fatalf("ReadJobCSV failed: %v", err)
+	}
+	defer source.Close()
+
+	rs, err := newReplaySource(source, ReplayOptions{
+		Speed:       2,
+		StartOffset: 1 * time.Second,
+		EndOffset:   3 * time.Second,
+		Repeat:      2,
+	})
+	if err != nil {
+		t.Fatalf("newReplaySource failed: %v", err)
+	}
+	if rs.Size() != 4 {
+		t.Errorf("Expected size 4, got %d", rs.Size())
+	}
+	if rs.Duration() != 2*time.Second {
+		t.Errorf("Expected duration 2s, got %v", rs.Duration())
+	}
+
+	expected := []struct {
+		id          string
+		traceOffset time.Duration
+		replayTime  time.Duration
+	}{
+		{"2", 1 * time.Second, 0},
+		{"3", 2 * time.Second, 500 * time.Millisecond},
+		{"2-1", 1 * time.Second, 1 * time.Second},
+		{"3-1", 2 * time.Second, 1500 * time.Millisecond},
+	}
+	for _, e := range expected {
+		job, ok := rs.Next()
+		if !ok {
+			t.Fatalf("Expected job %s", e.id)
+		}
+		if job.Id != e.id || job.TraceOffset != e.traceOffset || job.RequestTime.Sub(time.UnixMilli(0)) != e.replayTime {
+			t.Errorf("Expected %+v, got id=%s trace=%v replay=%v", e, job.Id, job.TraceOffset, job.RequestTime.Sub(time.UnixMilli(0)))
+		}
+	}
+	if _, ok := rs.Next(); ok {
+		t.Errorf("Expected end of replay")
+	}
+}
+
+func TestReplaySourceRepeatsWithoutEndOffset(t *testing.T) {
+	trace := "id,prompt,timestamp\n" +
+		"1,a,0\n" +
+		"2,b,1000\n" +
+		"3,c,2000\n" +
+		"4,d,3000\n"
+	source, err := ReadJobCSV(strings.NewReader(trace))
+	if err != nil {
+		t.Fatalf("ReadJobCSV failed: %v", err)
+	}
+	defer source.Close()
+
+	rs, err := newReplaySource(source, ReplayOptions{Speed: 1, StartOffset: 1 * time.Second, Repeat: 2})
+	if err != nil {
+		t.Fatalf("newReplaySource failed: %v", err)
+	}
+	// the second loop starts one inter-arrival gap after the last job of the first
+	if rs.Duration() != 5*time.Second {
+		t.Errorf("Expected duration 5s, got %v", rs.Duration())
+	}
+	for _, e := range []struct {
+		id         string
+		replayTime time.Duration
+	}{
+		{"2", 0},
+		{"3", 1 * time.Second},
+		{"4", 2 * time.Second},
+		{"2-1", 3 * time.Second},
+		{"3-1", 4 * time.Second},
+		{"4-1", 5 * time.Second},
+	} {
+		job, ok := rs.Next()
+		if !ok {
+			t.Fatalf("Expected job %s", e.id)
+		}
+		if job.Id != e.id || job.RequestTime.Sub(time.UnixMilli(0)) != e.replayTime {
+			t.Errorf("Expected %+v, got id=%s replay=%v", e, job.Id, job.RequestTime.Sub(time.UnixMilli(0)))
+		}
+	}
+	if _, ok := rs.Next(); ok {
+		t.Errorf("Expected end of replay")
+	}
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"github.com/paopaoyue/kscale/job-genrator/config"
+	"github.com/paopaoyue/kscale/job-genrator/util"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type ErrorClass string
+
+const (
+	ErrorNone       ErrorClass = ""
+	ErrorTimeout    ErrorClass = "timeout"
+	ErrorConnection ErrorClass = "connection"
+	ErrorOverloaded ErrorClass = "overloaded" // 429 or 503, the replica is busy
+	ErrorServer     ErrorClass = "server"
+	ErrorClient     ErrorClass = "client" // 4xx, the request itself is bad
+	ErrorResponse   ErrorClass = "invalid_response"
+	ErrorNoEndpoint ErrorClass = "no_endpoint"
+	ErrorCancelled  ErrorClass = "cancelled"
+	ErrorAbandoned  ErrorClass = "abandoned" // the job deadline passed
+	ErrorUnknown    ErrorClass = "unknown"
+)
+
+// ClassifyError maps an error of api.GenerateImage to its class
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ErrorNone
+	}
+	var statusErr *api.StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode == http.StatusServiceUnavailable:
+			return ErrorOverloaded
+		case statusErr.StatusCode == http.StatusRequestTimeout || statusErr.StatusCode == http.StatusGatewayTimeout:
+			return ErrorTimeout
+		case statusErr.StatusCode >= 500:
+			return ErrorServer
+		default:
+			return ErrorClient
+		}
+	}
+	if errors.Is(err, util.ErrNoEndpoint) {
+		return ErrorNoEndpoint
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrorCancelled
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ErrorTimeout
+		}
+		return ErrorConnection
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrorConnection
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return ErrorResponse
+	}
+	return ErrorUnknown
+}
+
+// Retryable reports whether another attempt may succeed, bad requests, cancelled and abandoned jobs never will
+func (c ErrorClass) Retryable() bool {
+	return c != ErrorNone && c != ErrorClient && c != ErrorCancelled && c != ErrorAbandoned
+}
+
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Budget      float64 // max retries of a batch as a fraction of its dispatched jobs
+}
+
+func NewRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: config.C.MaxRetryCount,
+		BaseDelay:   time.Duration(config.C.RetryBaseDelay) * time.Millisecond,
+		MaxDelay:    time.Duration(config.C.RetryMaxDelay) * time.Millisecond,
+		Budget:      config.C.RetryBudget,
+	}
+}
+
+// Backoff is the delay before the given retry, starting at 1, exponential with full jitter drawn
+// from rng so that jobs failing together do not retry together
+func (p RetryPolicy) Backoff(retry int, rng *util.Rand) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	ceiling := float64(p.BaseDelay) * math.Pow(2, float64(max(retry-1, 0)))
+	if p.MaxDelay > 0 {
+		ceiling = math.Min(ceiling, float64(p.MaxDelay))
+	}
+	return time.Duration(rng.Float64() * ceiling)
+}
+
+// retryBudget caps the retries of a batch to a fraction of the jobs it dispatched, so retries cannot
+// amplify an overload, at least one retry is allowed unless the fraction is 0
+type retryBudget struct {
+	retries atomic.Int32
+}
+
+func (rb *retryBudget) acquire(fraction float64, dispatched int32) bool {
+	if fraction <= 0 {
+		return false
+	}
+	limit := max(int32(fraction*float64(dispatched)), 1)
+	for {
+		retries := rb.retries.Load()
+		if retries >= limit {
+			return false
+		}
+		if rb.retries.CompareAndSwap(retries, retries+1) {
+			return true
+		}
+	}
+}
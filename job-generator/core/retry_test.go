@@ -0,0 +1,76 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"github.com/paopaoyue/kscale/job-genrator/util"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err   error
+		class ErrorClass
+	}{
+		{nil, ErrorNone},
+		{&api.StatusError{StatusCode: http.StatusServiceUnavailable}, ErrorOverloaded},
+		{&api.StatusError{StatusCode: http.StatusTooManyRequests}, ErrorOverloaded},
+		{&api.StatusError{StatusCode: http.StatusInternalServerError}, ErrorServer},
+		{&api.StatusError{StatusCode: http.StatusBadRequest}, ErrorClient},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), ErrorTimeout},
+		{context.Canceled, ErrorCancelled},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrorConnection},
+		{util.ErrNoEndpoint, ErrorNoEndpoint},
+		{errors.New("boom"), ErrorUnknown},
+	}
+	for _, c := range cases {
+		if class := ClassifyError(c.err); class != c.class {
+			t.Errorf("ClassifyError(%v) = %q, want %q", c.err, class, c.class)
+		}
+	}
+	if ErrorClient.Retryable() || ErrorCancelled.Retryable() || !ErrorOverloaded.Retryable() || !ErrorTimeout.Retryable() {
+		t.Error("unexpected retryable classification")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	rng, again := util.NewRand(1, 2), util.NewRand(1, 2)
+	for retry := 1; retry <= 10; retry++ {
+		ceiling := min(100*time.Millisecond<<(retry-1), time.Second)
+		for i := 0; i < 100; i++ {
+			delay := policy.Backoff(retry, rng)
+			if delay < 0 || delay > ceiling {
+				t.Fatalf("backoff %v of retry %d exceeds %v", delay, retry, ceiling)
+			}
+			// the jitter follows the seed
+			if same := policy.Backoff(retry, again); same != delay {
+				t.Fatalf("expected the backoff %v of the same seed, got %v", delay, same)
+			}
+		}
+	}
+	if delay := (RetryPolicy{}).Backoff(3, rng); delay != 0 {
+		t.Fatalf("expected no backoff, got %v", delay)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var budget retryBudget
+	if !budget.acquire(0.1, 5) {
+		t.Fatal("at least one retry should be allowed")
+	}
+	if budget.acquire(0.1, 5) {
+		t.Fatal("retry beyond the budget was allowed")
+	}
+	if !budget.acquire(0.1, 20) || budget.acquire(0.1, 20) {
+		t.Fatal("budget should grow with dispatched jobs")
+	}
+	if (&retryBudget{}).acquire(0, 100) {
+		t.Fatal("a zero budget should disable retries")
+	}
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+const (
+	OverflowDrop  = "drop"  // the job is not retried and fails
+	OverflowBlock = "block" // the retry waits until the queue has room
+	OverflowFail  = "fail"  // the batch of the job fails, the replay no longer follows the trace
+)
+
+type retryEntry struct {
+	job     Job
+	readyAt time.Time
+	index   int
+}
+
+type retryHeap []*retryEntry
+
+func (h retryHeap) Len() int           { return len(h) }
+func (h retryHeap) Less(i, j int) bool { return h[i].readyAt.Before(h[j].readyAt) }
+func (h retryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *retryHeap) Push(x any) {
+	entry := x.(*retryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+func (h *retryHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// retryQueue holds failed jobs until their backoff has passed, ready jobs are handed out on the
+// ready channel which the worker only reads when no fresh job is waiting
+type retryQueue struct {
+	capacity int // 0 for unlimited
+	overflow string
+	clock    Clock
+
+	ready chan Job
+
+	mu     *sync.Mutex
+	jobs   retryHeap
+	pushed chan struct{} // closed whenever a job is pushed
+	popped chan struct{} // closed whenever a job leaves the queue
+}
+
+func newRetryQueue(capacity int, overflow string, clock Clock) *retryQueue {
+	switch overflow {
+	case OverflowDrop, OverflowBlock, OverflowFail:
+	default:
+		overflow = OverflowDrop
+	}
+	return &retryQueue{
+		capacity: capacity,
+		overflow: overflow,
+		clock:    clock,
+		ready:    make(chan Job),
+		mu:       &sync.Mutex{},
+		pushed:   make(chan struct{}),
+		popped:   make(chan struct{}),
+	}
+}
+
+func (q *retryQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+// push queues the job to be ready after delay, returns false if the queue is full and the
+// overflow is not block, or if stopChan is closed while blocked
+func (q *retryQueue) push(job Job, delay time.Duration, stopChan <-chan struct{}) bool {
+	q.mu.Lock()
+	for q.capacity > 0 && len(q.jobs) >= q.capacity {
+		if q.overflow != OverflowBlock {
+			q.mu.Unlock()
+			return false
+		}
+		popped := q.popped
+		q.mu.Unlock()
+		select {
+		case <-popped:
+		case <-stopChan:
+			return false
+		}
+		q.mu.Lock()
+	}
+	q.add(job, delay)
+	q.mu.Unlock()
+	return true
+}
+
+// tryPush queues the job to be ready after delay, it returns false if the queue is full
+func (q *retryQueue) tryPush(job Job, delay time.Duration) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.capacity > 0 && len(q.jobs) >= q.capacity {
+		return false
+	}
+	q.add(job, delay)
+	return true
+}
+
+// add must be called with mu held
+func (q *retryQueue) add(job Job, delay time.Duration) {
+	heap.Push(&q.jobs, &retryEntry{job: job, readyAt: q.clock.Now().Add(delay)})
+	close(q.pushed)
+	q.pushed = make(chan struct{})
+}
+
+// pop takes the first job whose backoff has passed, if any
+func (q *retryQueue) pop() (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.jobs) == 0 || q.jobs[0].readyAt.After(q.clock.Now()) {
+		return Job{}, false
+	}
+	head := q.jobs[0]
+	q.remove(head)
+	return head.job, true
+}
+
+// remove must be called with mu held
+func (q *retryQueue) remove(entry *retryEntry) {
+	heap.Remove(&q.jobs, entry.index)
+	close(q.popped)
+	q.popped = make(chan struct{})
+}
+
+// park queues the job beyond the capacity, for a retry the worker stopped before it could queue
+func (q *retryQueue) park(job Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	heap.Push(&q.jobs, &retryEntry{job: job, readyAt: q.clock.Now()})
+}
+
+// drain empties the queue, for the jobs left once the queue stopped running
+func (q *retryQueue) drain() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]Job, 0, len(q.jobs))
+	for q.jobs.Len() > 0 {
+		jobs = append(jobs, heap.Pop(&q.jobs).(*retryEntry).job)
+	}
+	return jobs
+}
+
+// run hands out jobs whose backoff has passed until stopChan is closed
+func (q *retryQueue) run(stopChan <-chan struct{}) {
+	for {
+		var (
+			timer Timer
+			wait  <-chan time.Time
+			ready chan Job
+			head  *retryEntry
+		)
+		q.mu.Lock()
+		pushed := q.pushed
+		if len(q.jobs) > 0 {
+			head = q.jobs[0]
+			if d := head.readyAt.Sub(q.clock.Now()); d > 0 {
+				timer = q.clock.NewTimer(d)
+				wait = timer.C()
+			} else {
+				ready = q.ready
+			}
+		}
+		q.mu.Unlock()
+
+		var job Job
+		if head != nil {
+			job = head.job
+		}
+		select {
+		case <-wait:
+		case <-pushed:
+		case ready <- job:
+			q.mu.Lock()
+			q.remove(head)
+			q.mu.Unlock()
+		case <-stopChan:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package core
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// manualClock only moves when advanced and reports the deadline of every timer it makes, so a test
+// knows when the code under test waits instead of sleeping
+type manualClock struct {
+	mu     *sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+	armed  chan time.Time
+}
+
+type manualTimer struct {
+	clock  *manualClock
+	at     time.Time
+	period time.Duration // of a ticker, which arms itself again once it fires
+	c      chan time.Time
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{
+		mu:    &sync.Mutex{},
+		now:   time.Date(2025, 3, 4, 0, 0, 0, 0, time.UTC),
+		armed: make(chan time.Time, 100),
+	}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &manualTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+		return timer
+	}
+	c.timers = append(c.timers, timer)
+	c.armed <- timer.at
+	return timer
+}
+
+func (c *manualClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ticker := manualTicker{&manualTimer{clock: c, at: c.now.Add(d), period: d, c: make(chan time.Time, 1)}}
+	c.timers = append(c.timers, ticker.manualTimer)
+	c.armed <- ticker.at
+	return ticker
+}
+
+// Advance moves the clock and fires the timers that are due, a ticker drops the ticks nobody received
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.timers = slices.DeleteFunc(c.timers, func(timer *manualTimer) bool {
+		if timer.at.After(c.now) {
+			return false
+		}
+		if timer.period == 0 {
+			timer.c <- c.now
+			return true
+		}
+		select {
+		case timer.c <- c.now:
+		default:
+		}
+		for !timer.at.After(c.now) {
+			timer.at = timer.at.Add(timer.period)
+		}
+		return false
+	})
+}
+
+// waitArmed blocks until a timer due at is made
+func (c *manualClock) waitArmed(t *testing.T, at time.Time) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case armed := <-c.armed:
+			if armed.Equal(at) {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("no timer was made for %s", at)
+		}
+	}
+}
+
+func (t *manualTimer) C() <-chan time.Time { return t.c }
+
+func (t *manualTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := slices.Contains(c.timers, t)
+	c.timers = slices.DeleteFunc(c.timers, func(timer *manualTimer) bool { return timer == t })
+	return pending
+}
+
+type manualTicker struct {
+	*manualTimer
+}
+
+func (t manualTicker) Stop() { t.manualTimer.Stop() }
+
+func (t manualTicker) Reset(d time.Duration) {
+	t.manualTimer.Stop()
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.at, t.period = c.now.Add(d), d
+	c.timers = append(c.timers, t.manualTimer)
+}
+
+// receiveReady waits for the next job the queue hands out
+func receiveReady(t *testing.T, q *retryQueue) Job {
+	t.Helper()
+	select {
+	case job := <-q.ready:
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatal("no job became ready")
+		return Job{}
+	}
+}
+
+func TestRetryQueueOrder(t *testing.T) {
+	clock := newManualClock()
+	start := clock.Now()
+	q := newRetryQueue(0, OverflowDrop, clock)
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+
+	q.push(Job{Id: "late"}, 60*time.Millisecond, stopChan)
+	q.push(Job{Id: "early"}, 20*time.Millisecond, stopChan)
+	go q.run(stopChan)
+
+	// the queue waits for the backoff of the earliest job and hands out nothing meanwhile
+	clock.waitArmed(t, start.Add(20*time.Millisecond))
+	select {
+	case job := <-q.ready:
+		t.Fatalf("job %s handed out before its backoff", job.Id)
+	default:
+	}
+	clock.Advance(20 * time.Millisecond)
+	if job := receiveReady(t, q); job.Id != "early" {
+		t.Fatalf("expected early, got %s", job.Id)
+	}
+
+	clock.waitArmed(t, start.Add(60*time.Millisecond))
+	clock.Advance(40 * time.Millisecond)
+	if job := receiveReady(t, q); job.Id != "late" {
+		t.Fatalf("expected late, got %s", job.Id)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("queue should be empty, has %d", q.Len())
+	}
+}
+
+func TestRetryQueueWakesForEarlierJob(t *testing.T) {
+	clock := newManualClock()
+	start := clock.Now()
+	q := newRetryQueue(0, OverflowDrop, clock)
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go q.run(stopChan)
+
+	q.push(Job{Id: "late"}, time.Minute, stopChan)
+	clock.waitArmed(t, start.Add(time.Minute))
+	// a job pushed with a shorter backoff replaces the timer of the head
+	q.push(Job{Id: "early"}, time.Second, stopChan)
+	clock.waitArmed(t, start.Add(time.Second))
+	clock.Advance(time.Second)
+	if job := receiveReady(t, q); job.Id != "early" {
+		t.Fatalf("expected early, got %s", job.Id)
+	}
+}
+
+func TestRetryQueueOverflow(t *testing.T) {
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+
+	for _, overflow := range []string{OverflowDrop, OverflowFail} {
+		q := newRetryQueue(1, overflow, newManualClock())
+		if !q.push(Job{Id: "1"}, 0, stopChan) {
+			t.Fatal("push into an empty queue failed")
+		}
+		if q.push(Job{Id: "2"}, 0, stopChan) {
+			t.Fatalf("%s queue accepted a job beyond its capacity", overflow)
+		}
+	}
+
+	q := newRetryQueue(1, OverflowBlock, newManualClock())
+	q.push(Job{Id: "1"}, 0, stopChan)
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.push(Job{Id: "2"}, 0, stopChan)
+	}()
+	// nothing leaves the queue before it runs, so the push cannot have returned
+	select {
+	case <-pushed:
+		t.Fatal("blocking push returned while the queue was full")
+	default:
+	}
+	go q.run(stopChan)
+	if job := receiveReady(t, q); job.Id != "1" {
+		t.Fatalf("expected job 1, got %s", job.Id)
+	}
+	if !<-pushed {
+		t.Fatal("blocking push failed after room was made")
+	}
+	if job := receiveReady(t, q); job.Id != "2" {
+		t.Fatalf("expected job 2, got %s", job.Id)
+	}
+}
+
+func TestRetryQueueBlockedPushStops(t *testing.T) {
+	stopChan := make(chan struct{})
+	q := newRetryQueue(1, OverflowBlock, newManualClock())
+	q.push(Job{Id: "1"}, 0, stopChan)
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.push(Job{Id: "2"}, 0, stopChan)
+	}()
+	close(stopChan)
+	select {
+	case ok := <-pushed:
+		if ok {
+			t.Fatal("expected the blocked push to fail once stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked push never returned after the stop")
+	}
+}
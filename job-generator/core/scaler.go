@@ -1,6 +1,9 @@
 package core
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/paopaoyue/kscale/job-genrator/api"
 	"github.com/paopaoyue/kscale/job-genrator/config"
 	"github.com/paopaoyue/kscale/job-genrator/metrics"
@@ -8,7 +11,9 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -20,182 +25,478 @@ type DataPoint struct {
 	NewJob         int
 	OngoingJob     int
 	CompletedJob   int
+	AbandonedJob   int
+	FailedJob      int
 	AvgDuration    float64 // in milliseconds
 	AvgDelay       float64 // in milliseconds
+	P50Delay       float64 // in milliseconds
+	P95Delay       float64 // in milliseconds
+	P99Delay       float64 // in milliseconds
+	QueueAge       float64 // of the oldest unfinished job, in milliseconds
+	PredictedWork  float64 // of the queued and running jobs, in GPU seconds
 	Reward         float64
+	ObservedAt     time.Time
 }
 
+// Scaler scales the workers shared by every batch. The batches replay against the same deployment, so
+// one scaler decides on the jobs of all of them rather than a scaler per batch fighting over the same
+// replicas. Each batch attaches a scope that collects its own jobs into its metrics file, the scaler
+// observes the jobs of every scope every metrics window and decides on them, and it runs only while a
+// batch is attached. The observation loop owns the data
+// points, the decision loop owns the policies, the guardrails and the expected workers, and decisions
+// are handed from one to the other newest first: a newer observation supersedes the decision still
+// waiting, which never runs, and the decision in flight, whose policy is cancelled and whose result is
+// dropped, so a decision is only ever applied on the newest observation
 type Scaler struct {
-	time              int // in seconds
-	jobBatchName      string
-	jobBatchStartTime time.Time
+	time int // in seconds of observation, only used by the observation loop
 
 	dataPointList []DataPoint
+	reward        float64
 
-	stepTicker   *time.Ticker
-	reportTicker *time.Ticker
-	stopChan     chan struct{}
+	policy      Policy
+	fallback    Policy // nil for none
+	serviceTime *ServiceTimeModel
+	guardrails  *Guardrails
+	actuator    Actuator
 
-	expectedWorker     int
-	queueSize          atomic.Int32
+	clock   Clock
+	metrics metrics.MetricsClient
+	datadog metrics.MetricsClient
+
+	ctx            context.Context // cancelled when the scaler stops
+	cancel         context.CancelFunc
+	stepInterval   time.Duration
+	reportInterval time.Duration
+	stopChan       chan struct{}
+	decisionChan   chan decision // holds the newest decision not taken yet
+	wg             *sync.WaitGroup
+
+	runMu   *sync.Mutex // serializes attaching and detaching, which start and stop the loops
+	running bool
+
+	scopesMu *sync.Mutex
+	scopes   []*scope
+
+	version        atomic.Int64 // of the newest decision
+	applied        atomic.Int64 // version of the newest decision applied, only set by the decision loop
+	expectedWorker atomic.Int32 // of the last scale that succeeded
+	runningWorker  atomic.Int32 // as last reported by the actuator
+	totalWorker    atomic.Int32
+
+	inflightMu *sync.Mutex
+	inflight   context.CancelCauseFunc // cancels the policy of the decision in flight, nil for none
+
+	windowMu           *sync.Mutex
+	windowNewJob       int
 	windowCompletedJob []Job
-	reward             float64
 }
 
-func NewScaler() *Scaler {
-	return &Scaler{
+// scope collects the jobs of one batch, so its metrics file only counts its own jobs
+type scope struct {
+	scaler    *Scaler
+	name      string
+	startTime time.Time
+
+	mu       *sync.Mutex
+	newJobs  int
+	finished []Job
+	pending  map[string]Job // the unfinished jobs by id
+
+	time   int // in seconds since the batch started, only used by the observation loop of the scope
+	reward float64
+
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// decision asks the decision loop to scale for the observation made at time
+type decision struct {
+	version int64
+	time    int
+	param   api.CalcWorkerCountRequestParam
+}
+
+// NewScaler fails on a scale or fallback policy it cannot build, so a typo never scales with another policy
+func NewScaler(client *api.Client, actuator Actuator, clock Clock) (*Scaler, error) {
+	policy, err := NewPolicy(config.C.ScalePolicy, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the scale policy: %w", err)
+	}
+	var fallback Policy
+	if config.C.FallbackPolicy != "" && config.C.FallbackPolicy != policy.Name() {
+		fallback, err = NewPolicy(config.C.FallbackPolicy, client)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the fallback policy: %w", err)
+		}
+	}
+
+	s := &Scaler{
 		dataPointList: []DataPoint{},
 
-		stepTicker:   time.NewTicker(time.Duration(config.C.MetricsWindow) * time.Second),
-		reportTicker: time.NewTicker(1 * time.Second),
-		stopChan:     make(chan struct{}),
+		policy:      policy,
+		fallback:    fallback,
+		serviceTime: NewServiceTimeModel(),
+		guardrails:  NewGuardrailsFromConfig(),
+		actuator:    actuator,
+
+		clock:   clock,
+		metrics: metrics.Client,
+		datadog: metrics.DatadogClient,
 
-		queueSize:          atomic.Int32{},
+		stepInterval:   time.Duration(config.C.MetricsWindow) * time.Second,
+		reportInterval: 1 * time.Second,
+		wg:             &sync.WaitGroup{},
+
+		runMu:    &sync.Mutex{},
+		scopesMu: &sync.Mutex{},
+
+		inflightMu: &sync.Mutex{},
+
+		windowMu:           &sync.Mutex{},
 		windowCompletedJob: []Job{},
 	}
+	s.expectedWorker.Store(int32(config.C.InitWorkerCount))
+	s.reset()
+	return s, nil
+}
+
+// reset makes the context and the channels for the next run of the loops
+func (s *Scaler) reset() {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.stopChan = make(chan struct{})
+	s.decisionChan = make(chan decision, 1)
+}
+
+// Attach starts observing a batch into its metrics file, the first batch attached starts the scaler
+func (s *Scaler) Attach(jobBatchName string, jobBatchStartTime time.Time) *scope {
+	sc := s.newScope(jobBatchName, jobBatchStartTime)
+	file := OpenCSVAndWriteHeader(filepath.Join(config.C.OutputFilePath, jobBatchName+"-metrics.csv"), metricsHeader)
+	go s.scopeLoop(sc, file)
+
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.scopesMu.Lock()
+	s.scopes = append(s.scopes, sc)
+	s.scopesMu.Unlock()
+	if !s.running {
+		s.running = true
+		s.wg.Add(3)
+		go s.loop("observation", s.observationLoop)
+		go s.loop("decision", s.decisionLoop)
+		// apart from the observations so a slow actuator does not delay them
+		go s.loop("report", s.reportLoop)
+	}
+	return sc
+}
+
+// attachScope adds a batch a simulation observes itself, on the events of its clock, so no loop is started
+func (s *Scaler) attachScope(jobBatchName string, jobBatchStartTime time.Time) *scope {
+	sc := s.newScope(jobBatchName, jobBatchStartTime)
+	close(sc.doneChan) // no scope loop to wait for when detached
+	s.scopesMu.Lock()
+	s.scopes = append(s.scopes, sc)
+	s.scopesMu.Unlock()
+	return sc
+}
+
+func (s *Scaler) newScope(jobBatchName string, jobBatchStartTime time.Time) *scope {
+	return &scope{
+		scaler:    s,
+		name:      jobBatchName,
+		startTime: jobBatchStartTime,
+		mu:        &sync.Mutex{},
+		finished:  []Job{},
+		pending:   map[string]Job{},
+		stopChan:  make(chan struct{}),
+		doneChan:  make(chan struct{}),
+	}
+}
+
+// Detach stops observing a batch, the last batch detached stops the scaler
+func (s *Scaler) Detach(sc *scope) {
+	close(sc.stopChan)
+	<-sc.doneChan
+
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.scopesMu.Lock()
+	s.scopes = slices.DeleteFunc(s.scopes, func(other *scope) bool { return other == sc })
+	idle := len(s.scopes) == 0
+	s.scopesMu.Unlock()
+	if idle && s.running {
+		s.running = false
+		s.Stop()
+	}
+	if idle {
+		s.clear()
+	}
 }
 
-func (s *Scaler) Start(jobBatchName string, jobBatchStartTime time.Time) {
+// clear forgets the observations and the cooldowns of the guardrails and the policies once no batch is
+// attached, so the next batch starts its observation time, its forecast points and its reward over. It
+// runs with the loops stopped
+func (s *Scaler) clear() {
 	s.time = 0
+	s.dataPointList = []DataPoint{}
 	s.reward = 0
-	s.expectedWorker = config.C.InitWorkerCount
-	s.jobBatchName = jobBatchName
-	s.jobBatchStartTime = jobBatchStartTime
-	file := OpenCSVAndWriteHeader(filepath.Join(config.C.OutputFilePath, s.jobBatchName+"-metrics.csv"),
-		[]string{
-			"Time",
-			"Expected Worker",
-			"Running Worker",
-			"Total Worker",
-			"New Job",
-			"Ongoing Job",
-			"Completed Job",
-			"Avg Duration",
-			"Avg Delay",
-			"Reward",
-		})
-	go func() {
-		// catch panic
-		defer func() {
-			if r := recover(); r != nil {
-				slog.Error("Scaler recovered from panic", "error", r)
-			}
-		}()
-		defer file.Close()
-		for {
-			select {
-			case <-s.stepTicker.C:
-				s.step(file)
-			case <-s.reportTicker.C:
-				s.report()
-			case <-s.stopChan:
-				return
-			}
+	s.windowMu.Lock()
+	s.windowNewJob, s.windowCompletedJob = 0, []Job{}
+	s.windowMu.Unlock()
+	s.guardrails.Reset()
+	for _, policy := range s.scaledPolicies() {
+		policy.Reset()
+	}
+}
+
+// scaledPolicies are the scale and fallback policies that keep the time of the last scale action, both
+// are told of a scale action whichever of them decided it
+func (s *Scaler) scaledPolicies() []scaledPolicy {
+	policies := []scaledPolicy{}
+	for _, policy := range []Policy{s.policy, s.fallback} {
+		if policy, ok := policy.(scaledPolicy); ok {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+func (s *Scaler) loop(name string, run func()) {
+	defer s.wg.Done()
+	// catch panic
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Scaler recovered from panic", "loop", name, "error", r)
 		}
 	}()
+	run()
+}
+
+func (s *Scaler) observationLoop() {
+	ticker := s.clock.NewTicker(s.stepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			s.step()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+func (s *Scaler) decisionLoop() {
+	for {
+		select {
+		case d := <-s.decisionChan:
+			s.decide(d)
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+func (s *Scaler) reportLoop() {
+	ticker := s.clock.NewTicker(s.reportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			s.report()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
 
+// scopeLoop writes the observations of a batch every metrics window since the batch started
+func (s *Scaler) scopeLoop(sc *scope, file *os.File) {
+	defer close(sc.doneChan)
+	defer file.Close()
+	// catch panic
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Scaler recovered from panic", "loop", "scope", "batch", sc.name, "error", r)
+		}
+	}()
+	ticker := s.clock.NewTicker(s.stepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			AppendCSV(file, metricsRow(sc.step()))
+		case <-sc.stopChan:
+			return
+		}
+	}
 }
 
+// Stop aborts the decision in flight and waits for the loops to exit, the next run starts them again
 func (s *Scaler) Stop() {
-	s.stepTicker.Stop()
-	s.reportTicker.Stop()
+	s.cancel()
 	close(s.stopChan)
+	s.wg.Wait()
+	s.reset()
 }
 
-func (s *Scaler) PreProcessJob(job Job) {
-	s.queueSize.Add(1)
-	metrics.Client.Count(metrics.JobRequest)
-	metrics.DatadogClient.Count(metrics.JobRequest)
+func (sc *scope) PreProcessJob(job Job) {
+	sc.add(job)
+	s := sc.scaler
+	s.windowMu.Lock()
+	s.windowNewJob++
+	s.windowMu.Unlock()
+	s.metrics.Count(metrics.JobRequest)
+	s.datadog.Count(metrics.JobRequest)
 }
 
-func (s *Scaler) PostProcessJob(job Job) {
-	s.queueSize.Add(-1)
-
+func (sc *scope) PostProcessJob(job Job) {
+	if job.Cancelled {
+		// a cancelled job tells nothing about the workers, it only leaves the queue
+		sc.mu.Lock()
+		delete(sc.pending, job.Id)
+		sc.mu.Unlock()
+		return
+	}
+	sc.remove(job)
+	s := sc.scaler
 	if job.Success {
-		metrics.Client.Count(metrics.JobSuccess)
-		metrics.DatadogClient.Count(metrics.JobSuccess)
+		s.serviceTime.Observe(job.Param, job.Duration)
+
+		s.metrics.Count(metrics.JobSuccess)
+		s.datadog.Count(metrics.JobSuccess)
 
-		metrics.Client.Time(metrics.JobDuration, job.Duration)
-		metrics.DatadogClient.Time(metrics.JobDuration, job.Duration)
+		s.metrics.Time(metrics.JobDuration, job.Duration)
+		s.datadog.Time(metrics.JobDuration, job.Duration)
 
-		metrics.Client.Time(metrics.JobLatency, job.EndTime.Sub(job.RequestTime))
-		metrics.DatadogClient.Time(metrics.JobLatency, job.EndTime.Sub(job.RequestTime))
+		s.metrics.Time(metrics.JobLatency, job.EndTime.Sub(job.RequestTime))
+		s.datadog.Time(metrics.JobLatency, job.EndTime.Sub(job.RequestTime))
+	} else if job.Abandoned {
+		s.metrics.Count(metrics.JobAbandon)
+		s.datadog.Count(metrics.JobAbandon)
 	} else {
-		metrics.Client.Count(metrics.JobFailure)
-		metrics.DatadogClient.Count(metrics.JobFailure)
+		s.metrics.Count(metrics.JobFailure)
+		s.datadog.Count(metrics.JobFailure)
 	}
 
+	s.windowMu.Lock()
 	s.windowCompletedJob = append(s.windowCompletedJob, job)
+	s.windowMu.Unlock()
 }
 
-func (s *Scaler) step(outputFile *os.File) {
+// add and remove keep the window and the unfinished jobs of the scope
+func (sc *scope) add(job Job) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.newJobs++
+	sc.pending[job.Id] = job
+}
+
+func (sc *scope) remove(job Job) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.pending, job.Id)
+	sc.finished = append(sc.finished, job)
+}
+
+// step observes the last metrics window of the batch, runs on the observation loop of the scope
+func (sc *scope) step() (int, DataPoint) {
+	sc.time += config.C.MetricsWindow
+
+	sc.mu.Lock()
+	newJobs, finished := sc.newJobs, sc.finished
+	sc.newJobs, sc.finished = 0, []Job{}
+	sc.mu.Unlock()
+
+	dp := sc.scaler.observe(sc.startTime.Add(time.Duration(sc.time)*time.Second), newJobs, finished, []*scope{sc})
+	sc.reward += windowReward(finished, dp.TotalWorker)
+	dp.Reward = sc.reward
+	return sc.time, dp
+}
+
+// step observes the last metrics window of every batch and decides on it, runs on the observation loop
+func (s *Scaler) step() {
 	s.time += config.C.MetricsWindow
 
-	// calculate data point
-	aggregateTime := s.jobBatchStartTime.Add(time.Duration(s.time) * time.Second)
-	dp := DataPoint{
-		ExpectedWorker: s.expectedWorker,
-		RunningWorker:  int(math.Round(metrics.Client.ReadGauge(aggregateTime, metrics.RunningWorkerNum))),
-		TotalWorker:    int(math.Round(metrics.Client.ReadGauge(aggregateTime, metrics.WorkerNum))),
-		NewJob:         int(math.Round(metrics.Client.ReadCount(aggregateTime, metrics.JobRequest))),
-		OngoingJob:     int(s.queueSize.Load()),
-		CompletedJob:   int(math.Round(metrics.Client.ReadCount(aggregateTime, metrics.JobSuccess))),
-		AvgDuration:    float64(metrics.Client.ReadTime(aggregateTime, metrics.JobDuration).Milliseconds()),
-		AvgDelay:       float64(metrics.Client.ReadTime(aggregateTime, metrics.JobLatency).Milliseconds()),
-	}
-	for _, job := range s.windowCompletedJob {
-		delay := job.EndTime.Sub(job.RequestTime)
-		if job.Success && delay.Milliseconds() < int64(config.C.LatencyThreshold) {
-			s.reward += config.C.JobReward
-		}
-	}
-	s.reward -= config.C.WorkerCostPerHour * float64(config.C.MetricsWindow) / 3600.0 * float64(dp.TotalWorker)
-	dp.Reward = s.reward
+	s.windowMu.Lock()
+	newJobs, finished := s.windowNewJob, s.windowCompletedJob
+	s.windowNewJob, s.windowCompletedJob = 0, []Job{}
+	s.windowMu.Unlock()
+	s.scopesMu.Lock()
+	scopes := slices.Clone(s.scopes)
+	s.scopesMu.Unlock()
 
+	dp := s.observe(s.clock.Now(), newJobs, finished, scopes)
+	s.reward += windowReward(finished, dp.TotalWorker)
+	dp.Reward = s.reward
 	s.dataPointList = append(s.dataPointList, dp)
 
 	// scale worker
 	if config.C.EnableAutoScaling {
-		go func() {
-			param := api.CalcWorkerCountRequestParam{
-				Time:   s.time,
-				Points: []api.DataPoint{},
-			}
-			dataPointLen := len(s.dataPointList)
-			for i := config.C.ForecastWindow - 1; i >= 0; i-- {
-				if dataPointLen-i-1 < 0 {
-					continue
-				} else {
-					dp := s.dataPointList[dataPointLen-i-1]
-					param.Points = append(param.Points, api.DataPoint{
-						RunningWorker: dp.RunningWorker,
-						NewJob:        dp.NewJob,
-						OngoingJob:    dp.OngoingJob,
-						CompletedJob:  dp.CompletedJob,
-						AvgDuration:   dp.AvgDuration,
-						AvgDelay:      dp.AvgDelay,
-					})
-				}
-			}
-			expectedWorker, err := api.CalcWorkerCount("http://"+config.C.APIEndpoint, param)
-			if err != nil {
-				slog.Error("Failed to calculate worker count", "err", err)
-				return
-			}
-			if expectedWorker != s.expectedWorker {
-				s.expectedWorker = expectedWorker
-				err := api.ScaleWorker("http://"+config.C.RayDashboardEndpoint, expectedWorker)
-				if err != nil {
-					slog.Error("Failed to scale worker", "err", err)
-					return
-				}
-			}
-		}()
-	}
-
-	// write to file
-	AppendCSV(outputFile, []string{
-		strconv.Itoa(s.time),
+		s.requestDecision(s.time, s.forecastParam())
+	}
+}
+
+// observe makes the data point of the metrics window ending at now from the jobs that arrived and
+// finished in it and the jobs of the scopes still unfinished, the reward is left to the caller
+func (s *Scaler) observe(now time.Time, newJobs int, finished []Job, scopes []*scope) DataPoint {
+	dp := DataPoint{
+		ExpectedWorker: int(s.expectedWorker.Load()),
+		RunningWorker:  int(s.runningWorker.Load()),
+		TotalWorker:    int(s.totalWorker.Load()),
+		NewJob:         newJobs,
+		ObservedAt:     now,
+	}
+	ongoing, age, shapes := pendingJobs(now, scopes)
+	dp.OngoingJob = ongoing
+	dp.QueueAge = float64(age.Milliseconds())
+	dp.PredictedWork = s.serviceTime.Work(shapes)
+	dp.observeWindow(finished)
+	return dp
+}
+
+// pendingWork counts the unfinished jobs of a scope and predicts their work in GPU seconds
+func (s *Scaler) pendingWork(sc *scope) (int, float64) {
+	count, _, shapes := pendingJobs(s.clock.Now(), []*scope{sc})
+	return count, s.serviceTime.Work(shapes)
+}
+
+// pendingJobs counts the unfinished jobs of the scopes, how long the oldest has waited at now and their shapes
+func pendingJobs(now time.Time, scopes []*scope) (int, time.Duration, map[jobShape]int) {
+	count, age, shapes := 0, time.Duration(0), map[jobShape]int{}
+	for _, sc := range scopes {
+		sc.mu.Lock()
+		for _, job := range sc.pending {
+			count++
+			age = max(age, now.Sub(job.RequestTime))
+			shapes[shapeOf(job.Param)]++
+		}
+		sc.mu.Unlock()
+	}
+	return count, age, shapes
+}
+
+var metricsHeader = []string{
+	"Time",
+	"Expected Worker",
+	"Running Worker",
+	"Total Worker",
+	"New Job",
+	"Ongoing Job",
+	"Completed Job",
+	"Avg Duration",
+	"Avg Delay",
+	"Reward",
+	"Abandoned Job",
+	"Predicted Work",
+	"Failed Job",
+	"P50 Delay",
+	"P95 Delay",
+	"P99 Delay",
+	"Queue Age",
+}
+
+func metricsRow(time int, dp DataPoint) []string {
+	return []string{
+		strconv.Itoa(time),
 		strconv.Itoa(dp.ExpectedWorker),
 		strconv.Itoa(dp.RunningWorker),
 		strconv.Itoa(dp.TotalWorker),
@@ -205,28 +506,241 @@ func (s *Scaler) step(outputFile *os.File) {
 		strconv.FormatFloat(dp.AvgDuration, 'f', 2, 64),
 		strconv.FormatFloat(dp.AvgDelay, 'f', 2, 64),
 		strconv.FormatFloat(dp.Reward, 'f', 8, 64),
-	})
+		strconv.Itoa(dp.AbandonedJob),
+		strconv.FormatFloat(dp.PredictedWork, 'f', 2, 64),
+		strconv.Itoa(dp.FailedJob),
+		strconv.FormatFloat(dp.P50Delay, 'f', 2, 64),
+		strconv.FormatFloat(dp.P95Delay, 'f', 2, 64),
+		strconv.FormatFloat(dp.P99Delay, 'f', 2, 64),
+		strconv.FormatFloat(dp.QueueAge, 'f', 2, 64),
+	}
+}
+
+// observeWindow sets the counts, the averages and the delay percentiles of the jobs finished in the window
+func (dp *DataPoint) observeWindow(finished []Job) {
+	delays := []float64{}
+	duration, delay := time.Duration(0), time.Duration(0)
+	for _, job := range finished {
+		if job.Success {
+			dp.CompletedJob++
+			duration += job.Duration
+			delay += job.EndTime.Sub(job.RequestTime)
+			delays = append(delays, float64(job.EndTime.Sub(job.RequestTime).Milliseconds()))
+		} else if job.Abandoned {
+			dp.AbandonedJob++
+		} else {
+			dp.FailedJob++
+		}
+	}
+	if dp.CompletedJob > 0 {
+		dp.AvgDuration = float64((duration / time.Duration(dp.CompletedJob)).Milliseconds())
+		dp.AvgDelay = float64((delay / time.Duration(dp.CompletedJob)).Milliseconds())
+	}
+	slices.Sort(delays)
+	dp.P50Delay = delayPercentile(delays, 0.5)
+	dp.P95Delay = delayPercentile(delays, 0.95)
+	dp.P99Delay = delayPercentile(delays, 0.99)
+}
+
+// delayPercentile picks the nearest rank of the sorted delays, 0 without delays
+func delayPercentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[max(int(math.Ceil(p*float64(len(sorted))))-1, 0)]
+}
+
+// windowReward is the reward of the jobs completed in a metrics window minus the cost of the workers
+func windowReward(completed []Job, totalWorker int) float64 {
+	reward := 0.0
+	for _, job := range completed {
+		delay := job.EndTime.Sub(job.RequestTime)
+		if job.Success && delay.Milliseconds() < int64(config.C.LatencyThreshold) {
+			reward += config.C.JobReward
+		} else if job.Abandoned {
+			reward -= config.C.AbandonPenalty
+		}
+	}
+	return reward - config.C.WorkerCostPerHour*float64(config.C.MetricsWindow)/3600.0*float64(totalWorker)
+}
+
+// forecastParam copies the last ForecastWindow data points for the policy
+func (s *Scaler) forecastParam() api.CalcWorkerCountRequestParam {
+	param := api.CalcWorkerCountRequestParam{
+		Time:   s.time,
+		Points: []api.DataPoint{},
+	}
+	for _, dp := range s.dataPointList[max(len(s.dataPointList)-config.C.ForecastWindow, 0):] {
+		param.Points = append(param.Points, api.DataPoint{
+			RunningWorker: dp.RunningWorker,
+			NewJob:        dp.NewJob,
+			OngoingJob:    dp.OngoingJob,
+			CompletedJob:  dp.CompletedJob,
+			AvgDuration:   dp.AvgDuration,
+			AvgDelay:      dp.AvgDelay,
+
+			ExpectedWorker: dp.ExpectedWorker,
+			TotalWorker:    dp.TotalWorker,
+			PendingWorker:  max(dp.TotalWorker-dp.RunningWorker, 0),
+			FailedJob:      dp.FailedJob,
+			AbandonedJob:   dp.AbandonedJob,
+			FailureRate:    failureRate(dp),
+			P50Delay:       dp.P50Delay,
+			P95Delay:       dp.P95Delay,
+			P99Delay:       dp.P99Delay,
+			QueueAge:       dp.QueueAge,
+			PredictedWork:  dp.PredictedWork,
+			Reward:         dp.Reward,
+			TimeOfDay:      timeOfDay(dp.ObservedAt),
+			DayOfWeek:      int(dp.ObservedAt.Weekday()),
+		})
+	}
+	return param
+}
+
+// failureRate is the fraction of the jobs finished in the window that failed or were abandoned
+func failureRate(dp DataPoint) float64 {
+	finished := dp.CompletedJob + dp.FailedJob + dp.AbandonedJob
+	if finished == 0 {
+		return 0
+	}
+	return float64(dp.FailedJob+dp.AbandonedJob) / float64(finished)
+}
+
+func timeOfDay(t time.Time) float64 {
+	hour, minute, second := t.Clock()
+	return float64(hour*3600 + minute*60 + second)
+}
+
+// errSuperseded cancels the policy of a decision once a newer one is requested
+var errSuperseded = errors.New("superseded by a newer decision")
+
+// requestDecision hands a decision to the decision loop, replacing the one still waiting there and
+// cancelling the one in flight
+func (s *Scaler) requestDecision(now int, param api.CalcWorkerCountRequestParam) {
+	d := decision{version: s.version.Add(1), time: now, param: param}
+	select {
+	case old := <-s.decisionChan:
+		s.supersede(old, "a newer observation arrived before it started")
+	default:
+	}
+	// the observation loop is the only sender, so the channel has room now
+	s.decisionChan <- d
+
+	s.inflightMu.Lock()
+	if s.inflight != nil {
+		s.inflight(errSuperseded)
+	}
+	s.inflightMu.Unlock()
+}
+
+// decide runs the policy and applies the decision unless a newer one was requested meanwhile, runs on
+// the decision loop
+func (s *Scaler) decide(d decision) {
+	ctx, cancel := context.WithCancelCause(s.ctx)
+	defer cancel(nil)
+	s.inflightMu.Lock()
+	s.inflight = cancel
+	s.inflightMu.Unlock()
+	defer func() {
+		s.inflightMu.Lock()
+		s.inflight = nil
+		s.inflightMu.Unlock()
+	}()
+
+	current := int(s.expectedWorker.Load())
+	desiredWorker, err := s.calcWorkerCount(ctx, d.param, current)
+	// the newer decision may have been requested before this one could be cancelled
+	if d.version < s.version.Load() {
+		s.supersede(d, "a newer observation arrived while deciding")
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to calculate worker count", "err", err)
+		return
+	}
+	expectedWorker := s.applyGuardrails(d.time, current, desiredWorker)
+	if expectedWorker != current {
+		if err := s.actuator.Scale(s.ctx, expectedWorker); err != nil {
+			slog.Error("Failed to scale worker", "actuator", s.actuator.Name(), "err", err)
+			return
+		}
+		s.guardrails.Scaled(d.time)
+		for _, policy := range s.scaledPolicies() {
+			policy.Scaled(d.time)
+		}
+		s.expectedWorker.Store(int32(expectedWorker))
+	}
+	s.applied.Store(d.version)
+}
 
-	// reset window completed job
-	s.windowCompletedJob = []Job{}
+func (s *Scaler) supersede(d decision, reason string) {
+	slog.Warn("Scale decision superseded", "version", d.version, "time", d.time, "reason", reason)
+	s.metrics.Count(metrics.ScaleSuperseded)
+	s.datadog.Count(metrics.ScaleSuperseded)
+}
+
+// calcWorkerCount asks the scale policy, or the fallback policy when it fails, but not once the
+// decision was cancelled
+func (s *Scaler) calcWorkerCount(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error) {
+	count, err := s.policy.CalcWorkerCount(ctx, param, current)
+	if err == nil || s.fallback == nil || ctx.Err() != nil {
+		return count, err
+	}
+	slog.Warn("Scale policy failed, using fallback", "policy", s.policy.Name(), "fallback", s.fallback.Name(), "err", err)
+	s.metrics.Count(metrics.PolicyFallback)
+	s.datadog.Count(metrics.PolicyFallback)
+	return s.fallback.CalcWorkerCount(ctx, param, current)
+}
+
+func (s *Scaler) applyGuardrails(now, current, desired int) int {
+	replicas, clamps := s.guardrails.Apply(now, current, desired)
+	if len(clamps) == 0 {
+		return replicas
+	}
+	slog.Warn("Scale decision clamped by guardrails", "time", now, "current", current, "desired", desired, "applied", replicas, "guardrails", clamps)
+	s.metrics.Count(metrics.ScaleClamp)
+	s.datadog.Count(metrics.ScaleClamp)
+	for _, clamp := range clamps {
+		s.metrics.Count(metrics.ScaleClamp + "." + clamp)
+		s.datadog.Count(metrics.ScaleClamp + "." + clamp)
+	}
+	return replicas
 }
 
 func (s *Scaler) report() {
-	running, total, err := api.GetWorkerCount("http://" + config.C.RayDashboardEndpoint)
+	running, total, err := s.actuator.Replicas(s.ctx)
 	if err != nil {
 		slog.Error("Failed to get worker count", "err", err)
 		return
 	}
+	s.runningWorker.Store(int32(running))
+	s.totalWorker.Store(int32(total))
+
+	s.scopesMu.Lock()
+	scopes := slices.Clone(s.scopes)
+	s.scopesMu.Unlock()
+	queueSize, predictedWork := 0, 0.0
+	for _, sc := range scopes {
+		count, work := s.pendingWork(sc)
+		queueSize += count
+		predictedWork += work
+		s.metrics.Gauge(metrics.BatchKey(metrics.PredictedWork, sc.name), work)
+		s.datadog.Gauge(metrics.BatchKey(metrics.PredictedWork, sc.name), work)
+	}
+
+	s.metrics.Gauge(metrics.QueueSize, float64(queueSize))
+	s.datadog.Gauge(metrics.QueueSize, float64(queueSize))
 
-	metrics.Client.Gauge(metrics.QueueSize, float64(s.queueSize.Load()))
-	metrics.DatadogClient.Gauge(metrics.QueueSize, float64(s.queueSize.Load()))
+	s.metrics.Gauge(metrics.PredictedWork, predictedWork)
+	s.datadog.Gauge(metrics.PredictedWork, predictedWork)
 
-	metrics.Client.Gauge(metrics.ExpectedWorkerNum, float64(s.expectedWorker))
-	metrics.DatadogClient.Gauge(metrics.ExpectedWorkerNum, float64(s.expectedWorker))
+	s.metrics.Gauge(metrics.ExpectedWorkerNum, float64(s.expectedWorker.Load()))
+	s.datadog.Gauge(metrics.ExpectedWorkerNum, float64(s.expectedWorker.Load()))
 
-	metrics.Client.Gauge(metrics.RunningWorkerNum, float64(running))
-	metrics.DatadogClient.Gauge(metrics.RunningWorkerNum, float64(running))
+	s.metrics.Gauge(metrics.RunningWorkerNum, float64(running))
+	s.datadog.Gauge(metrics.RunningWorkerNum, float64(running))
 
-	metrics.Client.Gauge(metrics.WorkerNum, float64(total))
-	metrics.DatadogClient.Gauge(metrics.WorkerNum, float64(total))
+	s.metrics.Gauge(metrics.WorkerNum, float64(total))
+	s.datadog.Gauge(metrics.WorkerNum, float64(total))
 }
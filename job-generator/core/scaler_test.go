@@ -0,0 +1,381 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"github.com/paopaoyue/kscale/job-genrator/api/fakeserve"
+	"github.com/paopaoyue/kscale/job-genrator/config"
+	"github.com/paopaoyue/kscale/job-genrator/metrics"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var dummyMetrics sync.Once
+
+// useDummyMetrics sets the metrics clients once, so no test writes them while another one reads them
+func useDummyMetrics() {
+	dummyMetrics.Do(func() {
+		metrics.Client = metrics.NewDummyClient()
+		metrics.DatadogClient = metrics.NewDummyClient()
+	})
+}
+
+func newTestScaler(t *testing.T, policy Policy, actuator Actuator) *Scaler {
+	t.Helper()
+	useDummyMetrics()
+	saved := config.C
+	t.Cleanup(func() { config.C = saved })
+	config.C.OutputFilePath = t.TempDir()
+	config.C.EnableAutoScaling = true
+	config.C.MetricsWindow = 10
+	config.C.ForecastWindow = 3
+	config.C.InitWorkerCount = 1
+	config.C.LatencyThreshold = 1000
+	config.C.JobReward = 1
+	config.C.WorkerCostPerHour = 0
+	config.C.ScalePolicy = PolicyTargetQueue
+	config.C.TargetJobsPerWorker = 1
+	config.C.FallbackPolicy = ""
+
+	s, err := NewScaler(nil, actuator, WallClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.policy = policy
+	s.guardrails = &Guardrails{}
+	s.stepInterval = 2 * time.Millisecond
+	s.reportInterval = 2 * time.Millisecond
+	return s
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// policyFunc adapts a function to a Policy
+type policyFunc func(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error)
+
+func (f policyFunc) Name() string { return "func" }
+
+func (f policyFunc) CalcWorkerCount(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error) {
+	return f(ctx, param, current)
+}
+
+func TestScalerObservesConcurrentJobs(t *testing.T) {
+	actuator := NewRecordActuator(1)
+	s := newTestScaler(t, &TargetQueuePolicy{JobsPerWorker: 1}, actuator)
+	sc := s.Attach("concurrent", time.Now())
+
+	const producers, jobs = 8, 200
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < jobs; i++ {
+				job := Job{Success: true, RequestTime: time.Now()}
+				job.Id = strconv.Itoa(p) + "-" + strconv.Itoa(i)
+				sc.PreProcessJob(job)
+				job.EndTime = job.RequestTime.Add(time.Millisecond)
+				sc.PostProcessJob(job)
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "the last window to be observed", func() bool {
+		s.windowMu.Lock()
+		defer s.windowMu.Unlock()
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		return len(s.windowCompletedJob) == 0 && len(sc.finished) == 0
+	})
+	s.Detach(sc)
+
+	if sc.reward != producers*jobs {
+		t.Fatalf("expected a reward of %d, got %f", producers*jobs, sc.reward)
+	}
+	if len(sc.pending) != 0 {
+		t.Fatalf("expected an empty queue, got %d", len(sc.pending))
+	}
+	data, err := os.ReadFile(filepath.Join(config.C.OutputFilePath, "concurrent-metrics.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := strings.Count(string(data), "\n"); rows < 2 {
+		t.Fatalf("expected observations in the metrics file, got %d rows", rows)
+	}
+}
+
+func TestScalerSupersedesStaleDecisions(t *testing.T) {
+	// the first decision outlasts the next observations, and answers even once it is cancelled
+	cause := make(chan error, 1)
+	var calls atomic.Int32
+	policy := policyFunc(func(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error) {
+		if calls.Add(1) == 1 {
+			<-ctx.Done()
+			cause <- context.Cause(ctx)
+			return 5, nil
+		}
+		return 3, nil
+	})
+	actuator := NewRecordActuator(1)
+	s := newTestScaler(t, policy, actuator)
+	sc := s.Attach("supersede", time.Now())
+	waitFor(t, "a newer decision", func() bool { return s.expectedWorker.Load() == 3 })
+	s.Detach(sc)
+
+	if err := <-cause; !errors.Is(err, errSuperseded) {
+		t.Errorf("expected the slow decision cancelled by a newer one, got %v", err)
+	}
+	// the slow decision is never applied, not even after the newer one
+	for _, d := range actuator.Decisions() {
+		if d.Replicas != 3 {
+			t.Fatalf("expected only the newer decisions applied, got %+v", actuator.Decisions())
+		}
+	}
+}
+
+// failingActuator fails every scale action
+type failingActuator struct {
+	RecordActuator
+}
+
+func (a *failingActuator) Scale(ctx context.Context, replicas int) error {
+	return errors.New("scale failed")
+}
+
+func TestScalerKeepsWorkersWhenScaleFails(t *testing.T) {
+	s := newTestScaler(t, &TargetQueuePolicy{JobsPerWorker: 1}, &failingActuator{*NewRecordActuator(1)})
+	s.guardrails = &Guardrails{ScaleUpCooldown: 60}
+	s.expectedWorker.Store(1)
+	point := api.CalcWorkerCountRequestParam{Time: 10, Points: []api.DataPoint{{OngoingJob: 4}}}
+
+	s.decide(decision{version: s.version.Add(1), time: 10, param: point})
+	if s.expectedWorker.Load() != 1 || s.applied.Load() != 0 {
+		t.Fatalf("expected the failed scale not applied, got %d workers", s.expectedWorker.Load())
+	}
+
+	// without an applied scale the cooldown has not started, so the next decision scales right away
+	s.actuator = NewRecordActuator(1)
+	point.Time = 20
+	s.decide(decision{version: s.version.Add(1), time: 20, param: point})
+	if s.expectedWorker.Load() != 4 {
+		t.Fatalf("expected 4 workers, got %d", s.expectedWorker.Load())
+	}
+}
+
+func TestScalerAppliesDecisionsInOrder(t *testing.T) {
+	policy := policyFunc(func(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error) {
+		time.Sleep(time.Duration(param.Time%3) * 100 * time.Microsecond)
+		return param.Time, nil
+	})
+	actuator := NewRecordActuator(0)
+	s := newTestScaler(t, policy, actuator)
+	s.wg.Add(1)
+	go s.loop("decision", s.decisionLoop)
+	defer s.Stop()
+
+	for now := 1; now <= 300; now++ {
+		s.requestDecision(now, api.CalcWorkerCountRequestParam{Time: now})
+	}
+	waitFor(t, "the newest decision", func() bool { return s.expectedWorker.Load() == 300 })
+
+	last := 0
+	for _, d := range actuator.Decisions() {
+		if d.Replicas <= last {
+			t.Fatalf("decision for %d applied after the one for %d", d.Replicas, last)
+		}
+		last = d.Replicas
+	}
+}
+
+func TestScalerStopAbortsDecision(t *testing.T) {
+	started := make(chan struct{})
+	policy := policyFunc(func(ctx context.Context, param api.CalcWorkerCountRequestParam, current int) (int, error) {
+		close(started)
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	s := newTestScaler(t, policy, NewRecordActuator(1))
+	sc := s.Attach("stop", time.Now())
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		s.Detach(sc)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop waited for the decision in flight")
+	}
+}
+
+func TestScalerScalesRayServe(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Autoscale = func(req fakeserve.CalcRequest) (int, error) { return 3, nil }
+	server := useFakeServe(t, options)
+	config.C.EnableAutoScaling = true
+	config.C.FallbackPolicy = PolicyTargetQueue
+	// the first decision falls back to the target queue policy, which keeps the single replica
+	server.Fail(fakeserve.RouteCalc, http.StatusInternalServerError)
+
+	client := api.NewClientFromConfig()
+	s, err := NewScaler(client, NewRayServeActuator(client), WallClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// long enough for the autoscaler to answer before the next observation supersedes the decision
+	s.stepInterval = 50 * time.Millisecond
+	s.reportInterval = 2 * time.Millisecond
+	sc := s.Attach("ray-serve", time.Now())
+	t.Cleanup(func() { s.Detach(sc) })
+	waitFor(t, "serve to scale to 3 replicas", func() bool { return server.Target() == 3 })
+
+	if server.Requests(fakeserve.RouteCalc) < 2 {
+		t.Errorf("expected a failed and a successful autoscaler request, got %d", server.Requests(fakeserve.RouteCalc))
+	}
+	if running, total := server.Replicas(); running != 3 || total != 3 {
+		t.Errorf("expected 3 running replicas, got %d of %d", running, total)
+	}
+}
+
+func TestScalerScopesBatches(t *testing.T) {
+	s := newTestScaler(t, &TargetQueuePolicy{JobsPerWorker: 1}, NewRecordActuator(1))
+	config.C.EnableAutoScaling = false
+	// the windows are stepped by hand
+	s.stepInterval = time.Hour
+	now := time.Now()
+	first, second := s.Attach("first", now), s.Attach("second", now)
+	if !s.running {
+		t.Fatal("expected the scaler running with batches attached")
+	}
+
+	for i := 0; i < 3; i++ {
+		first.PreProcessJob(Job{Id: strconv.Itoa(i), RequestTime: now})
+	}
+	first.PostProcessJob(Job{Id: "0", Success: true, RequestTime: now, EndTime: now.Add(time.Second)})
+	// the same id in another batch is another job
+	second.PreProcessJob(Job{Id: "0", RequestTime: now})
+
+	if _, dp := first.step(); dp.NewJob != 3 || dp.OngoingJob != 2 || dp.CompletedJob != 1 {
+		t.Errorf("expected the first batch to observe only its jobs, got %+v", dp)
+	}
+	if _, dp := second.step(); dp.NewJob != 1 || dp.OngoingJob != 1 || dp.CompletedJob != 0 {
+		t.Errorf("expected the second batch to observe only its job, got %+v", dp)
+	}
+	s.step()
+	if dp := s.dataPointList[0]; dp.NewJob != 4 || dp.OngoingJob != 3 || dp.CompletedJob != 1 {
+		t.Errorf("expected the scaler to observe the jobs of both batches, got %+v", dp)
+	}
+
+	s.Detach(first)
+	if !s.running {
+		t.Fatal("expected the scaler running while a batch is attached")
+	}
+	s.guardrails.Scaled(s.time)
+	s.Detach(second)
+	if s.running {
+		t.Fatal("expected the scaler stopped once the last batch detached")
+	}
+	// the next batch observes from the start again
+	if s.time != 0 || s.reward != 0 || len(s.dataPointList) != 0 || s.guardrails.lastScale != nil {
+		t.Errorf("expected the observations cleared once idle, got time %d, reward %f and %d points", s.time, s.reward, len(s.dataPointList))
+	}
+	third := s.Attach("third", now)
+	third.PreProcessJob(Job{Id: "0", RequestTime: now})
+	s.step()
+	if at, dp := s.time, s.dataPointList[0]; at != 10 || dp.NewJob != 1 || dp.OngoingJob != 1 {
+		t.Errorf("expected the first window of the third batch at 10s, got %+v at %ds", dp, at)
+	}
+	s.Detach(third)
+}
+
+func TestScalerPredictsWorkPerBatch(t *testing.T) {
+	s := newTestScaler(t, &TargetQueuePolicy{JobsPerWorker: 1}, NewRecordActuator(1))
+	param := api.GenerateRequestParam{SamplerIndex: "Euler", Steps: 20, Width: 512, Height: 512}
+	s.serviceTime.Observe(param, 2*time.Second)
+	now := time.Now()
+	first, second := s.newScope("first", now), s.newScope("second", now)
+	first.add(Job{Id: "1", Param: param, RequestTime: now})
+	first.add(Job{Id: "2", Param: param, RequestTime: now})
+	second.add(Job{Id: "1", Param: param, RequestTime: now})
+
+	if count, work := s.pendingWork(first); count != 2 || work != 4 {
+		t.Errorf("expected 4 GPU seconds for 2 jobs of the first batch, got %.2f for %d", work, count)
+	}
+	if count, work := s.pendingWork(second); count != 1 || work != 2 {
+		t.Errorf("expected 2 GPU seconds for 1 job of the second batch, got %.2f for %d", work, count)
+	}
+}
+
+func TestScalerObservation(t *testing.T) {
+	s := newTestScaler(t, &TargetQueuePolicy{JobsPerWorker: 1}, NewRecordActuator(1))
+	now := time.Date(2025, 3, 4, 13, 30, 15, 0, time.Local)
+	sc := s.newScope("observation", now)
+
+	sc.add(Job{Id: "old", RequestTime: now.Add(-4 * time.Second)})
+	sc.add(Job{Id: "new", RequestTime: now.Add(-time.Second)})
+	sc.remove(Job{Id: "old"})
+	finished := []Job{{Id: "failed"}, {Id: "abandoned", Abandoned: true}}
+	for i := 1; i <= 8; i++ {
+		finished = append(finished, Job{Id: strconv.Itoa(i), Success: true, Duration: 100 * time.Millisecond, RequestTime: now, EndTime: now.Add(time.Duration(i) * 100 * time.Millisecond)})
+	}
+	s.runningWorker.Store(2)
+	s.totalWorker.Store(3)
+
+	dp := s.observe(now, 2, finished, []*scope{sc})
+	if dp.OngoingJob != 1 || dp.QueueAge != 1000 || dp.CompletedJob != 8 || dp.AbandonedJob != 1 || dp.FailedJob != 1 {
+		t.Fatalf("unexpected window counts %+v", dp)
+	}
+	if dp.AvgDuration != 100 || dp.AvgDelay != 450 || dp.P50Delay != 400 || dp.P95Delay != 800 || dp.P99Delay != 800 {
+		t.Fatalf("unexpected window statistics %+v", dp)
+	}
+
+	s.dataPointList = append(s.dataPointList, dp)
+	point := s.forecastParam().Points[0]
+	if point.PendingWorker != 1 || point.FailureRate != 0.2 || point.TimeOfDay != 13*3600+30*60+15 || point.DayOfWeek != int(time.Tuesday) {
+		t.Fatalf("unexpected observation %+v", point)
+	}
+}
+
+func TestWindowReward(t *testing.T) {
+	saved := config.C
+	t.Cleanup(func() { config.C = saved })
+	config.C.JobReward = 1
+	config.C.AbandonPenalty = 2
+	config.C.LatencyThreshold = 1000
+	config.C.WorkerCostPerHour = 360
+	config.C.MetricsWindow = 10
+
+	request := time.Unix(0, 0)
+	job := func(success, abandoned bool, latency time.Duration) Job {
+		return Job{Success: success, Abandoned: abandoned, RequestTime: request, EndTime: request.Add(latency)}
+	}
+	completed := []Job{
+		job(true, false, 500*time.Millisecond),
+		job(true, false, 2*time.Second), // too slow to earn the reward
+		job(false, false, 500*time.Millisecond),
+		job(false, true, time.Second),
+	}
+	// 1 rewarded job, 1 abandoned job and 2 workers costing 1 each for the window
+	if reward := windowReward(completed, 2); reward != -3 {
+		t.Errorf("expected a reward of -3, got %v", reward)
+	}
+}
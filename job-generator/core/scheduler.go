@@ -1,175 +1,295 @@
 package core
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"github.com/paopaoyue/kscale/job-genrator/api"
 	"github.com/paopaoyue/kscale/job-genrator/config"
 	"github.com/paopaoyue/kscale/job-genrator/util"
+	"io"
+	"k8s.io/client-go/kubernetes"
 	"log/slog"
-	"mime/multipart"
-	"path/filepath"
-	"strconv"
+	"math/rand/v2"
+	"sort"
 	"sync"
 	"time"
 )
 
 type JobScheduler struct {
-	active            bool
-	jobBatchStartTime time.Time
-	jobBatchName      string
-	jobBatchSize      int
+	batches map[string]*JobBatch
 
 	jobChan    chan Job
 	outputChan chan Job
 	stopChan   chan struct{}
 
-	worker *JobWorker
-	scaler *Scaler
+	client    *api.Client
+	actuator  Actuator
+	scaler    *Scaler // shared by the batches so they never scale against each other
+	worker    *JobWorker
+	endpoints *util.EndpointGroup
+	k8sClient *kubernetes.Clientset // nil outside a cluster
 
-	mu        *sync.Mutex
-	jobTicker *time.Ticker
+	mu      *sync.Mutex
+	wg      *sync.WaitGroup
+	stopped bool
 }
 
-func NewJobScheduler() *JobScheduler {
+var ErrSchedulerStopped = errors.New("job scheduler is stopped")
+
+func NewJobScheduler(k8sClient *kubernetes.Clientset) *JobScheduler {
 	return &JobScheduler{
-		active:       false,
-		jobBatchName: "",
-		jobBatchSize: 0,
-		jobChan:      make(chan Job, config.C.MaxQueueSize),
-		outputChan:   make(chan Job),
-		stopChan:     make(chan struct{}),
-		mu:           &sync.Mutex{},
+		k8sClient:  k8sClient,
+		batches:    map[string]*JobBatch{},
+		jobChan:    make(chan Job, config.C.MaxQueueSize),
+		outputChan: make(chan Job),
+		stopChan:   make(chan struct{}),
+		mu:         &sync.Mutex{},
+		wg:         &sync.WaitGroup{},
 	}
 }
 
-func (js *JobScheduler) Start() {
-	ep, _ := util.NewEndpoint(config.C.APIEndpoint)
-	js.worker = NewJobWorker(ep, js.jobChan, js.outputChan)
+// Start fails without starting anything if the configured actuator or policies cannot be built, so a
+// typo never falls back to scaling the real cluster or to another policy
+func (js *JobScheduler) Start() error {
+	js.client = api.NewClientFromConfig()
+	actuator, err := NewActuator(config.C.ScaleActuator, js.client, js.k8sClient, config.C.Environment, config.C.ScaleTarget, config.C.ScaleTargetHPA)
+	if err != nil {
+		return fmt.Errorf("failed to create the %s scale actuator: %w", config.C.ScaleActuator, err)
+	}
+	scaler, err := NewScaler(js.client, actuator, WallClock)
+	if err != nil {
+		return err
+	}
+	js.actuator = actuator
+	js.scaler = scaler
+	slog.Info("Scaling workers", "actuator", js.actuator.Name())
+
+	endpoints := util.NewEndpoints(config.C.APIEndpoint)
+	js.endpoints = util.NewEndpointGroup(endpoints, config.C.LoadBalancePolicy, config.C.MaxInflightPerEndpoint)
+	if config.C.EndpointDiscovery {
+		if js.k8sClient == nil {
+			slog.Warn("Endpoint discovery needs a Kubernetes client, using static endpoints")
+		} else {
+			port := int32(8000)
+			if len(endpoints) > 0 {
+				port = endpoints[0].Port
+			}
+			js.endpoints.Watch(js.k8sClient, config.C.Environment, config.C.LabelSelector, port,
+				time.Duration(config.C.DiscoveryInterval)*time.Second, js.stopChan)
+		}
+	}
+	slog.Info("Load balancing api endpoints", "policy", config.C.LoadBalancePolicy, "endpoints", len(js.endpoints.Endpoints()))
+
+	js.worker = NewJobWorker(js.client, js.endpoints, js.jobChan, js.outputChan, WallClock)
 	js.worker.Start()
 
+	js.routeOutput()
+	return nil
 }
 
+// Stop pauses every batch so nothing new is dispatched, lets the jobs in flight finish within
+// ShutdownPeriod so their results are still recorded, then cancels the batches and the jobs left queued
 func (js *JobScheduler) Stop() {
 	js.mu.Lock()
-	defer js.mu.Unlock()
-	if js.jobTicker != nil {
-		js.jobTicker.Stop()
+	js.stopped = true
+	batches := make([]*JobBatch, 0, len(js.batches))
+	for _, batch := range js.batches {
+		batches = append(batches, batch)
+	}
+	js.mu.Unlock()
+
+	for _, batch := range batches {
+		_ = batch.Pause()
 	}
-	time.Sleep(time.Duration(config.C.ShutdownPeriod) * time.Second) // wait for workers to finish
+	js.worker.Stop(time.Duration(config.C.ShutdownPeriod) * time.Second)
 
-	js.worker.Stop()
-	close(js.jobChan)
+	// once the worker has exited and no batch dispatches anymore, the jobs left queued are cancelled
+	for _, batch := range batches {
+		_ = batch.Cancel()
+		<-batch.dispatchChan
+	}
+	if cancelled := js.worker.CancelQueued(); cancelled > 0 {
+		slog.Warn("Cancelled the jobs left queued", "count", cancelled)
+	}
+
+	// routing ends once the last results are handed to their batches
 	close(js.outputChan)
+	js.wg.Wait()
+	for _, batch := range batches {
+		<-batch.doneChan
+	}
 	close(js.stopChan)
+	slog.Info("Job scheduler stopped")
+}
+
+func (js *JobScheduler) EndpointStats() []util.EndpointStats {
+	if js.endpoints == nil {
+		return []util.EndpointStats{}
+	}
+	return js.endpoints.Stats()
 }
 
-func (js *JobScheduler) SubmitJobs(jobBatchName string, file multipart.File) error {
-	if js.active {
-		slog.Warn("Job scheduler is already active")
-		return errors.New("job scheduler is already active")
+// Scale sets the replicas of the served deployment, a dry run only returns the config changes
+func (js *JobScheduler) Scale(ctx context.Context, count int, dryRun bool) (*api.ScaleResult, error) {
+	if js.client == nil {
+		return nil, ErrSchedulerStopped
 	}
-	iter, err := ReadJobCSV(file)
+	return js.client.ScaleDeployment(ctx, count, dryRun)
+}
+
+func (js *JobScheduler) SubmitJobs(jobBatchName, filename, contentType string, file io.Reader, options ReplayOptions) error {
+	if err := js.checkSubmit(jobBatchName, options); err != nil {
+		return err
+	}
+	source, err := OpenJobSource(filename, contentType, file)
 	if err != nil {
 		return err
 	}
+	return js.submit(RunManifest{Batch: jobBatchName, Source: filename, Seed: options.Seed, Options: options}, source)
+}
 
-	go func() {
-		// catch panic
-		defer func() {
-			if r := recover(); r != nil {
-				slog.Error("Ticker recovered from panic", "error", r)
-			}
-		}()
+// SubmitWorkload starts a batch of synthetic jobs generated from the spec, corpus may be nil
+func (js *JobScheduler) SubmitWorkload(spec WorkloadSpec, corpus JobSource, options ReplayOptions) error {
+	if err := js.checkSubmit(spec.Name, options); err != nil {
+		return err
+	}
+	source, err := NewWorkloadSource(spec, corpus)
+	if err != nil {
+		return err
+	}
+	spec = source.Spec()
+	return js.submit(RunManifest{Batch: spec.Name, Seed: spec.Seed, Workload: &spec, Options: options}, source)
+}
 
-		js.active = true
-		js.jobBatchName = jobBatchName
-		js.jobBatchSize = iter.Size()
-		js.jobBatchStartTime = time.Now()
-		js.scaler = NewScaler()
-		js.scaler.Start(jobBatchName, js.jobBatchStartTime)
+func (js *JobScheduler) checkSubmit(jobBatchName string, options ReplayOptions) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	if batch, ok := js.Batch(jobBatchName); ok && batch.Active() {
+		slog.Warn("Job batch is already active", "batch", jobBatchName)
+		return fmt.Errorf("job batch %s is already active", jobBatchName)
+	}
+	return nil
+}
 
-		js.processOutput()
+func (js *JobScheduler) submit(manifest RunManifest, source JobSource) error {
+	iter, err := js.replay(&manifest, source)
+	if err != nil {
+		return err
+	}
+	batch := NewJobBatch(manifest, iter, js.scaler, js.jobChan)
+	return js.register(batch, batch.Start)
+}
 
-		js.jobTicker = time.NewTicker(1 * time.Millisecond)
+// replay opens the source for the replay options of the manifest and records the trace and the seed
+// in the manifest
+func (js *JobScheduler) replay(manifest *RunManifest, source JobSource) (JobSource, error) {
+	iter, err := newReplaySource(source, manifest.Options)
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	if manifest.Seed == 0 {
+		manifest.Seed = rand.Uint64()
+	}
+	manifest.Version = util.BuildVersion()
+	manifest.TraceHash = source.Hash()
+	manifest.Size = iter.Size()
+	manifest.Config = config.C
+	return iter, nil
+}
 
-		var (
-			job     Job
-			hasNext bool
-		)
-		if job, hasNext = iter.Next(); hasNext {
-			for {
-				select {
-				case <-js.stopChan:
-					return
-				case <-js.jobTicker.C:
-					current := time.Now()
-					timeElapsed := current.Sub(js.jobBatchStartTime)
-					jobTime := job.RequestTime.Sub(time.UnixMilli(0))
-					for timeElapsed >= jobTime {
-						job.RequestTime = current
-						js.scaler.PreProcessJob(job)
-						js.jobChan <- job
-						if job, hasNext = iter.Next(); hasNext {
-							jobTime = job.RequestTime.Sub(time.UnixMilli(0))
-							if timeElapsed < jobTime {
-								js.jobTicker.Reset(jobTime - timeElapsed)
-							}
-						} else {
-							break
-						}
-					}
-				}
-				if !hasNext {
-					js.jobTicker.Stop()
-					break
-				}
-			}
-		}
-	}()
+// register adds the batch under its name and starts it, unless a batch of that name is still active,
+// so no two batches ever write the same files
+func (js *JobScheduler) register(batch *JobBatch, start func()) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.stopped {
+		batch.iter.Close()
+		return ErrSchedulerStopped
+	}
+	if other, ok := js.batches[batch.Name]; ok && other.Active() {
+		batch.iter.Close()
+		slog.Warn("Job batch is already active", "batch", batch.Name)
+		return fmt.Errorf("job batch %s is already active", batch.Name)
+	}
+
+	js.batches[batch.Name] = batch
+	start()
 
 	return nil
 }
 
-func (js *JobScheduler) processOutput() {
-	file := OpenCSVAndWriteHeader(filepath.Join(config.C.OutputFilePath, js.jobBatchName+"-result.csv"),
-		[]string{
-			"Id",
-			"Success",
-			"Retry",
-			"RequestTime",
-			"EndTime",
-			"Duration",
-			"Latency",
-		})
+func (js *JobScheduler) Batch(jobBatchName string) (*JobBatch, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	batch, ok := js.batches[jobBatchName]
+	return batch, ok
+}
+
+func (js *JobScheduler) Batches() []*JobBatch {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	batches := make([]*JobBatch, 0, len(js.batches))
+	for _, batch := range js.batches {
+		batches = append(batches, batch)
+	}
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i].StartTime.Before(batches[j].StartTime)
+	})
+	return batches
+}
+
+func (js *JobScheduler) PauseBatch(jobBatchName string) error {
+	batch, ok := js.Batch(jobBatchName)
+	if !ok {
+		return ErrBatchNotFound
+	}
+	return batch.Pause()
+}
+
+func (js *JobScheduler) ResumeBatch(jobBatchName string) error {
+	batch, ok := js.Batch(jobBatchName)
+	if !ok {
+		return ErrBatchNotFound
+	}
+	return batch.Resume()
+}
+
+func (js *JobScheduler) CancelBatch(jobBatchName string) error {
+	batch, ok := js.Batch(jobBatchName)
+	if !ok {
+		return ErrBatchNotFound
+	}
+	return batch.Cancel()
+}
+
+// routeOutput hands every finished job from the shared worker pool back to the batch it belongs to
+func (js *JobScheduler) routeOutput() {
+	js.wg.Add(1)
 	go func() {
-		defer file.Close()
-		var count int
+		defer js.wg.Done()
 		for {
 			select {
 			case <-js.stopChan:
 				return
-			case job := <-js.outputChan:
-				js.scaler.PostProcessJob(job)
-				AppendCSV(file, []string{
-					job.Id,
-					strconv.FormatBool(job.Success),
-					strconv.Itoa(job.Retry),
-					formatTimeWithMillis(job.RequestTime),
-					formatTimeWithMillis(job.EndTime),
-					strconv.FormatInt(job.Duration.Milliseconds(), 10),
-					strconv.FormatInt(job.EndTime.Sub(job.RequestTime).Milliseconds(), 10),
-				})
-				count++
-			}
-			if count >= js.jobBatchSize {
-				break
+			case job, ok := <-js.outputChan:
+				if !ok {
+					return
+				}
+				batch := job.batch
+				if batch == nil {
+					slog.Warn("Dropping job without batch", "jobId", job.Id)
+					continue
+				}
+				// a batch reads until every job it dispatched is back, stopped or not
+				select {
+				case batch.outputChan <- job:
+				case <-batch.doneChan:
+					slog.Warn("Dropping job of a finished batch", "jobId", job.Id, "batch", batch.Name)
+				}
 			}
 		}
-
-		slog.Info("Job batch completed", "Name", js.jobBatchName, "Size", js.jobBatchSize, "Duration", time.Since(js.jobBatchStartTime))
-		js.active = false
-		js.jobBatchName = ""
-		js.jobBatchSize = 0
-		js.jobBatchStartTime = time.Time{}
-		js.scaler.Stop()
 	}()
 }
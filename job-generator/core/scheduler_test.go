@@ -0,0 +1,378 @@
+package core
+
+import (
+	"encoding/csv"
+	"github.com/paopaoyue/kscale/job-genrator/api/fakeserve"
+	"github.com/paopaoyue/kscale/job-genrator/config"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFakeServe loads the default config pointed at a fake ray serve for the test
+func useFakeServe(t *testing.T, options fakeserve.Options) *fakeserve.Server {
+	t.Helper()
+	useDummyMetrics()
+	server := fakeserve.New(options)
+	t.Cleanup(server.Close)
+	saved := config.C
+	t.Cleanup(func() { config.C = saved })
+	t.Setenv("API_ENDPOINT", server.Host())
+	t.Setenv("RAY_DASHBOARD_ENDPOINT", server.Host())
+	t.Setenv("OUTPUT_FILE_PATH", t.TempDir())
+	config.LoadConfig()
+	return server
+}
+
+func TestSchedulerRunsBatch(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Latency = 20 * time.Millisecond
+	options.Autoscale = func(req fakeserve.CalcRequest) (int, error) { return 2, nil }
+	server := useFakeServe(t, options)
+	config.C.EnableAutoScaling = true
+	config.C.MetricsWindow = 1
+	config.C.ShutdownPeriod = 1
+
+	js := NewJobScheduler(nil)
+	if err := js.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	trace := "id,prompt,timestamp\n"
+	for i := 0; i < 6; i++ {
+		trace += strconv.Itoa(i) + ",p," + strconv.Itoa(i*300) + "\n"
+	}
+	if err := js.SubmitJobs("hermetic", "hermetic.csv", "text/csv", strings.NewReader(trace), DefaultReplayOptions()); err != nil {
+		t.Fatalf("SubmitJobs failed: %v", err)
+	}
+	batch, _ := js.Batch("hermetic")
+	<-batch.doneChan
+	js.Stop()
+
+	if status := batch.Status(); status.State != BatchCompleted || status.Completed != 6 {
+		t.Fatalf("expected 6 completed jobs, got %+v", status)
+	}
+	// the autoscaler was asked once the first metrics window passed
+	if server.Requests(fakeserve.RouteCalc) == 0 || server.Target() != 2 {
+		t.Errorf("expected serve scaled to 2 replicas, got %d after %d autoscaler requests", server.Target(), server.Requests(fakeserve.RouteCalc))
+	}
+	if _, ok := server.Calcs()[0].Points[0]["predicted_work"]; !ok {
+		t.Errorf("expected the predicted work in the autoscaler request, got %+v", server.Calcs()[0])
+	}
+	data, err := os.ReadFile(filepath.Join(config.C.OutputFilePath, "hermetic-result.csv"))
+	if err != nil {
+		t.Fatalf("reading results failed: %v", err)
+	}
+	if rows := strings.Split(strings.TrimSpace(string(data)), "\n"); len(rows) != 7 {
+		t.Errorf("expected a header and 6 results, got %d rows", len(rows))
+	}
+}
+
+func TestSchedulerRunsBatchesConcurrently(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Latency = 20 * time.Millisecond
+	useFakeServe(t, options)
+	config.C.ShutdownPeriod = 1
+
+	js := NewJobScheduler(nil)
+	if err := js.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer js.Stop()
+	background := "id,prompt,timestamp\n"
+	for i := 0; i < 5; i++ {
+		background += strconv.Itoa(i) + ",p," + strconv.Itoa(i*200) + "\n"
+	}
+	burst := "id,prompt,timestamp\n1,a,0\n2,b,0\n3,c,0\n"
+	if err := js.SubmitJobs("background", "background.csv", "text/csv", strings.NewReader(background), DefaultReplayOptions()); err != nil {
+		t.Fatalf("SubmitJobs failed: %v", err)
+	}
+	if err := js.SubmitJobs("burst", "burst.csv", "text/csv", strings.NewReader(burst), DefaultReplayOptions()); err != nil {
+		t.Fatalf("expected a second batch to run alongside the first, got %v", err)
+	}
+	// an active batch keeps its name
+	if err := js.SubmitJobs("background", "background.csv", "text/csv", strings.NewReader(background), DefaultReplayOptions()); err == nil {
+		t.Fatal("expected a batch with the name of an active one rejected")
+	}
+	if batches := js.Batches(); len(batches) != 2 {
+		t.Fatalf("expected 2 batches, got %d", len(batches))
+	}
+
+	for name, size := range map[string]int{"background": 5, "burst": 3} {
+		batch, _ := js.Batch(name)
+		select {
+		case <-batch.doneChan:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for batch %s", name)
+		}
+		if status := batch.Status(); status.State != BatchCompleted || status.Completed != size {
+			t.Errorf("expected %d completed jobs in batch %s, got %+v", size, name, status)
+		}
+		// every batch writes its own results
+		data, err := os.ReadFile(filepath.Join(config.C.OutputFilePath, name+"-result.csv"))
+		if err != nil {
+			t.Fatalf("reading results of %s failed: %v", name, err)
+		}
+		if rows := strings.Split(strings.TrimSpace(string(data)), "\n"); len(rows) != size+1 {
+			t.Errorf("expected a header and %d results for batch %s, got %d rows", size, name, len(rows))
+		}
+	}
+}
+
+func TestSchedulerPausesAndResumesBatch(t *testing.T) {
+	useFakeServe(t, fakeserve.DefaultOptions())
+	config.C.ShutdownPeriod = 1
+
+	js := NewJobScheduler(nil)
+	if err := js.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer js.Stop()
+	trace := "id,prompt,timestamp\n1,a,0\n2,b,300\n3,c,600\n"
+	if err := js.SubmitJobs("pause", "pause.csv", "text/csv", strings.NewReader(trace), DefaultReplayOptions()); err != nil {
+		t.Fatalf("SubmitJobs failed: %v", err)
+	}
+	if err := js.PauseBatch("missing"); err != ErrBatchNotFound {
+		t.Fatalf("expected an unknown batch not found, got %v", err)
+	}
+	batch, _ := js.Batch("pause")
+	waitFor(t, "the first job", func() bool { return batch.dispatched.Load() == 1 })
+	if err := js.PauseBatch("pause"); err != nil {
+		t.Fatalf("PauseBatch failed: %v", err)
+	}
+	if err := js.PauseBatch("pause"); err != ErrBatchNotRunning {
+		t.Fatalf("expected a paused batch not paused again, got %v", err)
+	}
+
+	// the replay stops while paused and the pause does not count as replay time
+	time.Sleep(500 * time.Millisecond)
+	status := batch.Status()
+	if status.State != BatchPaused || status.Dispatched != 1 || status.Elapsed > 0.3 || status.ETA <= 0.3 {
+		t.Fatalf("expected the batch paused after the first job, got %+v", status)
+	}
+	if err := js.ResumeBatch("pause"); err != nil {
+		t.Fatalf("ResumeBatch failed: %v", err)
+	}
+	if err := js.ResumeBatch("pause"); err != ErrBatchNotPaused {
+		t.Fatalf("expected a running batch not resumed, got %v", err)
+	}
+	select {
+	case <-batch.doneChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the resumed batch")
+	}
+	if status := batch.Status(); status.State != BatchCompleted || status.Completed != 3 || status.Elapsed > 1 {
+		t.Fatalf("expected 3 completed jobs within the trace time, got %+v", status)
+	}
+	if err := js.CancelBatch("pause"); err != ErrBatchAlreadyEnded {
+		t.Fatalf("expected a completed batch not cancelled, got %v", err)
+	}
+}
+
+func TestSchedulerWritesAttempts(t *testing.T) {
+	server := useFakeServe(t, fakeserve.DefaultOptions())
+	config.C.MaxRetryCount = 2
+	config.C.RetryBaseDelay = 1
+	config.C.RetryBudget = 1
+	config.C.ShutdownPeriod = 1
+	server.Fail(fakeserve.RouteGenerate, http.StatusServiceUnavailable)
+
+	js := NewJobScheduler(nil)
+	if err := js.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	trace := "id,prompt,timestamp\n1,p,0\n2,p,100\n"
+	if err := js.SubmitJobs("attempts", "attempts.csv", "text/csv", strings.NewReader(trace), DefaultReplayOptions()); err != nil {
+		t.Fatalf("SubmitJobs failed: %v", err)
+	}
+	batch, _ := js.Batch("attempts")
+	<-batch.doneChan
+	js.Stop()
+
+	file, err := os.Open(filepath.Join(config.C.OutputFilePath, "attempts-attempts.csv"))
+	if err != nil {
+		t.Fatalf("opening attempts failed: %v", err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("reading attempts failed: %v", err)
+	}
+	// the first job failed once before it succeeded
+	if len(rows) != 4 || !slices.Equal(rows[0], attemptHeader) {
+		t.Fatalf("expected a header and 3 attempts, got %v", rows)
+	}
+	first := rows[1]
+	if first[0] != "1" || first[1] != "1" || first[2] != server.Host() || first[5] != "503" || first[6] != string(ErrorOverloaded) {
+		t.Errorf("unexpected failed attempt %v", first)
+	}
+	for _, row := range rows[2:] {
+		if row[5] != "200" || row[6] != "" || row[7] != "" {
+			t.Errorf("unexpected successful attempt %v", row)
+		}
+	}
+}
+
+func TestSchedulerCancelsQueuedJobsOnShutdown(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Latency = 200 * time.Millisecond
+	server := useFakeServe(t, options)
+	config.C.MaxInflightRequests = 1
+	config.C.ShutdownPeriod = 5
+
+	js := NewJobScheduler(nil)
+	if err := js.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	trace := "id,prompt,timestamp\n1,a,0\n2,b,0\n3,c,0\n4,d,0\n"
+	if err := js.SubmitJobs("shutdown", "shutdown.csv", "text/csv", strings.NewReader(trace), DefaultReplayOptions()); err != nil {
+		t.Fatalf("SubmitJobs failed: %v", err)
+	}
+	batch, _ := js.Batch("shutdown")
+	// one job runs while the others wait for the single slot
+	waitFor(t, "the first request", func() bool { return server.Requests(fakeserve.RouteGenerate) == 1 && batch.dispatched.Load() == 4 })
+	js.Stop()
+
+	if status := batch.Status(); status.Completed != 1 || status.Abandoned != 3 {
+		t.Fatalf("expected 1 completed and 3 abandoned jobs, got %+v", status)
+	}
+	file, err := os.Open(filepath.Join(config.C.OutputFilePath, "shutdown-result.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled := slices.Index(rows[0], "Cancelled")
+	count := 0
+	for _, row := range rows[1:] {
+		if row[cancelled] == "true" {
+			count++
+		}
+	}
+	if len(rows) != 5 || count != 3 {
+		t.Fatalf("expected a result for each of the 4 jobs, 3 cancelled, got %d rows with %d cancelled", len(rows)-1, count)
+	}
+}
+
+func TestSchedulerCancelWritesEveryJob(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Latency = time.Minute
+	server := useFakeServe(t, options)
+	config.C.MaxInflightRequests = 1
+
+	js := NewJobScheduler(nil)
+	if err := js.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(js.Stop)
+	trace := "id,prompt,timestamp\n1,a,0\n2,b,0\n3,c,0\n4,d,0\n5,e,60000\n"
+	if err := js.SubmitJobs("cancel", "cancel.csv", "text/csv", strings.NewReader(trace), DefaultReplayOptions()); err != nil {
+		t.Fatalf("SubmitJobs failed: %v", err)
+	}
+	batch, _ := js.Batch("cancel")
+	// one job is in flight and three are queued behind the single slot
+	waitFor(t, "the first request", func() bool { return server.Requests(fakeserve.RouteGenerate) == 1 && batch.dispatched.Load() == 4 })
+	if err := js.CancelBatch("cancel"); err != nil {
+		t.Fatalf("CancelBatch failed: %v", err)
+	}
+	select {
+	case <-batch.doneChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the results of the cancelled batch")
+	}
+
+	if status := batch.Status(); status.State != BatchCancelled || status.Dispatched != 4 || status.Abandoned != 4 {
+		t.Fatalf("expected the 4 dispatched jobs abandoned, got %+v", status)
+	}
+	file, err := os.Open(filepath.Join(config.C.OutputFilePath, "cancel-result.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled := slices.Index(rows[0], "Cancelled")
+	for _, row := range rows[1:] {
+		if row[cancelled] != "true" {
+			t.Errorf("expected job %s cancelled, got %v", row[0], row)
+		}
+	}
+	if len(rows) != 5 {
+		t.Fatalf("expected a result for each of the 4 dispatched jobs, got %d", len(rows)-1)
+	}
+}
+
+func TestSchedulerAbandonsJobsPastSLO(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Latency = time.Minute
+	useFakeServe(t, options)
+	config.C.JobSLO = 50
+	config.C.MaxRetryCount = 3
+	config.C.RetryBaseDelay = 1
+
+	js := NewJobScheduler(nil)
+	if err := js.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer js.Stop()
+	trace := "id,prompt,timestamp\n1,a,0\n2,b,100\n"
+	if err := js.SubmitJobs("slo", "slo.csv", "text/csv", strings.NewReader(trace), DefaultReplayOptions()); err != nil {
+		t.Fatalf("SubmitJobs failed: %v", err)
+	}
+	batch, _ := js.Batch("slo")
+	select {
+	case <-batch.doneChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the abandoned jobs")
+	}
+
+	// an abandoned job is not retried and does not count as failed
+	if status := batch.Status(); status.Abandoned != 2 || status.Failed != 0 || status.Retries != 0 {
+		t.Fatalf("expected 2 abandoned jobs, got %+v", status)
+	}
+	rows, err := csv.NewReader(strings.NewReader(readTestOutput(t, "slo-result.csv"))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandoned, cancelled := slices.Index(rows[0], "Abandoned"), slices.Index(rows[0], "Cancelled")
+	for _, row := range rows[1:] {
+		if row[abandoned] != "true" || row[cancelled] != "false" {
+			t.Errorf("expected job %s abandoned past its SLO, got %v", row[0], row)
+		}
+	}
+}
+
+func TestSchedulerRejectsUnknownActuator(t *testing.T) {
+	useFakeServe(t, fakeserve.DefaultOptions())
+	config.C.ScaleActuator = "ray-serve"
+
+	js := NewJobScheduler(nil)
+	if err := js.Start(); err == nil {
+		t.Fatal("Expected an unknown actuator to fail the start")
+	}
+	if js.actuator != nil || js.worker != nil {
+		t.Error("Expected nothing to be started")
+	}
+}
+
+func TestSchedulerRejectsUnknownPolicy(t *testing.T) {
+	useFakeServe(t, fakeserve.DefaultOptions())
+	config.C.ScalePolicy = "target-queue"
+
+	js := NewJobScheduler(nil)
+	if err := js.Start(); err == nil {
+		t.Fatal("Expected an unknown scale policy to fail the start")
+	}
+	if js.scaler != nil || js.worker != nil {
+		t.Error("Expected nothing to be started")
+	}
+}
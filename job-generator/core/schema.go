@@ -0,0 +1,232 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxSchemaIssues = 100
+
+type SchemaIssue struct {
+	Row    int    `json:"row"` // line of the file where the record starts
+	Column string `json:"column,omitempty"`
+	Value  string `json:"value,omitempty"`
+	Reason string `json:"reason"`
+}
+
+type SchemaError struct {
+	Issues []SchemaIssue // capped at maxSchemaIssues
+	Count  int
+}
+
+func (e *SchemaError) Error() string {
+	if len(e.Issues) == 0 {
+		return "invalid job trace"
+	}
+	first := e.Issues[0]
+	if first.Column == "" {
+		return fmt.Sprintf("invalid job trace: %d issue(s), first at row %d: %s", e.Count, first.Row, first.Reason)
+	}
+	return fmt.Sprintf("invalid job trace: %d issue(s), first at row %d column %s: %s", e.Count, first.Row, first.Column, first.Reason)
+}
+
+func (e *SchemaError) add(issues ...SchemaIssue) {
+	for _, issue := range issues {
+		e.Count++
+		if len(e.Issues) < maxSchemaIssues {
+			e.Issues = append(e.Issues, issue)
+		}
+	}
+}
+
+type column struct {
+	name         string
+	aliases      []string
+	required     bool
+	raw          bool // keep surrounding whitespace
+	defaultValue string
+	parse        func(value string, job *Job) error
+}
+
+// jobColumns maps trace columns onto a Job, a blank optional field takes its default value
+var jobColumns = []column{
+	{name: "id", required: true, parse: func(v string, job *Job) error {
+		if v == "" {
+			return fmt.Errorf("must not be empty")
+		}
+		job.Id = v
+		return nil
+	}},
+	{name: "prompt", required: true, raw: true, parse: func(v string, job *Job) error {
+		job.Param.Prompt = v
+		return nil
+	}},
+	{name: "step", aliases: []string{"steps"}, defaultValue: "20", parse: func(v string, job *Job) error {
+		return parsePositiveInt(v, &job.Param.Steps)
+	}},
+	{name: "cfg", aliases: []string{"cfg_scale", "scale"}, defaultValue: "7.0", parse: func(v string, job *Job) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			return fmt.Errorf("expected a positive number")
+		}
+		job.Param.Scale = f
+		return nil
+	}},
+	{name: "sampler", aliases: []string{"sampler_index"}, defaultValue: "8", parse: func(v string, job *Job) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			job.Param.SamplerIndex = v // sampler given by name
+			return nil
+		}
+		if i < 1 || i > 8 {
+			return fmt.Errorf("expected a sampler index between 1 and 8")
+		}
+		job.Param.SamplerIndex = convertToSamplerIndex(v)
+		return nil
+	}},
+	{name: "width", defaultValue: "512", parse: func(v string, job *Job) error {
+		return parsePositiveInt(v, &job.Param.Width)
+	}},
+	{name: "height", defaultValue: "512", parse: func(v string, job *Job) error {
+		return parsePositiveInt(v, &job.Param.Height)
+	}},
+	{name: "token_count", defaultValue: "0", parse: func(v string, job *Job) error {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			return fmt.Errorf("expected a non-negative integer")
+		}
+		job.TokenCount = i
+		return nil
+	}},
+	{name: "timestamp", required: true, parse: func(v string, job *Job) error {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || i < 0 {
+			return fmt.Errorf("expected a non-negative integer offset in milliseconds")
+		}
+		job.RequestTime = time.UnixMilli(i)
+		return nil
+	}},
+}
+
+// corpusColumns are used for seed corpora of synthetic workloads, which carry no request times
+var corpusColumns = func() []column {
+	columns := append([]column{}, jobColumns...)
+	for i := range columns {
+		if columns[i].name == "timestamp" {
+			columns[i].required = false
+			columns[i].defaultValue = "0"
+		}
+	}
+	return columns
+}()
+
+// jobSchema holds the position of every known column in a trace, -1 if absent
+type jobSchema struct {
+	columns []column
+	index   []int
+	fields  int
+}
+
+func newJobSchema(header []string, columns []column) (*jobSchema, *SchemaError) {
+	positions := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if _, ok := positions[name]; !ok {
+			positions[name] = i
+		}
+	}
+
+	schema := &jobSchema{columns: columns, index: make([]int, len(columns)), fields: len(header)}
+	schemaErr := &SchemaError{}
+	for i, col := range columns {
+		schema.index[i] = -1
+		for _, name := range append([]string{col.name}, col.aliases...) {
+			if pos, ok := positions[name]; ok {
+				schema.index[i] = pos
+				break
+			}
+		}
+		if schema.index[i] < 0 && col.required {
+			schemaErr.add(SchemaIssue{Row: 1, Column: col.name, Reason: "required column is missing"})
+		}
+	}
+	if schemaErr.Count > 0 {
+		return nil, schemaErr
+	}
+	return schema, nil
+}
+
+// parse builds a job from a record, row is the 1-based line number used in the reported issues
+func (s *jobSchema) parse(record []string, row int) (Job, []SchemaIssue) {
+	if len(record) != s.fields {
+		return Job{}, []SchemaIssue{{Row: row, Reason: fmt.Sprintf("expected %d fields, got %d", s.fields, len(record))}}
+	}
+
+	var (
+		job    Job
+		issues []SchemaIssue
+	)
+	for i, col := range s.columns {
+		value := col.defaultValue
+		if s.index[i] >= 0 {
+			v := record[s.index[i]]
+			if !col.raw {
+				v = strings.TrimSpace(v)
+			}
+			if v != "" || col.required {
+				value = v
+			}
+		}
+		if err := col.parse(value, &job); err != nil {
+			issues = append(issues, SchemaIssue{Row: row, Column: col.name, Value: value, Reason: err.Error()})
+		}
+	}
+	return job, issues
+}
+
+func parsePositiveInt(value string, target *int) error {
+	i, err := strconv.Atoi(value)
+	if err != nil || i <= 0 {
+		return fmt.Errorf("expected a positive integer")
+	}
+	*target = i
+	return nil
+}
+
+// canonicalHeader lists the column names in the order expected by canonicalRecord
+func canonicalHeader(columns []column) []string {
+	header := make([]string, len(columns))
+	for i, col := range columns {
+		header[i] = col.name
+	}
+	return header
+}
+
+// canonicalRecord lays out the fields of a keyed row, such as a JSON object, in canonical column order
+func canonicalRecord(columns []column, fields map[string]string, row int) ([]string, []SchemaIssue) {
+	normalized := make(map[string]string, len(fields))
+	for key, value := range fields {
+		normalized[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+
+	var (
+		record = make([]string, len(columns))
+		issues []SchemaIssue
+	)
+	for i, col := range columns {
+		found := false
+		for _, name := range append([]string{col.name}, col.aliases...) {
+			if value, ok := normalized[name]; ok {
+				record[i] = value
+				found = true
+				break
+			}
+		}
+		if !found && col.required {
+			issues = append(issues, SchemaIssue{Row: row, Column: col.name, Reason: "required field is missing"})
+		}
+	}
+	return record, issues
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"cmp"
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// samples a sampler needs before its own fit is trusted over the fit of every sampler
+const minServiceTimeSamples = 5
+
+// ServiceTimeModel learns online how long the served deployment takes for a request. Per sampler it
+// fits a least squares line of the duration over the work of a request, its steps times its pixels
+// in 512x512 images, from the completed jobs
+type ServiceTimeModel struct {
+	mu       *sync.Mutex
+	samplers map[string]*serviceTimeFit
+	all      *serviceTimeFit
+}
+
+// jobShape is a request configuration, jobs of the same shape have the same predicted duration
+type jobShape struct {
+	sampler string
+	steps   int
+	width   int
+	height  int
+}
+
+func shapeOf(param api.GenerateRequestParam) jobShape {
+	return jobShape{sampler: param.SamplerIndex, steps: param.Steps, width: param.Width, height: param.Height}
+}
+
+func (s jobShape) work() float64 {
+	pixels := float64(s.width*s.height) / (512 * 512)
+	if pixels <= 0 {
+		pixels = 1
+	}
+	return float64(s.steps) * pixels
+}
+
+func NewServiceTimeModel() *ServiceTimeModel {
+	return &ServiceTimeModel{
+		mu:       &sync.Mutex{},
+		samplers: map[string]*serviceTimeFit{},
+		all:      &serviceTimeFit{},
+	}
+}
+
+// Observe learns from a completed request and the generation time the server reported for it
+func (m *ServiceTimeModel) Observe(param api.GenerateRequestParam, duration time.Duration) {
+	if duration <= 0 {
+		return
+	}
+	shape := shapeOf(param)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fit, ok := m.samplers[shape.sampler]
+	if !ok {
+		fit = &serviceTimeFit{}
+		m.samplers[shape.sampler] = fit
+	}
+	fit.add(shape.work(), duration.Seconds())
+	m.all.add(shape.work(), duration.Seconds())
+}
+
+// Predict returns the expected generation time of a request, 0 until a request completed
+func (m *ServiceTimeModel) Predict(param api.GenerateRequestParam) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return time.Duration(m.predict(shapeOf(param)) * float64(time.Second))
+}
+
+func (m *ServiceTimeModel) predict(shape jobShape) float64 {
+	if fit, ok := m.samplers[shape.sampler]; ok && fit.n >= minServiceTimeSamples {
+		return fit.predict(shape.work())
+	}
+	return m.all.predict(shape.work())
+}
+
+// Work is the predicted work of a count of requests per shape in GPU seconds, summed in the order of
+// the shapes so the same queue always gives the same work
+func (m *ServiceTimeModel) Work(shapes map[jobShape]int) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	work := 0.0
+	for _, shape := range slices.SortedFunc(maps.Keys(shapes), compareShapes) {
+		work += m.predict(shape) * float64(shapes[shape])
+	}
+	return work
+}
+
+func compareShapes(a, b jobShape) int {
+	return cmp.Or(
+		strings.Compare(a.sampler, b.sampler),
+		cmp.Compare(a.steps, b.steps),
+		cmp.Compare(a.width, b.width),
+		cmp.Compare(a.height, b.height),
+	)
+}
+
+// serviceTimeFit keeps the sums of a simple linear regression so it is updated in constant time
+type serviceTimeFit struct {
+	n, sumX, sumY, sumXX, sumXY float64
+}
+
+func (f *serviceTimeFit) add(x, y float64) {
+	f.n++
+	f.sumX += x
+	f.sumY += y
+	f.sumXX += x * x
+	f.sumXY += x * y
+}
+
+// predict returns the duration of work x in seconds
+func (f *serviceTimeFit) predict(x float64) float64 {
+	if f.n == 0 {
+		return 0
+	}
+	meanX, meanY := f.sumX/f.n, f.sumY/f.n
+	varX := f.sumXX/f.n - meanX*meanX
+	if varX <= 1e-9*max(meanX*meanX, 1) {
+		// every sample had the same work, so scale the mean duration with the work
+		if meanX > 0 {
+			return meanY * x / meanX
+		}
+		return meanY
+	}
+	slope := (f.sumXY/f.n - meanX*meanY) / varX
+	return max(meanY+slope*(x-meanX), 0)
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestServiceTimeModel(t *testing.T) {
+	m := NewServiceTimeModel()
+	if m.Predict(api.GenerateRequestParam{SamplerIndex: "Euler", Steps: 20, Width: 512, Height: 512}) != 0 {
+		t.Fatal("expected no prediction before a job completed")
+	}
+
+	// Euler takes 0.5s plus 0.05s per step of a 512x512 image, DDIM twice as long per step
+	for steps := 10; steps <= 50; steps += 10 {
+		for _, size := range []int{512, 1024} {
+			work := float64(steps*size*size) / (512 * 512)
+			m.Observe(api.GenerateRequestParam{SamplerIndex: "Euler", Steps: steps, Width: size, Height: size}, time.Duration((0.5+0.05*work)*float64(time.Second)))
+			m.Observe(api.GenerateRequestParam{SamplerIndex: "DDIM", Steps: steps, Width: size, Height: size}, time.Duration((0.5+0.1*work)*float64(time.Second)))
+		}
+	}
+	assertSeconds := func(param api.GenerateRequestParam, want float64) {
+		t.Helper()
+		if got := m.Predict(param).Seconds(); math.Abs(got-want) > 0.01 {
+			t.Errorf("expected %+v to take %.2fs, got %.2fs", param, want, got)
+		}
+	}
+	assertSeconds(api.GenerateRequestParam{SamplerIndex: "Euler", Steps: 25, Width: 768, Height: 512}, 0.5+0.05*25*1.5)
+	assertSeconds(api.GenerateRequestParam{SamplerIndex: "DDIM", Steps: 25, Width: 512, Height: 512}, 0.5+0.1*25)
+	// a sampler never seen uses the fit of every sampler
+	assertSeconds(api.GenerateRequestParam{SamplerIndex: "LMS", Steps: 20, Width: 512, Height: 512}, 0.5+0.075*20)
+
+	euler := api.GenerateRequestParam{SamplerIndex: "Euler", Steps: 30, Width: 512, Height: 512}
+	ddim := api.GenerateRequestParam{SamplerIndex: "DDIM", Steps: 10, Width: 1024, Height: 1024}
+	shapes := map[jobShape]int{shapeOf(euler): 2, shapeOf(ddim): 1}
+	if got, want := m.Work(shapes), 2*(0.5+0.05*30)+(0.5+0.1*40); math.Abs(got-want) > 0.01 {
+		t.Errorf("expected %.2f GPU seconds pending, got %.2f", want, got)
+	}
+}
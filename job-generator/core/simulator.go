@@ -0,0 +1,670 @@
+package core
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"github.com/paopaoyue/kscale/job-genrator/config"
+	"github.com/paopaoyue/kscale/job-genrator/metrics"
+	"github.com/paopaoyue/kscale/job-genrator/util"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const ActuatorSimulation = "simulation"
+
+// SimOptions model the served deployment in an offline simulation
+type SimOptions struct {
+	Concurrency int     `json:"concurrency"`  // requests a replica serves at once
+	ColdStart   float64 `json:"cold_start"`   // in seconds, before a new replica serves
+	BaseTime    float64 `json:"base_time"`    // in seconds, of every request
+	StepTime    float64 `json:"step_time"`    // in seconds, of every step of a 512x512 image, scaled by the pixels
+	Jitter      float64 `json:"jitter"`       // standard deviation of the service time as a fraction of it
+	FailureRate float64 `json:"failure_rate"` // of the requests a replica answers with a 503 right away
+	Seed        uint64  `json:"seed"`
+	MaxTime     float64 `json:"max_time"` // in seconds of virtual time, the jobs not finished by then are cancelled
+}
+
+func DefaultSimOptions() SimOptions {
+	return SimOptions{
+		Concurrency: 1,
+		ColdStart:   30,
+		BaseTime:    0.5,
+		StepTime:    0.08,
+		Seed:        1,
+		MaxTime:     24 * 3600,
+	}
+}
+
+func (o SimOptions) Validate() error {
+	if o.Concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+	if o.ColdStart < 0 || o.BaseTime < 0 || o.StepTime < 0 || o.Jitter < 0 {
+		return errors.New("times and jitter must not be negative")
+	}
+	if o.BaseTime == 0 && o.StepTime == 0 {
+		return errors.New("base time or step time must be positive")
+	}
+	if o.FailureRate < 0 || o.FailureRate >= 1 {
+		return errors.New("failure rate must be in [0, 1)")
+	}
+	if o.MaxTime <= 0 {
+		return errors.New("max time must be positive")
+	}
+	return nil
+}
+
+// serviceTime models how long a replica takes for a job, linear in the steps and the pixels
+func (o SimOptions) serviceTime(param api.GenerateRequestParam, rng *rand.Rand) time.Duration {
+	pixels := float64(param.Width*param.Height) / (512 * 512)
+	if pixels <= 0 {
+		pixels = 1
+	}
+	seconds := o.BaseTime + o.StepTime*float64(param.Steps)*pixels
+	if o.Jitter > 0 {
+		seconds *= math.Max(1+o.Jitter*rng.NormFloat64(), 0.1)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// simEpoch is where the virtual time of every simulation starts, so two runs of a trace write the same
+// timestamps and the policies see the same time of day
+var simEpoch = time.Unix(0, 0).UTC()
+
+// Simulation replays a trace as a batch of its own against a simulated pool of replicas in virtual time.
+// The batch, the worker and the scaler are the ones real batches run on, with their worker slots, endpoint
+// limits, deadlines, retries, observations and decisions, but instead of running their loops the simulation
+// runs their steps as the events of a SimClock: arrivals, answers of the pool, deadlines, backoffs, cold
+// starts, reports and metrics windows. Virtual time jumps from one event to the next, so the same trace and
+// options always give the same results. Decisions take no virtual time, the pool is the actuator of the
+// scaler, and nothing of the simulation reaches the served deployment or the metrics
+type Simulation struct {
+	Name    string
+	options SimOptions
+	clock   *SimClock
+
+	pool   *simPool
+	scaler *Scaler
+	worker *JobWorker
+	batch  *JobBatch
+
+	// only touched by the events, which run one after the other
+	next      Job // the next job of the trace, dispatched once its replay offset has come
+	hasNext   bool
+	queueSize int
+	full      bool                 // the next job waits for room in the queue
+	fresh     []Job                // the dispatched jobs waiting for a worker slot
+	retries   []simRetry           // the retries waiting for room in the retry queue
+	waiting   []*simRequest        // the attempts holding a worker slot while every endpoint is at its limit
+	requests  map[*simRequest]bool // the attempts not answered yet
+	seq       int
+
+	dispatchFile *os.File
+	resultFile   *os.File
+	attemptFile  *os.File
+	metricsFile  *os.File
+}
+
+// simRequest is an attempt of a job in a simulation, from taking a worker slot until it is answered
+type simRequest struct {
+	seq      int
+	job      Job
+	ctx      context.Context // ends with the cause the attempt was aborted for
+	cancel   context.CancelCauseFunc
+	attempt  Attempt
+	endpoint *util.Endpoint // nil until the attempt is sent
+	replica  *simReplica    // nil until a replica serves the attempt
+	deadline Timer          // aborts the attempt at the deadline of its job
+	reply    Timer          // of the replica serving the attempt
+}
+
+// simRetry is a retry blocked on the full retry queue
+type simRetry struct {
+	job   Job
+	delay time.Duration
+}
+
+func NewSimulation(manifest RunManifest, iter JobSource, client *api.Client, options SimOptions) (*Simulation, error) {
+	clock := NewSimClock(simEpoch)
+	pool := newSimPool(options, clock)
+	scaler, err := NewScaler(client, pool, clock)
+	if err != nil {
+		return nil, err
+	}
+	quiet := metrics.NewDummyClient()
+	scaler.metrics, scaler.datadog = quiet, quiet
+
+	// the simulation queues the jobs and sends the attempts to the pool itself
+	batch := NewJobBatch(manifest, iter, scaler, nil)
+	// every endpoint leads to the pool, so the load balancing and the limits per endpoint still apply
+	endpoints := util.NewEndpoints(config.C.APIEndpoint)
+	if len(endpoints) == 0 {
+		endpoints = util.NewEndpoints(ActuatorSimulation + ":8000")
+	}
+	group := util.NewEndpointGroup(endpoints, config.C.LoadBalancePolicy, config.C.MaxInflightPerEndpoint)
+	worker := NewJobWorker(nil, group, nil, nil, clock)
+	worker.metrics, worker.datadog = quiet, quiet
+
+	sim := &Simulation{
+		Name:      manifest.Batch,
+		options:   options,
+		clock:     clock,
+		pool:      pool,
+		scaler:    scaler,
+		worker:    worker,
+		batch:     batch,
+		queueSize: max(config.C.MaxQueueSize, 1),
+		requests:  map[*simRequest]bool{},
+	}
+	pool.answer = sim.answer
+	worker.output = sim.write
+	return sim, nil
+}
+
+// Start runs the simulation in the background, it is followed like any batch
+func (sim *Simulation) Start() {
+	b := sim.batch
+	b.begin()
+	b.scope = sim.scaler.attachScope(b.Name, b.StartTime)
+	sim.dispatchFile = OpenCSVAndWriteHeader(filepath.Join(config.C.OutputFilePath, b.Name+"-dispatch.csv"), dispatchHeader)
+	sim.resultFile = OpenCSVAndWriteHeader(filepath.Join(config.C.OutputFilePath, b.Name+"-result.csv"), resultHeader)
+	sim.attemptFile = OpenCSVAndWriteHeader(filepath.Join(config.C.OutputFilePath, b.Name+"-attempts.csv"), attemptHeader)
+	sim.metricsFile = OpenCSVAndWriteHeader(filepath.Join(config.C.OutputFilePath, b.Name+"-metrics.csv"), metricsHeader)
+
+	sim.next, sim.hasNext = b.iter.Next()
+	sim.clock.AfterFunc(0, sim.dispatch)
+	sim.every(sim.scaler.stepInterval, sim.observe)
+	sim.every(sim.scaler.reportInterval, sim.scaler.report)
+	sim.clock.AfterFunc(time.Duration(sim.options.MaxTime*float64(time.Second)), func() {
+		if b.Cancel() == nil {
+			slog.Warn("Simulation reached its max time, the jobs left are cancelled", "Name", sim.Name, "MaxTime", sim.options.MaxTime)
+		}
+	})
+	go sim.run()
+}
+
+// run handles the events until the batch completes or stops, it waits while the batch is paused
+func (sim *Simulation) run() {
+	b := sim.batch
+	wallStart := time.Now()
+	for b.waitResume() && b.Active() && sim.clock.Next() {
+		sim.pump()
+		if !sim.hasNext && b.finished() == b.dispatched.Load() && b.finish(BatchCompleted) {
+			slog.Info("Job batch completed", "Name", b.Name, "Size", b.Size, "Duration", sim.clock.Now().Sub(b.StartTime))
+		}
+	}
+	sim.cancelLeft()
+
+	b.iter.Close()
+	for _, file := range []*os.File{sim.dispatchFile, sim.resultFile, sim.attemptFile, sim.metricsFile} {
+		file.Close()
+	}
+	close(b.dispatchChan)
+	close(b.doneChan)
+	status := b.Status()
+	slog.Info("Simulation completed", "Name", sim.Name, "State", status.State, "Completed", status.Completed,
+		"VirtualTime", time.Duration(status.Elapsed*float64(time.Second)), "WallTime", time.Since(wallStart))
+}
+
+// every runs f every d of virtual time
+func (sim *Simulation) every(d time.Duration, f func()) {
+	var tick func()
+	tick = func() {
+		f()
+		sim.clock.AfterFunc(d, tick)
+	}
+	sim.clock.AfterFunc(d, tick)
+}
+
+// observe ends a metrics window, the batch writes its observation and the scaler observes and decides
+func (sim *Simulation) observe() {
+	AppendCSV(sim.metricsFile, metricsRow(sim.batch.scope.step()))
+	s := sim.scaler
+	s.step()
+	select {
+	case d := <-s.decisionChan:
+		s.decide(d)
+	default:
+	}
+}
+
+// dispatch sends the jobs of the trace whose replay offset has come, as the dispatch of a batch does, and
+// schedules itself for the next one
+func (sim *Simulation) dispatch() {
+	b := sim.batch
+	for sim.hasNext {
+		now := sim.clock.Now()
+		b.mu.Lock()
+		elapsed := b.elapsed(now)
+		b.mu.Unlock()
+		jobTime := sim.next.RequestTime.Sub(time.UnixMilli(0))
+		if elapsed < jobTime {
+			sim.clock.AfterFunc(jobTime-elapsed, sim.dispatch)
+			return
+		}
+		if len(sim.fresh) >= sim.queueSize {
+			sim.full = true // dispatched again once a job leaves the queue
+			return
+		}
+		job := sim.next
+		b.prepare(&job, jobTime, now)
+		sim.fresh = append(sim.fresh, job)
+		b.dispatched.Add(1)
+		b.recordDispatch(sim.dispatchFile, job.Id, jobTime, elapsed)
+		sim.next, sim.hasNext = b.iter.Next()
+	}
+	if err := b.iter.Err(); err != nil {
+		slog.Error("Job batch trace ended early", "Name", b.Name, "Dispatched", b.dispatched.Load(), "err", err)
+	}
+}
+
+// pump hands the endpoints freed meanwhile to the attempts waiting for one, then the queued jobs to the
+// free worker slots, fresh jobs before retries as the worker does
+func (sim *Simulation) pump() {
+	jw := sim.worker
+	for len(sim.waiting) > 0 && sim.send(sim.waiting[0]) {
+		sim.waiting = sim.waiting[1:]
+	}
+	for tryAcquireSlot(jw.slots) {
+		job, ok := sim.nextJob()
+		if !ok {
+			releaseSlot(jw.slots)
+			break
+		}
+		sim.attempt(job)
+	}
+	if sim.full && len(sim.fresh) < sim.queueSize {
+		sim.full = false
+		sim.dispatch()
+	}
+}
+
+func (sim *Simulation) nextJob() (Job, bool) {
+	if len(sim.fresh) > 0 {
+		job := sim.fresh[0]
+		sim.fresh = sim.fresh[1:]
+		return job, true
+	}
+	job, ok := sim.worker.retryQueue.pop()
+	if ok && len(sim.retries) > 0 {
+		// the first retry blocked on the full queue takes the room
+		retry := sim.retries[0]
+		sim.retries = sim.retries[1:]
+		sim.queueRetry(retry.job, retry.delay)
+	}
+	return job, ok
+}
+
+// attempt starts an attempt of a job holding a worker slot, as processJob does
+func (sim *Simulation) attempt(job Job) {
+	jw := sim.worker
+	if !jw.begin(&job) {
+		releaseSlot(jw.slots)
+		return
+	}
+	sim.seq++
+	r := &simRequest{seq: sim.seq, job: job}
+	r.ctx, r.cancel = context.WithCancelCause(context.Background())
+	if !job.Deadline.IsZero() {
+		r.deadline = sim.clock.AfterFunc(job.Deadline.Sub(sim.clock.Now()), func() {
+			sim.abort(r, context.DeadlineExceeded)
+		})
+	}
+	sim.requests[r] = true
+	if len(sim.waiting) > 0 || !sim.send(r) {
+		sim.waiting = append(sim.waiting, r)
+	}
+}
+
+// send takes an endpoint for the attempt and hands the attempt to the pool, it returns false while every
+// endpoint is at its limit
+func (sim *Simulation) send(r *simRequest) bool {
+	endpoint, ok, err := sim.worker.Endpoints.TryAcquire(r.job.batch.rand)
+	if err != nil {
+		sim.answer(r, 0, err)
+		return true
+	}
+	if !ok {
+		return false
+	}
+	r.endpoint = &endpoint
+	r.attempt = sim.worker.startAttempt(endpoint)
+	sim.pool.serve(r)
+	return true
+}
+
+// answer ends the attempt with the answer of the pool, or the error it ended with, as processJob does
+func (sim *Simulation) answer(r *simRequest, duration time.Duration, err error) {
+	jw := sim.worker
+	delete(sim.requests, r)
+	if r.deadline != nil {
+		r.deadline.Stop()
+	}
+	attempt := r.attempt
+	if r.endpoint != nil {
+		jw.endAttempt(*r.endpoint, &attempt, duration, err)
+	} else {
+		now := sim.clock.Now()
+		attempt = Attempt{StartTime: now, EndTime: now}
+	}
+	retry := jw.complete(r.ctx, &r.job, attempt, err)
+	r.cancel(context.Canceled)
+	releaseSlot(jw.slots)
+	if retry {
+		sim.retry(r.job)
+	}
+}
+
+// abort ends an attempt before the pool answered it, at the deadline of its job or once the batch stopped
+func (sim *Simulation) abort(r *simRequest, cause error) {
+	r.cancel(cause)
+	if r.endpoint == nil {
+		sim.waiting = slices.DeleteFunc(sim.waiting, func(w *simRequest) bool { return w == r })
+		sim.answer(r, 0, util.ErrNoEndpoint) // as Acquire fails once the context is done
+		return
+	}
+	sim.pool.abort(r)
+	sim.answer(r, 0, r.ctx.Err())
+}
+
+// retry queues the job for another attempt as retryJob does, with the block overflow a retry waits for
+// room in the full queue
+func (sim *Simulation) retry(job Job) {
+	jw := sim.worker
+	delay, ok := jw.backoff(&job)
+	if !ok {
+		return
+	}
+	switch {
+	case sim.queueRetry(job, delay):
+	case jw.retryQueue.overflow == OverflowBlock:
+		sim.retries = append(sim.retries, simRetry{job: job, delay: delay})
+	default:
+		jw.overflowRetry(job)
+	}
+}
+
+// queueRetry pushes the job into the retry queue and wakes the pump once its backoff passed
+func (sim *Simulation) queueRetry(job Job, delay time.Duration) bool {
+	if !sim.worker.retryQueue.tryPush(job, delay) {
+		return false
+	}
+	sim.worker.countRetry()
+	sim.clock.AfterFunc(delay, sim.pump)
+	return true
+}
+
+func (sim *Simulation) write(job Job) {
+	sim.batch.writeOutput(sim.resultFile, sim.attemptFile, job)
+}
+
+// cancelLeft writes every job left once the batch stopped as cancelled: the attempts in flight are aborted,
+// the queued jobs and retries cancelled and the jobs not dispatched yet written as never sent, so the
+// results cover the whole trace
+func (sim *Simulation) cancelLeft() {
+	jw := sim.worker
+	requests := slices.SortedFunc(maps.Keys(sim.requests), func(a, b *simRequest) int { return a.seq - b.seq })
+	for _, r := range requests {
+		sim.abort(r, context.Canceled)
+	}
+	for _, job := range sim.fresh {
+		jw.cancelJob(&job)
+	}
+	sim.fresh = nil
+	for _, job := range jw.retryQueue.drain() {
+		jw.cancelJob(&job)
+	}
+	for _, retry := range sim.retries {
+		jw.cancelJob(&retry.job)
+	}
+	sim.retries = nil
+
+	b := sim.batch
+	now := sim.clock.Now()
+	count := 0
+	for ; sim.hasNext; sim.next, sim.hasNext = b.iter.Next() {
+		job := sim.next
+		job.batch = b
+		job.ReplayOffset = job.RequestTime.Sub(time.UnixMilli(0))
+		job.RequestTime, job.EndTime = now, now
+		job.Abandoned, job.Cancelled = true, true
+		sim.write(job)
+		count++
+	}
+	if count > 0 {
+		slog.Warn("Cancelled the jobs not dispatched yet", "Name", b.Name, "count", count)
+	}
+}
+
+// simPool is a simulated pool of replicas, it serves the attempts of a simulation as the served deployment
+// does and scales as the actuator of the scaler. Attempts wait in arrival order for a free slot of a ready
+// replica, the least busy one, and a new replica serves once its cold start passed
+type simPool struct {
+	options SimOptions
+	clock   *SimClock
+	rng     *rand.Rand
+	answer  func(r *simRequest, duration time.Duration, err error)
+
+	replicas []*simReplica
+	nextID   int
+	waiting  []*simRequest
+}
+
+type simReplica struct {
+	id        int
+	ready     bool
+	busy      int
+	draining  bool  // removed once its requests finish
+	coldStart Timer // makes it ready
+}
+
+func newSimPool(options SimOptions, clock *SimClock) *simPool {
+	p := &simPool{
+		options: options,
+		clock:   clock,
+		rng:     rand.New(rand.NewPCG(options.Seed, options.Seed)),
+	}
+	for i := 0; i < config.C.InitWorkerCount; i++ {
+		p.add().ready = true
+	}
+	return p
+}
+
+func (p *simPool) Name() string { return ActuatorSimulation }
+
+// serve starts the attempt on a replica, or queues it behind the attempts before it
+func (p *simPool) serve(r *simRequest) {
+	if replica := p.free(); replica != nil && len(p.waiting) == 0 {
+		p.start(r, replica)
+		return
+	}
+	p.waiting = append(p.waiting, r)
+}
+
+// start serves the attempt on the replica, which answers once the service time passed, or right away
+// with a failure
+func (p *simPool) start(r *simRequest, replica *simReplica) {
+	replica.busy++
+	r.replica = replica
+	failed := p.options.FailureRate > 0 && p.rng.Float64() < p.options.FailureRate
+	duration := p.options.serviceTime(r.job.Param, p.rng)
+	if failed {
+		r.reply = p.clock.AfterFunc(0, func() {
+			p.release(replica)
+			p.answer(r, 0, &api.StatusError{StatusCode: http.StatusServiceUnavailable, Body: "simulated failure"})
+		})
+		return
+	}
+	r.reply = p.clock.AfterFunc(duration, func() {
+		p.release(replica)
+		p.answer(r, duration, nil)
+	})
+}
+
+// abort drops an attempt the worker gave up on, freeing its slot
+func (p *simPool) abort(r *simRequest) {
+	if r.replica == nil {
+		p.waiting = slices.DeleteFunc(p.waiting, func(w *simRequest) bool { return w == r })
+		return
+	}
+	r.reply.Stop()
+	p.release(r.replica)
+}
+
+func (p *simPool) release(replica *simReplica) {
+	replica.busy--
+	if replica.draining && replica.busy == 0 {
+		p.remove(replica)
+	}
+	p.assign()
+}
+
+// assign hands the free slots to the waiting attempts
+func (p *simPool) assign() {
+	for len(p.waiting) > 0 {
+		replica := p.free()
+		if replica == nil {
+			return
+		}
+		r := p.waiting[0]
+		p.waiting = p.waiting[1:]
+		p.start(r, replica)
+	}
+}
+
+// free is the least busy replica with room
+func (p *simPool) free() *simReplica {
+	var replica *simReplica
+	for _, r := range p.replicas {
+		if r.ready && !r.draining && r.busy < p.options.Concurrency && (replica == nil || r.busy < replica.busy) {
+			replica = r
+		}
+	}
+	return replica
+}
+
+func (p *simPool) add() *simReplica {
+	p.nextID++
+	replica := &simReplica{id: p.nextID}
+	p.replicas = append(p.replicas, replica)
+	return replica
+}
+
+func (p *simPool) remove(replica *simReplica) {
+	if replica.coldStart != nil {
+		replica.coldStart.Stop()
+	}
+	p.replicas = slices.DeleteFunc(p.replicas, func(r *simReplica) bool { return r == replica })
+}
+
+// Scale adds replicas, reusing draining ones before cold starting new ones, or removes them, starting
+// ones first, then idle ones, and drains busy ones
+func (p *simPool) Scale(ctx context.Context, replicas int) error {
+	active := []*simReplica{}
+	draining := []*simReplica{}
+	for _, r := range p.replicas {
+		if r.draining {
+			draining = append(draining, r)
+		} else {
+			active = append(active, r)
+		}
+	}
+
+	for n := len(active); n < replicas; n++ {
+		if len(draining) > 0 {
+			draining[0].draining = false
+			draining = draining[1:]
+			continue
+		}
+		replica := p.add()
+		replica.coldStart = p.clock.AfterFunc(time.Duration(p.options.ColdStart*float64(time.Second)), func() {
+			replica.ready = true
+			p.assign()
+		})
+	}
+
+	for n := len(active); n > replicas; n-- {
+		var victim *simReplica
+		for _, r := range p.replicas {
+			if r.draining {
+				continue
+			}
+			if victim == nil || removeBefore(r, victim) {
+				victim = r
+			}
+		}
+		if victim.busy > 0 {
+			victim.draining = true
+		} else {
+			p.remove(victim)
+		}
+	}
+	p.assign()
+	return nil
+}
+
+func removeBefore(a, b *simReplica) bool {
+	if a.ready != b.ready {
+		return !a.ready
+	}
+	if a.busy != b.busy {
+		return a.busy < b.busy
+	}
+	return a.id > b.id
+}
+
+func (p *simPool) Replicas(ctx context.Context) (int, int, error) {
+	running := 0
+	for _, r := range p.replicas {
+		if r.ready && !r.draining {
+			running++
+		}
+	}
+	return running, len(p.replicas), nil
+}
+
+// Simulate replays an uploaded trace against a simulated pool as a batch of its own, which is listed,
+// paused and cancelled like the others and writes the same files. It returns once the simulation started
+func (js *JobScheduler) Simulate(name, filename, contentType string, file io.Reader, options ReplayOptions, simOptions SimOptions) error {
+	if err := simOptions.Validate(); err != nil {
+		return err
+	}
+	if err := js.checkSubmit(name, options); err != nil {
+		return err
+	}
+	source, err := OpenJobSource(filename, contentType, file)
+	if err != nil {
+		return err
+	}
+	// the seed of the pool also seeds the batch unless the replay options set one
+	manifest := RunManifest{Batch: name, Source: filename, Seed: cmp.Or(options.Seed, simOptions.Seed), Options: options, Simulation: &simOptions}
+	iter, err := js.replay(&manifest, source)
+	if err != nil {
+		return err
+	}
+	// the remote policy needs a client even if the scheduler never started
+	client := js.client
+	if client == nil {
+		client = api.NewClientFromConfig()
+	}
+	sim, err := NewSimulation(manifest, iter, client, simOptions)
+	if err != nil {
+		iter.Close()
+		return err
+	}
+	if err := js.register(sim.batch, sim.Start); err != nil {
+		return err
+	}
+	slog.Info("Simulation started", "Name", name, "Size", manifest.Size)
+	return nil
+}
@@ -0,0 +1,383 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/paopaoyue/kscale/job-genrator/api/fakeserve"
+	"github.com/paopaoyue/kscale/job-genrator/config"
+	"github.com/paopaoyue/kscale/job-genrator/util"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSimConfig loads a config for simulations writing to a temporary directory
+func useSimConfig(t *testing.T) {
+	t.Helper()
+	useDummyMetrics()
+	saved := config.C
+	t.Cleanup(func() { config.C = saved })
+	config.C.OutputFilePath = t.TempDir()
+	config.C.EnableAutoScaling = false
+	config.C.MetricsWindow = 10
+	config.C.ForecastWindow = 3
+	config.C.InitWorkerCount = 1
+	config.C.JobSLO = 0
+	config.C.ScalePolicy = PolicyTargetQueue
+	config.C.TargetJobsPerWorker = 1
+	config.C.FallbackPolicy = ""
+}
+
+// newTestSimulation builds a simulation of the trace without starting it
+func newTestSimulation(t *testing.T, trace string, options SimOptions) *Simulation {
+	t.Helper()
+	useSimConfig(t)
+	source, err := ReadJobCSV(strings.NewReader(trace))
+	if err != nil {
+		t.Fatalf("ReadJobCSV failed: %v", err)
+	}
+	rs, err := newReplaySource(source, DefaultReplayOptions())
+	if err != nil {
+		t.Fatalf("newReplaySource failed: %v", err)
+	}
+	sim, err := NewSimulation(RunManifest{Batch: "sim"}, rs, nil, options)
+	if err != nil {
+		t.Fatalf("NewSimulation failed: %v", err)
+	}
+	return sim
+}
+
+// runTestSimulation runs the simulation to its end and returns its results by job id
+func runTestSimulation(t *testing.T, sim *Simulation) map[string][]string {
+	t.Helper()
+	sim.Start()
+	select {
+	case <-sim.batch.doneChan:
+	case <-time.After(30 * time.Second):
+		t.Fatal("simulation did not finish")
+	}
+
+	rows, err := csv.NewReader(strings.NewReader(readTestOutput(t, "sim-result.csv"))).ReadAll()
+	if err != nil {
+		t.Fatalf("reading results failed: %v", err)
+	}
+	results := map[string][]string{}
+	for _, row := range rows[1:] {
+		results[row[0]] = row
+	}
+	return results
+}
+
+func readTestOutput(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(config.C.OutputFilePath, name))
+	if err != nil {
+		t.Fatalf("reading %s failed: %v", name, err)
+	}
+	return string(data)
+}
+
+// assertMillis checks a result column in milliseconds
+func assertMillis(t *testing.T, row []string, column int, want int64) {
+	t.Helper()
+	if got, err := strconv.ParseInt(row[column], 10, 64); err != nil || got != want {
+		t.Errorf("expected %dms in column %d of job %s, got %s", want, column, row[0], row[column])
+	}
+}
+
+func TestSimulationServesTrace(t *testing.T) {
+	trace := "id,prompt,timestamp,steps\n" +
+		"1,a,0,10\n" +
+		"2,b,1000,10\n" +
+		"3,c,2000,10\n" +
+		"4,d,3000,10\n"
+	sim := newTestSimulation(t, trace, SimOptions{Concurrency: 1, BaseTime: 0.5, StepTime: 0.08, MaxTime: 3600})
+	results := runTestSimulation(t, sim)
+
+	if status := sim.batch.Status(); status.State != BatchCompleted || status.Completed != 4 {
+		t.Fatalf("expected 4 completed jobs, got %+v", status)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(results))
+	}
+	// every job takes 1.3s on the single replica, so they queue behind each other: job 4 arrives at 3s,
+	// starts at 3.9s and ends at 5.2s
+	for id, latency := range map[string]int64{"1": 1300, "2": 1600, "3": 1900, "4": 2200} {
+		job := results[id]
+		assertMillis(t, job, 5, 1300)
+		assertMillis(t, job, 6, latency)
+	}
+	assertMillis(t, results["4"], 8, 3000)
+	if row := results["4"]; row[3] != "1970-01-01 00:00:03.000" || row[4] != "1970-01-01 00:00:05.200" {
+		t.Errorf("expected job 4 requested at 3s and ended at 5.2s of the epoch, got %v", row)
+	}
+	if elapsed := sim.batch.Status().Elapsed; elapsed != 5.2 {
+		t.Errorf("expected 5.2s of virtual time, got %vs", elapsed)
+	}
+	if dispatch := readTestOutput(t, "sim-dispatch.csv"); strings.Count(dispatch, "\n") != 5 {
+		t.Errorf("expected a dispatch row for every job, got %q", dispatch)
+	}
+	readTestOutput(t, "sim-metrics.csv")
+}
+
+func TestSimulateWritesManifest(t *testing.T) {
+	useSimConfig(t)
+	trace := "id,prompt,timestamp,steps\n" +
+		"1,a,0,10\n" +
+		"2,b,1000,10\n" +
+		"3,c,2000,10\n"
+	simulate := func(name string, seed uint64) RunManifest {
+		js := NewJobScheduler(nil)
+		options := DefaultReplayOptions()
+		options.Seed = seed
+		simOptions := SimOptions{Concurrency: 1, BaseTime: 0.5, StepTime: 0.08, MaxTime: 3600}
+		if err := js.Simulate(name, name+".csv", "text/csv", strings.NewReader(trace), options, simOptions); err != nil {
+			t.Fatalf("Simulate failed: %v", err)
+		}
+		batch, _ := js.Batch(name)
+		select {
+		case <-batch.doneChan:
+		case <-time.After(30 * time.Second):
+			t.Fatal("simulation did not finish")
+		}
+		var manifest RunManifest
+		if err := json.Unmarshal([]byte(readTestOutput(t, name+"-manifest.json")), &manifest); err != nil {
+			t.Fatalf("decoding the manifest failed: %v", err)
+		}
+		return manifest
+	}
+
+	manifest := simulate("seeded", 11)
+	hash := sha256.Sum256([]byte(trace))
+	if manifest.TraceHash != hex.EncodeToString(hash[:]) {
+		t.Errorf("expected the hash of the trace, got %s", manifest.TraceHash)
+	}
+	if manifest.Seed != 11 || manifest.Version != util.BuildVersion() || manifest.Source != "seeded.csv" || manifest.Size != 3 {
+		t.Errorf("unexpected manifest %+v", manifest)
+	}
+	if manifest.Config.OutputFilePath != config.C.OutputFilePath || manifest.Config.MetricsWindow != 10 || manifest.Config.ScalePolicy != PolicyTargetQueue {
+		t.Errorf("expected a snapshot of the config, got %+v", manifest.Config)
+	}
+	if manifest.State != BatchCompleted || manifest.EndTime == nil || manifest.Simulation == nil || manifest.Simulation.Concurrency != 1 {
+		t.Errorf("expected the completed simulation recorded, got %+v", manifest)
+	}
+	// the virtual clock dispatches every job right at its offset
+	if dispatch := manifest.Dispatch; dispatch == nil || *dispatch != (DispatchAccuracy{Count: 3}) {
+		t.Errorf("expected 3 jobs dispatched without skew, got %+v", dispatch)
+	}
+
+	if manifest := simulate("unseeded", 0); manifest.Seed == 0 {
+		t.Errorf("expected the random seed recorded, got %+v", manifest)
+	}
+}
+
+func TestSimulationIsReproducible(t *testing.T) {
+	trace := "id,prompt,timestamp,steps\n"
+	for i := 0; i < 30; i++ {
+		trace += strconv.Itoa(i) + ",p," + strconv.Itoa(i*150) + ",20\n"
+	}
+	options := SimOptions{Concurrency: 2, ColdStart: 3, BaseTime: 0.2, StepTime: 0.05, Jitter: 0.3, FailureRate: 0.2, Seed: 7, MaxTime: 3600}
+	run := func() (string, string) {
+		sim := newTestSimulation(t, trace, options)
+		config.C.EnableAutoScaling = true
+		config.C.MaxRetryCount = 5
+		config.C.RetryBaseDelay = 100
+		config.C.RetryBudget = 1
+		sim.worker.retryPolicy = NewRetryPolicy()
+		sim.scaler.guardrails = &Guardrails{MinReplicas: 1, MaxReplicas: 4}
+		runTestSimulation(t, sim)
+		return readTestOutput(t, "sim-result.csv"), readTestOutput(t, "sim-attempts.csv")
+	}
+
+	results, attempts := run()
+	for i := 0; i < 3; i++ {
+		if again, againAttempts := run(); again != results || againAttempts != attempts {
+			t.Fatalf("expected every run of the trace to give the same results, run %d differs", i+2)
+		}
+	}
+}
+
+func TestSimulationScalesPool(t *testing.T) {
+	trace := "id,prompt,timestamp,steps\n"
+	for i := 0; i < 40; i++ {
+		trace += strconv.Itoa(i) + ",p,0,50\n"
+	}
+
+	sim := newTestSimulation(t, trace, SimOptions{Concurrency: 2, ColdStart: 5, BaseTime: 1, StepTime: 0.1, MaxTime: 3600})
+	config.C.EnableAutoScaling = true
+	sim.scaler.policy = &TargetQueuePolicy{JobsPerWorker: 4}
+	sim.scaler.guardrails = &Guardrails{MinReplicas: 1, MaxReplicas: 5}
+	runTestSimulation(t, sim)
+
+	status := sim.batch.Status()
+	if status.Completed != 40 {
+		t.Fatalf("expected 40 completed jobs, got %+v", status)
+	}
+	// the queue holds 11 jobs at 10s, so the pool scales to 3 replicas, which serve from 15s, then to 5
+	// at 20s, clamped by the max replicas
+	rows, err := csv.NewReader(strings.NewReader(readTestOutput(t, "sim-metrics.csv"))).ReadAll()
+	if err != nil {
+		t.Fatalf("reading metrics failed: %v", err)
+	}
+	running := []string{}
+	for _, row := range rows[1:] {
+		running = append(running, row[2])
+	}
+	if !slices.Equal(running, []string{"1", "3", "5", "5"}) {
+		t.Errorf("expected the pool to scale to 5 running replicas, got %v", running)
+	}
+	// a single replica would need 40 * 6s / 2 = 120s
+	if status.Elapsed != 43 {
+		t.Errorf("expected scaling to end the simulation at 43s, took %vs", status.Elapsed)
+	}
+}
+
+func TestSimulationRetriesFailures(t *testing.T) {
+	trace := "id,prompt,timestamp,steps\n"
+	for i := 0; i < 20; i++ {
+		trace += strconv.Itoa(i) + ",p," + strconv.Itoa(i*100) + ",1\n"
+	}
+	sim := newTestSimulation(t, trace, SimOptions{Concurrency: 4, BaseTime: 0.1, FailureRate: 0.3, Seed: 3, MaxTime: 3600})
+	config.C.MaxRetryCount = 10
+	config.C.RetryBaseDelay = 100
+	config.C.RetryBudget = 1
+	sim.worker.retryPolicy = NewRetryPolicy()
+	runTestSimulation(t, sim)
+
+	status := sim.batch.Status()
+	if status.Completed != 20 || status.Retries != 2 {
+		t.Fatalf("expected every job completed after 2 retries, got %+v", status)
+	}
+}
+
+func TestSimulationMaxTimeCancelsJobsLeft(t *testing.T) {
+	// job 1 completes at 0.6s, job 2 is served from 0.6s to 2.1s, job 3 waits for the replica and
+	// job 4 arrives long after the max time
+	trace := "id,prompt,timestamp,steps\n" +
+		"1,a,0,1\n" +
+		"2,b,300,10\n" +
+		"3,c,400,1\n" +
+		"4,d,100000,1\n"
+	sim := newTestSimulation(t, trace, SimOptions{Concurrency: 1, BaseTime: 0.5, StepTime: 0.1, MaxTime: 1.5})
+	results := runTestSimulation(t, sim)
+
+	status := sim.batch.Status()
+	if status.State != BatchCancelled || status.Completed != 1 || status.Abandoned != 3 {
+		t.Fatalf("expected 1 completed and 3 cancelled jobs, got %+v", status)
+	}
+	if status.Elapsed != 1.5 {
+		t.Errorf("expected the simulation to stop at 1.5s, got %vs", status.Elapsed)
+	}
+	if len(results) != 4 {
+		t.Fatalf("expected a result for every job of the trace, got %d", len(results))
+	}
+	for _, id := range []string{"2", "3", "4"} {
+		if row := results[id]; row[1] != "false" || row[10] != "true" || row[4] != "1970-01-01 00:00:01.500" {
+			t.Errorf("expected job %s cancelled at 1.5s, got %v", id, row)
+		}
+	}
+	assertMillis(t, results["2"], 6, 1200)
+	assertMillis(t, results["4"], 8, 100000)
+}
+
+func TestSchedulerRunsSimulationAsBatch(t *testing.T) {
+	server := useFakeServe(t, fakeserve.DefaultOptions())
+	js := NewJobScheduler(nil)
+	if err := js.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(js.Stop)
+
+	// the files of a running batch are never overwritten by a simulation of the same name
+	waiting := "id,prompt,timestamp,steps\n1,a,3600000,10\n"
+	if err := js.SubmitJobs("trace", "trace.csv", "text/csv", strings.NewReader(waiting), DefaultReplayOptions()); err != nil {
+		t.Fatalf("SubmitJobs failed: %v", err)
+	}
+	trace := "id,prompt,timestamp,steps\n1,a,0,10\n2,b,1000,10\n"
+	options := SimOptions{Concurrency: 1, BaseTime: 0.5, StepTime: 0.08, MaxTime: 3600}
+	if err := js.Simulate("trace", "trace.csv", "text/csv", strings.NewReader(trace), DefaultReplayOptions(), options); err == nil {
+		t.Error("expected a simulation named like the running batch to be rejected")
+	}
+
+	if err := js.Simulate("trace-sim", "trace.csv", "text/csv", strings.NewReader(trace), DefaultReplayOptions(), options); err != nil {
+		t.Fatalf("Simulate failed: %v", err)
+	}
+	batch, ok := js.Batch("trace-sim")
+	if !ok {
+		t.Fatal("expected the simulation registered as a batch")
+	}
+	<-batch.doneChan
+	if status := batch.Status(); status.State != BatchCompleted || status.Completed != 2 || status.Elapsed != 2.6 {
+		t.Fatalf("expected 2 jobs completed at 2.6s, got %+v", status)
+	}
+	if manifest := batch.Manifest(); manifest.Simulation == nil || *manifest.Simulation != options {
+		t.Errorf("expected the simulation options in the manifest, got %+v", manifest.Simulation)
+	}
+	if requests := server.Requests(fakeserve.RouteGenerate); requests != 0 {
+		t.Errorf("expected the simulation to stay off the served deployment, got %d requests", requests)
+	}
+}
+
+func TestSimPoolScaleDown(t *testing.T) {
+	saved := config.C
+	t.Cleanup(func() { config.C = saved })
+	config.C.InitWorkerCount = 0
+	pool := newSimPool(DefaultSimOptions(), NewSimClock(simEpoch))
+	idle, busy := pool.add(), pool.add()
+	idle.ready, busy.ready, busy.busy = true, true, 1
+	replicas := func() (int, int) {
+		running, total, _ := pool.Replicas(context.Background())
+		return running, total
+	}
+
+	_ = pool.Scale(context.Background(), 3)
+	if _, total := replicas(); total != 3 {
+		t.Fatalf("expected a starting replica, got %d", total)
+	}
+	// the starting replica goes first, then the idle one, the busy one drains
+	_ = pool.Scale(context.Background(), 0)
+	if running, total := replicas(); running != 0 || total != 1 || !busy.draining {
+		t.Fatalf("expected only the busy replica draining, got %d running of %d", running, total)
+	}
+	// scaling up again reuses the draining replica instead of a cold start
+	_ = pool.Scale(context.Background(), 1)
+	if running, total := replicas(); running != 1 || total != 1 || busy.draining {
+		t.Fatalf("expected the busy replica back, got %d running of %d", running, total)
+	}
+}
+
+func TestSimPoolServesInArrivalOrder(t *testing.T) {
+	saved := config.C
+	t.Cleanup(func() { config.C = saved })
+	config.C.InitWorkerCount = 1
+	clock := NewSimClock(simEpoch)
+	pool := newSimPool(SimOptions{Concurrency: 1, BaseTime: 1}, clock)
+	served := []string{}
+	pool.answer = func(r *simRequest, duration time.Duration, err error) {
+		served = append(served, r.job.Id+"@"+clock.Now().Sub(simEpoch).String())
+	}
+
+	// the first request is served right away, the others wait for the replica in arrival order and
+	// one that is aborted leaves the line
+	requests := map[string]*simRequest{}
+	for _, id := range []string{"1", "2", "3", "4"} {
+		requests[id] = &simRequest{job: Job{Id: id}}
+		pool.serve(requests[id])
+	}
+	if len(pool.waiting) != 3 {
+		t.Fatalf("expected 3 requests waiting, got %d", len(pool.waiting))
+	}
+	pool.abort(requests["3"])
+	for clock.Next() {
+	}
+	if want := []string{"1@1s", "2@2s", "4@3s"}; !slices.Equal(served, want) {
+		t.Errorf("expected the requests served as %v, got %v", want, served)
+	}
+}
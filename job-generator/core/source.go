@@ -0,0 +1,123 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// JobSource yields the jobs of an uploaded trace in request time order
+type JobSource interface {
+	Next() (Job, bool)
+	Size() int
+	Duration() time.Duration // request time offset of the last job
+	Err() error
+	Hash() string // content hash identifying the trace
+	Reset() error // rewind to the first job
+	Close()
+}
+
+// OpenJobSource picks the trace format by file extension, then by content type, falling back to CSV
+func OpenJobSource(filename, contentType string, file io.Reader) (JobSource, error) {
+	return openSource(filename, contentType, file, jobColumns)
+}
+
+// OpenCorpusSource opens a seed corpus for synthetic workloads, unlike a trace it needs no timestamp column
+func OpenCorpusSource(filename, contentType string, file io.Reader) (JobSource, error) {
+	return openSource(filename, contentType, file, corpusColumns)
+}
+
+func openSource(filename, contentType string, file io.Reader, columns []column) (JobSource, error) {
+	switch traceFormat(filename, contentType) {
+	case "jsonl":
+		return readJSONL(file, columns)
+	case "parquet":
+		return readParquet(file, columns)
+	default:
+		return readCSV(file, columns)
+	}
+}
+
+func traceFormat(filename, contentType string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return "csv"
+	case ".jsonl", ".ndjson":
+		return "jsonl"
+	case ".parquet":
+		return "parquet"
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/jsonl", "application/x-jsonlines", "application/x-ndjson", "application/ndjson":
+		return "jsonl"
+	case "application/vnd.apache.parquet", "application/x-parquet":
+		return "parquet"
+	}
+	return "csv"
+}
+
+// spoolTrace copies the upload to a temporary file and hashes it, scan reads the content while it is being copied
+func spoolTrace(file io.Reader, pattern string, scan func(r io.Reader) error) (*os.File, string, error) {
+	spool, err := os.CreateTemp("", pattern)
+	if err != nil {
+		slog.Error("Error creating trace spool file", "err", err)
+		return nil, "", err
+	}
+	if scan == nil {
+		scan = func(r io.Reader) error {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+	}
+	hash := sha256.New()
+	if err = scan(io.TeeReader(file, io.MultiWriter(spool, hash))); err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeSpool(spool)
+		return nil, "", err
+	}
+	return spool, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func removeSpool(spool *os.File) {
+	_ = spool.Close()
+	_ = os.Remove(spool.Name())
+}
+
+// traceStats accumulates the size, duration and validation issues of a trace
+type traceStats struct {
+	size     int
+	duration time.Duration
+	hash     string
+	issues   SchemaError
+}
+
+func (s *traceStats) Hash() string {
+	return s.hash
+}
+
+func (s *traceStats) add(job Job, issues []SchemaIssue) {
+	if len(issues) > 0 {
+		s.issues.add(issues...)
+		return
+	}
+	s.size++
+	if d := job.RequestTime.Sub(time.UnixMilli(0)); d > s.duration {
+		s.duration = d
+	}
+}
+
+func (s *traceStats) err() error {
+	if s.issues.Count > 0 {
+		return &s.issues
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package core
+
+import (
+	"bytes"
+	"github.com/parquet-go/parquet-go"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceFormat(t *testing.T) {
+	cases := []struct {
+		filename, contentType, format string
+	}{
+		{"trace.csv", "application/octet-stream", "csv"},
+		{"trace.jsonl", "", "jsonl"},
+		{"trace.parquet", "text/csv", "parquet"},
+		{"trace", "application/x-ndjson; charset=utf-8", "jsonl"},
+		{"trace", "", "csv"},
+	}
+	for _, c := range cases {
+		if format := traceFormat(c.filename, c.contentType); format != c.format {
+			t.Errorf("traceFormat(%q, %q) = %s, expected %s", c.filename, c.contentType, format, c.format)
+		}
+	}
+}
+
+func TestReadJobJSONL(t *testing.T) {
+	trace := `{"id": 1, "prompt": "a cat", "steps": 30, "timestamp": 0}` + "\n\n" +
+		`{"id": "2", "prompt": "a dog", "cfg": 7.5, "sampler": 3, "timestamp": 2000}`
+
+	iter, err := ReadJobJSONL(strings.NewReader(trace))
+	if err != nil {
+		t.Fatalf("ReadJobJSONL failed: %v", err)
+	}
+	defer iter.Close()
+
+	if iter.Size() != 2 || iter.Duration() != 2*time.Second {
+		t.Errorf("Unexpected size %d or duration %v", iter.Size(), iter.Duration())
+	}
+	job, ok := iter.Next()
+	if !ok || job.Id != "1" || job.Param.Steps != 30 {
+		t.Errorf("Unexpected first job: %+v", job)
+	}
+	job, ok = iter.Next()
+	if !ok || job.Id != "2" || job.Param.Scale != 7.5 || job.Param.SamplerIndex != "Euler" {
+		t.Errorf("Unexpected second job: %+v", job)
+	}
+	if _, ok = iter.Next(); ok {
+		t.Errorf("Expected end of trace")
+	}
+}
+
+func TestReadJobParquet(t *testing.T) {
+	type row struct {
+		Id        int64   `parquet:"id"`
+		Prompt    string  `parquet:"prompt"`
+		Cfg       float64 `parquet:"cfg"`
+		Timestamp int64   `parquet:"timestamp"`
+	}
+	buf := &bytes.Buffer{}
+	if err := parquet.Write(buf, []row{
+		{Id: 1, Prompt: "a cat", Cfg: 7, Timestamp: 0},
+		{Id: 2, Prompt: "a dog", Cfg: 8.5, Timestamp: 1200},
+	}); err != nil {
+		t.Fatalf("Failed to write parquet: %v", err)
+	}
+
+	iter, err := ReadJobParquet(buf)
+	if err != nil {
+		t.Fatalf("ReadJobParquet failed: %v", err)
+	}
+	defer iter.Close()
+
+	if iter.Size() != 2 || iter.Duration() != 1200*time.Millisecond {
+		t.Errorf("Unexpected size %d or duration %v", iter.Size(), iter.Duration())
+	}
+	job, ok := iter.Next()
+	if !ok || job.Id != "1" || job.Param.Prompt != "a cat" || job.Param.Width != 512 {
+		t.Errorf("Unexpected first job: %+v", job)
+	}
+	job, ok = iter.Next()
+	if !ok || job.Id != "2" || job.Param.Scale != 8.5 || job.RequestTime != time.UnixMilli(1200) {
+		t.Errorf("Unexpected second job: %+v", job)
+	}
+	if _, ok = iter.Next(); ok {
+		t.Errorf("Expected end of trace")
+	}
+}
@@ -0,0 +1,226 @@
+package core
+
+import (
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"github.com/paopaoyue/kscale/job-genrator/api/fakeserve"
+	"github.com/paopaoyue/kscale/job-genrator/config"
+	"github.com/paopaoyue/kscale/job-genrator/util"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func startTestWorker(t *testing.T) (chan Job, chan Job) {
+	t.Helper()
+	jobChan, outputChan := make(chan Job, 1), make(chan Job)
+	endpoints := util.NewEndpointGroup(util.NewEndpoints(config.C.APIEndpoint), util.RoundRobin, 0)
+	worker := NewJobWorker(api.NewClientFromConfig(), endpoints, jobChan, outputChan, WallClock)
+	worker.Start()
+	t.Cleanup(func() { worker.Stop(time.Second) })
+	return jobChan, outputChan
+}
+
+func receiveJob(t *testing.T, outputChan chan Job) Job {
+	t.Helper()
+	select {
+	case job := <-outputChan:
+		return job
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the job")
+		return Job{}
+	}
+}
+
+func TestWorkerRetriesInjectedFailures(t *testing.T) {
+	server := useFakeServe(t, fakeserve.DefaultOptions())
+	config.C.MaxRetryCount = 3
+	config.C.RetryBaseDelay = 1
+	server.Fail(fakeserve.RouteGenerate, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	jobChan, outputChan := startTestWorker(t)
+
+	jobChan <- *NewJob("1", api.GenerateRequestParam{Prompt: "a", Steps: 20})
+	job := receiveJob(t, outputChan)
+	if !job.Success || job.Retry != 2 || len(job.Attempts) != 3 {
+		t.Fatalf("expected success on the third attempt, got %+v", job)
+	}
+	for i, status := range []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK} {
+		if job.Attempts[i].StatusCode != status {
+			t.Errorf("expected attempt %d to get %d, got %d", i+1, status, job.Attempts[i].StatusCode)
+		}
+	}
+}
+
+func TestWorkerRecordsAttempts(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Latency = 10 * time.Millisecond
+	server := useFakeServe(t, options)
+	config.C.MaxRetryCount = 2
+	config.C.RetryBaseDelay = 1
+	server.Fail(fakeserve.RouteGenerate, http.StatusInternalServerError)
+	jobChan, outputChan := startTestWorker(t)
+
+	job := *NewJob("1", api.GenerateRequestParam{Prompt: "a", Steps: 20})
+	job.readyAt = time.Now()
+	jobChan <- job
+	job = receiveJob(t, outputChan)
+	if len(job.Attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %+v", job.Attempts)
+	}
+	failed, succeeded := job.Attempts[0], job.Attempts[1]
+	if failed.Number != 1 || failed.Endpoint != server.Host() || failed.ErrorClass != ErrorServer ||
+		!strings.Contains(failed.Error, "injected failure") || failed.ServerDuration != 0 {
+		t.Errorf("unexpected failed attempt %+v", failed)
+	}
+	if succeeded.Number != 2 || succeeded.ErrorClass != ErrorNone || succeeded.Error != "" || succeeded.ServerDuration != 10*time.Millisecond {
+		t.Errorf("unexpected successful attempt %+v", succeeded)
+	}
+	// the queue delay of the retry counts from the end of its backoff
+	if succeeded.QueueDelay < 0 || succeeded.StartTime.Before(failed.EndTime) {
+		t.Errorf("expected the retry to start after the failure, got a queue delay of %v", succeeded.QueueDelay)
+	}
+	if failed.EndTime.Before(failed.StartTime) || succeeded.EndTime.Sub(succeeded.StartTime) < 10*time.Millisecond {
+		t.Errorf("unexpected attempt times %+v", job.Attempts)
+	}
+}
+
+func TestTruncateError(t *testing.T) {
+	short := "connection refused"
+	if got := truncateError(short); got != short {
+		t.Errorf("expected a short error kept, got %q", got)
+	}
+	// a 3 byte character straddles the limit
+	long := strings.Repeat("a", maxErrorLength-1) + "错误"
+	got := truncateError(long)
+	if !utf8.ValidString(got) || got != strings.Repeat("a", maxErrorLength-1) {
+		t.Errorf("expected the cut before the split character, got %d bytes valid=%v", len(got), utf8.ValidString(got))
+	}
+	if got := truncateError(strings.Repeat("错", maxErrorLength)); len(got) > maxErrorLength || !utf8.ValidString(got) {
+		t.Errorf("expected valid text within the limit, got %d bytes", len(got))
+	}
+}
+
+func TestWorkerAbandonsAtDeadline(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Latency = time.Second
+	useFakeServe(t, options)
+	jobChan, outputChan := startTestWorker(t)
+
+	job := *NewJob("1", api.GenerateRequestParam{Prompt: "a", Steps: 20})
+	job.Deadline = time.Now().Add(20 * time.Millisecond)
+	jobChan <- job
+	job = receiveJob(t, outputChan)
+	if job.Success || !job.Abandoned || len(job.Attempts) != 1 || job.Attempts[0].ErrorClass != ErrorAbandoned {
+		t.Fatalf("expected the job abandoned in its first attempt, got %+v", job)
+	}
+}
+
+func TestWorkerWithoutRunningReplicas(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Replicas = 0
+	server := useFakeServe(t, options)
+	config.C.MaxRetryCount = 1
+	jobChan, outputChan := startTestWorker(t)
+
+	// without a running replica serve answers 503, which is an overload the job may retry
+	jobChan <- *NewJob("1", api.GenerateRequestParam{Prompt: "a", Steps: 20})
+	job := receiveJob(t, outputChan)
+	if job.Success || job.Attempts[0].ErrorClass != ErrorOverloaded || server.Requests(fakeserve.RouteGenerate) != 1 {
+		t.Fatalf("expected an overloaded attempt, got %+v", job)
+	}
+}
+
+func TestWorkerCancelsQueuedJobsOnStop(t *testing.T) {
+	server := useFakeServe(t, fakeserve.DefaultOptions())
+	config.C.MaxRetryCount = 5
+	config.C.RetryBaseDelay = 60000
+	config.C.MaxRetryQueueSize = 1
+	config.C.RetryQueueOverflow = OverflowBlock
+	server.Fail(fakeserve.RouteGenerate, slices.Repeat([]int{http.StatusServiceUnavailable}, 10)...)
+	jobChan, outputChan := make(chan Job, 3), make(chan Job)
+	endpoints := util.NewEndpointGroup(util.NewEndpoints(config.C.APIEndpoint), util.RoundRobin, 0)
+	worker := NewJobWorker(api.NewClientFromConfig(), endpoints, jobChan, outputChan, WallClock)
+	worker.Start()
+
+	// the first retry fills the queue and the second one blocks until the worker stops
+	jobChan <- *NewJob("1", api.GenerateRequestParam{Prompt: "a", Steps: 20})
+	jobChan <- *NewJob("2", api.GenerateRequestParam{Prompt: "b", Steps: 20})
+	waitFor(t, "both jobs to fail once", func() bool { return server.Requests(fakeserve.RouteGenerate) >= 2 })
+	worker.Stop(time.Second)
+	jobChan <- *NewJob("3", api.GenerateRequestParam{Prompt: "c", Steps: 20})
+
+	cancelled := make(chan int)
+	go func() { cancelled <- worker.CancelQueued() }()
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		job := receiveJob(t, outputChan)
+		if job.Success || !job.Abandoned || !job.Cancelled {
+			t.Fatalf("expected job %s cancelled, got %+v", job.Id, job)
+		}
+		ids = append(ids, job.Id)
+	}
+	slices.Sort(ids)
+	if count := <-cancelled; count != 3 || !slices.Equal(ids, []string{"1", "2", "3"}) {
+		t.Fatalf("expected the 3 queued jobs cancelled, got %d: %v", count, ids)
+	}
+}
+
+func TestWorkerStopAbortsRequestsAfterGrace(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Latency = time.Minute
+	server := useFakeServe(t, options)
+	config.C.MaxRetryCount = 3
+	jobChan, outputChan := make(chan Job, 1), make(chan Job)
+	endpoints := util.NewEndpointGroup(util.NewEndpoints(config.C.APIEndpoint), util.RoundRobin, 0)
+	worker := NewJobWorker(api.NewClientFromConfig(), endpoints, jobChan, outputChan, WallClock)
+	worker.Start()
+
+	jobChan <- *NewJob("1", api.GenerateRequestParam{Prompt: "a", Steps: 20})
+	waitFor(t, "the request", func() bool { return server.Requests(fakeserve.RouteGenerate) == 1 })
+	stopped := make(chan struct{})
+	go func() {
+		worker.Stop(50 * time.Millisecond)
+		close(stopped)
+	}()
+
+	// the request is aborted once the grace period ends instead of waiting for the answer
+	job := receiveJob(t, outputChan)
+	if job.Success || !job.Cancelled || job.Retry != 0 {
+		t.Fatalf("expected the job in flight cancelled without a retry, got %+v", job)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop did not return after the grace period")
+	}
+}
+
+func TestWorkerLimitsInflightPerEndpoint(t *testing.T) {
+	options := fakeserve.DefaultOptions()
+	options.Latency = 50 * time.Millisecond
+	server := useFakeServe(t, options)
+	jobChan, outputChan := make(chan Job, 6), make(chan Job)
+	endpoints := util.NewEndpointGroup(util.NewEndpoints(config.C.APIEndpoint), util.RoundRobin, 2)
+	worker := NewJobWorker(api.NewClientFromConfig(), endpoints, jobChan, outputChan, WallClock)
+	worker.Start()
+	t.Cleanup(func() { worker.Stop(time.Second) })
+
+	// the jobs beyond the limit wait for an answer instead of piling up at the endpoint
+	for i := 0; i < 6; i++ {
+		jobChan <- *NewJob(strconv.Itoa(i), api.GenerateRequestParam{Prompt: "a", Steps: 20})
+	}
+	for i := 0; i < 6; i++ {
+		if job := receiveJob(t, outputChan); !job.Success {
+			t.Fatalf("expected job %s to succeed, got %+v", job.Id, job)
+		}
+	}
+	if peak := server.PeakInflight(); peak != 2 {
+		t.Errorf("expected at most 2 requests in flight at the endpoint, got %d", peak)
+	}
+	if stats := endpoints.Stats(); stats[0].Requests != 6 || stats[0].Outstanding != 0 {
+		t.Errorf("unexpected endpoint stats %+v", stats)
+	}
+}
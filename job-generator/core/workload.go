@@ -0,0 +1,353 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxCorpusSize = 10000
+
+type WorkloadSpec struct {
+	Name     string      `json:"name"`
+	Duration float64     `json:"duration"` // in seconds
+	Seed     uint64      `json:"seed"`     // 0 picks a random seed, recorded in the run manifest
+	Arrival  ArrivalSpec `json:"arrival"`
+
+	// optional overrides of the values sampled from the corpus
+	Steps []int    `json:"steps,omitempty"` // sampled uniformly
+	Sizes []string `json:"sizes,omitempty"` // "WIDTHxHEIGHT", sampled uniformly
+}
+
+type ArrivalSpec struct {
+	Process string  `json:"process"` // constant, poisson, diurnal, step or mmpp
+	Rate    float64 `json:"rate"`    // jobs per second
+
+	// diurnal: rate * (1 + amplitude * sin(2π * t / period + phase))
+	Amplitude float64 `json:"amplitude,omitempty"`
+	Period    float64 `json:"period,omitempty"` // in seconds
+	Phase     float64 `json:"phase,omitempty"`  // in radians
+
+	// step: piecewise constant rate, a burst is a step up followed by a step down
+	Schedule []RateStep `json:"schedule,omitempty"`
+
+	// mmpp: markov modulated poisson process cycling through its states
+	Rates       []float64 `json:"rates,omitempty"`        // jobs per second in each state
+	SwitchRates []float64 `json:"switch_rates,omitempty"` // rate of leaving each state per second
+}
+
+type RateStep struct {
+	At   float64 `json:"at"`   // in seconds
+	Rate float64 `json:"rate"` // jobs per second
+}
+
+func (s WorkloadSpec) Validate() error {
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+	if s.Duration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	for _, steps := range s.Steps {
+		if steps <= 0 {
+			return errors.New("steps must be positive")
+		}
+	}
+	for _, size := range s.Sizes {
+		if _, _, err := parseSize(size); err != nil {
+			return err
+		}
+	}
+	_, err := newArrivalProcess(s.Arrival)
+	return err
+}
+
+// arrivalProcess returns the time of the next arrival after t, both in seconds, or any time
+// past until if there is none before it
+type arrivalProcess interface {
+	next(t, until float64, rng *rand.Rand) float64
+	reset()
+}
+
+func newArrivalProcess(spec ArrivalSpec) (arrivalProcess, error) {
+	switch spec.Process {
+	case "constant", "poisson":
+		if spec.Rate <= 0 {
+			return nil, errors.New("arrival rate must be positive")
+		}
+		return &poissonProcess{rate: spec.Rate, constant: spec.Process == "constant"}, nil
+	case "diurnal":
+		if spec.Rate <= 0 || spec.Period <= 0 || spec.Amplitude < 0 || spec.Amplitude > 1 {
+			return nil, errors.New("diurnal arrival needs a positive rate and period and an amplitude between 0 and 1")
+		}
+		return &thinningProcess{
+			maxRate: spec.Rate * (1 + spec.Amplitude),
+			rate: func(t float64) float64 {
+				return spec.Rate * (1 + spec.Amplitude*math.Sin(2*math.Pi*t/spec.Period+spec.Phase))
+			},
+		}, nil
+	case "step":
+		if len(spec.Schedule) == 0 {
+			return nil, errors.New("step arrival needs a schedule")
+		}
+		maxRate := 0.0
+		for i, step := range spec.Schedule {
+			if step.Rate < 0 || (i > 0 && step.At <= spec.Schedule[i-1].At) {
+				return nil, errors.New("step schedule must have non-negative rates in increasing time order")
+			}
+			maxRate = max(maxRate, step.Rate)
+		}
+		if maxRate == 0 {
+			return nil, errors.New("step schedule must have a positive rate")
+		}
+		return &thinningProcess{
+			maxRate: maxRate,
+			rate: func(t float64) float64 {
+				rate := 0.0
+				for _, step := range spec.Schedule {
+					if t < step.At {
+						break
+					}
+					rate = step.Rate
+				}
+				return rate
+			},
+		}, nil
+	case "mmpp":
+		if len(spec.Rates) == 0 || len(spec.Rates) != len(spec.SwitchRates) {
+			return nil, errors.New("mmpp arrival needs as many switch rates as rates")
+		}
+		maxRate := 0.0
+		for i := range spec.Rates {
+			if spec.Rates[i] < 0 || spec.SwitchRates[i] <= 0 {
+				return nil, errors.New("mmpp rates must not be negative and switch rates must be positive")
+			}
+			maxRate = max(maxRate, spec.Rates[i])
+		}
+		if maxRate == 0 {
+			return nil, errors.New("mmpp must have a state with a positive rate")
+		}
+		return &mmppProcess{rates: spec.Rates, switchRates: spec.SwitchRates}, nil
+	default:
+		return nil, fmt.Errorf("unknown arrival process: %s", spec.Process)
+	}
+}
+
+type poissonProcess struct {
+	rate     float64
+	constant bool
+}
+
+func (p *poissonProcess) next(t, until float64, rng *rand.Rand) float64 {
+	if p.constant {
+		return t + 1/p.rate
+	}
+	return t + rng.ExpFloat64()/p.rate
+}
+
+func (p *poissonProcess) reset() {}
+
+// thinningProcess samples a non-homogeneous poisson process by thinning one of rate maxRate
+type thinningProcess struct {
+	maxRate float64
+	rate    func(t float64) float64
+}
+
+func (p *thinningProcess) next(t, until float64, rng *rand.Rand) float64 {
+	for t < until {
+		t += rng.ExpFloat64() / p.maxRate
+		if rng.Float64()*p.maxRate <= p.rate(t) {
+			return t
+		}
+	}
+	return t
+}
+
+func (p *thinningProcess) reset() {}
+
+type mmppProcess struct {
+	rates       []float64
+	switchRates []float64
+
+	state      int
+	switchTime float64
+	started    bool
+}
+
+func (p *mmppProcess) next(t, until float64, rng *rand.Rand) float64 {
+	if !p.started {
+		p.started = true
+		p.switchTime = t + rng.ExpFloat64()/p.switchRates[p.state]
+	}
+	for t < until {
+		arrival := math.Inf(1)
+		if p.rates[p.state] > 0 {
+			arrival = t + rng.ExpFloat64()/p.rates[p.state]
+		}
+		if arrival < p.switchTime {
+			return arrival
+		}
+		// memoryless, so the arrival is redrawn in the next state
+		t = p.switchTime
+		p.state = (p.state + 1) % len(p.rates)
+		p.switchTime = t + rng.ExpFloat64()/p.switchRates[p.state]
+	}
+	return t
+}
+
+func (p *mmppProcess) reset() {
+	p.state = 0
+	p.started = false
+}
+
+// WorkloadSource generates a synthetic trace, it is a JobSource so generated batches are
+// dispatched exactly like uploaded ones, the same seed always yields the same jobs
+type WorkloadSource struct {
+	spec    WorkloadSpec
+	arrival arrivalProcess
+	corpus  []Job
+
+	rng   *rand.Rand
+	t     float64
+	count int
+
+	size     int
+	duration time.Duration
+	hash     string
+}
+
+// NewWorkloadSource samples up to maxCorpusSize jobs of the corpus as templates, a nil corpus falls back
+// to a single default prompt
+func NewWorkloadSource(spec WorkloadSpec, corpus JobSource) (*WorkloadSource, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	if spec.Seed == 0 {
+		spec.Seed = rand.Uint64()
+	}
+	arrival, _ := newArrivalProcess(spec.Arrival)
+	ws := &WorkloadSource{
+		spec:    spec,
+		arrival: arrival,
+	}
+
+	if corpus != nil {
+		// reservoir sampling keeps memory bounded for large corpora
+		rng := rand.New(rand.NewPCG(spec.Seed, 0))
+		seen := 0
+		for job, ok := corpus.Next(); ok; job, ok = corpus.Next() {
+			seen++
+			if len(ws.corpus) < maxCorpusSize {
+				ws.corpus = append(ws.corpus, job)
+			} else if i := rng.IntN(seen); i < maxCorpusSize {
+				ws.corpus[i] = job
+			}
+		}
+		if err := corpus.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	hash := sha256.New()
+	_ = json.NewEncoder(hash).Encode(spec)
+	if corpus != nil {
+		hash.Write([]byte(corpus.Hash()))
+	}
+	ws.hash = hex.EncodeToString(hash.Sum(nil))
+	if len(ws.corpus) == 0 {
+		ws.corpus = []Job{{
+			Param: api.GenerateRequestParam{
+				Prompt:       "a photo of an astronaut riding a horse on mars",
+				Steps:        20,
+				Scale:        7.0,
+				SamplerIndex: convertToSamplerIndex("8"),
+				Width:        512,
+				Height:       512,
+			},
+			TokenCount: 10,
+		}}
+	}
+
+	// generate once to learn the exact size and duration, arrivals are cheap to sample
+	_ = ws.Reset()
+	for job, ok := ws.Next(); ok; job, ok = ws.Next() {
+		ws.size++
+		ws.duration = job.RequestTime.Sub(time.UnixMilli(0))
+	}
+	_ = ws.Reset()
+	return ws, nil
+}
+
+func (ws *WorkloadSource) Next() (Job, bool) {
+	t := ws.arrival.next(ws.t, ws.spec.Duration, ws.rng)
+	if t >= ws.spec.Duration {
+		ws.t = ws.spec.Duration
+		return Job{}, false
+	}
+	ws.t = t
+	ws.count++
+
+	template := ws.corpus[ws.rng.IntN(len(ws.corpus))]
+	job := Job{
+		Id:          strconv.Itoa(ws.count),
+		Param:       template.Param,
+		TokenCount:  template.TokenCount,
+		RequestTime: time.UnixMilli(0).Add(time.Duration(t * float64(time.Second))),
+	}
+	if len(ws.spec.Steps) > 0 {
+		job.Param.Steps = ws.spec.Steps[ws.rng.IntN(len(ws.spec.Steps))]
+	}
+	if len(ws.spec.Sizes) > 0 {
+		job.Param.Width, job.Param.Height, _ = parseSize(ws.spec.Sizes[ws.rng.IntN(len(ws.spec.Sizes))])
+	}
+	return job, true
+}
+
+func (ws *WorkloadSource) Size() int {
+	return ws.size
+}
+
+func (ws *WorkloadSource) Duration() time.Duration {
+	return ws.duration
+}
+
+func (ws *WorkloadSource) Err() error {
+	return nil
+}
+
+// Hash identifies the generated trace by its spec, including the seed, and the corpus it samples from
+func (ws *WorkloadSource) Hash() string {
+	return ws.hash
+}
+
+func (ws *WorkloadSource) Spec() WorkloadSpec {
+	return ws.spec
+}
+
+func (ws *WorkloadSource) Reset() error {
+	ws.rng = rand.New(rand.NewPCG(ws.spec.Seed, 1))
+	ws.arrival.reset()
+	ws.t = 0
+	ws.count = 0
+	return nil
+}
+
+func (ws *WorkloadSource) Close() {}
+
+func parseSize(size string) (int, int, error) {
+	w, h, ok := strings.Cut(strings.ToLower(size), "x")
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if !ok || errW != nil || errH != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid size %s, expected WIDTHxHEIGHT", size)
+	}
+	return width, height, nil
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestWorkloadSourceDeterministic(t *testing.T) {
+	spec := WorkloadSpec{
+		Name:     "mmpp",
+		Duration: 600,
+		Seed:     42,
+		Arrival: ArrivalSpec{
+			Process:     "mmpp",
+			Rates:       []float64{1, 10},
+			SwitchRates: []float64{0.1, 0.1},
+		},
+		Sizes: []string{"512x512", "768x512"},
+	}
+	corpus, err := OpenCorpusSource("corpus.csv", "", strings.NewReader("id,prompt,step\n1,a cat,30\n2,a dog,25\n"))
+	if err != nil {
+		t.Fatalf("OpenCorpusSource failed: %v", err)
+	}
+	defer corpus.Close()
+
+	ws, err := NewWorkloadSource(spec, corpus)
+	if err != nil {
+		t.Fatalf("NewWorkloadSource failed: %v", err)
+	}
+	first := []Job{}
+	for job, ok := ws.Next(); ok; job, ok = ws.Next() {
+		first = append(first, job)
+	}
+	if len(first) != ws.Size() || len(first) == 0 {
+		t.Fatalf("Expected %d jobs, got %d", ws.Size(), len(first))
+	}
+
+	_ = ws.Reset()
+	for i := range first {
+		job, ok := ws.Next()
+		if !ok || job.Id != first[i].Id || job.RequestTime != first[i].RequestTime || job.Param != first[i].Param {
+			t.Fatalf("Replay diverged at job %d", i)
+		}
+	}
+	if first[0].Param.Steps != 30 && first[0].Param.Steps != 25 {
+		t.Errorf("Expected steps sampled from the corpus, got %d", first[0].Param.Steps)
+	}
+}
+
+func TestWorkloadSourceRate(t *testing.T) {
+	for _, arrival := range []ArrivalSpec{
+		{Process: "constant", Rate: 5},
+		{Process: "poisson", Rate: 5},
+		{Process: "diurnal", Rate: 5, Amplitude: 0.5, Period: 100},
+		{Process: "step", Schedule: []RateStep{{At: 0, Rate: 2}, {At: 500, Rate: 8}}},
+	} {
+		ws, err := NewWorkloadSource(WorkloadSpec{Name: "rate", Duration: 1000, Seed: 1, Arrival: arrival}, nil)
+		if err != nil {
+			t.Fatalf("NewWorkloadSource(%s) failed: %v", arrival.Process, err)
+		}
+		if rate := float64(ws.Size()) / 1000; math.Abs(rate-5) > 0.5 {
+			t.Errorf("Expected about 5 jobs per second for %s, got %.2f", arrival.Process, rate)
+		}
+	}
+}
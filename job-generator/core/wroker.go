@@ -1,88 +1,443 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"github.com/paopaoyue/kscale/job-genrator/api"
 	"github.com/paopaoyue/kscale/job-genrator/config"
+	"github.com/paopaoyue/kscale/job-genrator/metrics"
 	"github.com/paopaoyue/kscale/job-genrator/util"
 	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
+const maxErrorLength = 256 // error bodies may be whole html pages
+
 type JobWorker struct {
-	Endpoint util.Endpoint
-	Hostname string
+	Endpoints *util.EndpointGroup
+	Hostname  string
+
+	client  *api.Client
+	clock   Clock
+	metrics metrics.MetricsClient
+	datadog metrics.MetricsClient
+
+	jobChan chan Job
+	output  func(Job) // hands a finished job back to its batch
+
+	ctx          context.Context // cancelled when the worker stops
+	cancel       context.CancelFunc
+	stopChan     chan struct{}
+	reportTicker Ticker
+	wg           *sync.WaitGroup // every goroutine of the worker, including jobs in flight
 
-	jobChan    chan Job
-	outputChan chan Job
+	// jobs stay in jobChan until a slot is free, nil slots are unlimited
+	slots    chan struct{}
+	inflight atomic.Int32
 
-	stopChan chan struct{}
+	retryPolicy RetryPolicy
+	retryQueue  *retryQueue
+	rand        *util.Rand // of the jobs sent without a batch
 }
 
-func NewJobWorker(endpoint util.Endpoint, jobChan, outputChan chan Job) *JobWorker {
+func NewJobWorker(client *api.Client, endpoints *util.EndpointGroup, jobChan, outputChan chan Job, clock Clock) *JobWorker {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &JobWorker{
-		Endpoint: endpoint,
+		Endpoints: endpoints,
+		client:    client,
+		clock:     clock,
+		metrics:   metrics.Client,
+		datadog:   metrics.DatadogClient,
 
-		jobChan:    jobChan,
-		outputChan: outputChan,
-		stopChan:   make(chan struct{}),
+		jobChan:  jobChan,
+		output:   func(job Job) { outputChan <- job },
+		ctx:      ctx,
+		cancel:   cancel,
+		stopChan: make(chan struct{}),
+		wg:       &sync.WaitGroup{},
+
+		slots:       newSlots(config.C.MaxInflightRequests),
+		retryPolicy: NewRetryPolicy(),
+		retryQueue:  newRetryQueue(config.C.MaxRetryQueueSize, config.C.RetryQueueOverflow, clock),
+		rand:        util.NewRand(rand.Uint64(), 0),
 	}
 }
 
 func (jw *JobWorker) Start() {
+	jw.reportTicker = jw.clock.NewTicker(1 * time.Second)
+	jw.wg.Add(3)
+	go func() {
+		defer jw.wg.Done()
+		jw.retryQueue.run(jw.stopChan)
+	}()
 
 	go func() {
+		defer jw.wg.Done()
 		for {
-			select {
-			case <-jw.stopChan:
+			if !acquireSlot(jw.slots, jw.stopChan) {
+				return
+			}
+			job, ok := jw.nextJob()
+			if !ok {
+				releaseSlot(jw.slots)
 				return
-			default:
-				select {
-				case job, ok := <-jw.jobChan:
-					if !ok {
-						return
+			}
+			jw.wg.Add(1)
+			go func() {
+				defer jw.wg.Done()
+				// catch panic
+				defer func() {
+					if r := recover(); r != nil {
+						slog.Error("Worker recovered from panic", "jobId", job.Id, "err", r)
 					}
-					go func() {
-						// catch panic
-						defer func() {
-							if r := recover(); r != nil {
-								slog.Error("Worker recovered from panic", "jobId", job.Id, "err", r)
-							}
-						}()
-						jw.processJob(job)
-					}()
-				case <-jw.stopChan:
-					return
+				}()
+				retry := func() bool {
+					defer releaseSlot(jw.slots)
+					return jw.processJob(&job)
+				}()
+				if retry {
+					jw.retryJob(job)
+				}
+			}()
+		}
+	}()
+
+	go func() {
+		defer jw.wg.Done()
+		for {
+			select {
+			case <-jw.reportTicker.C():
+				jw.metrics.Gauge(metrics.InflightRequest, float64(jw.inflight.Load()))
+				jw.datadog.Gauge(metrics.InflightRequest, float64(jw.inflight.Load()))
+				jw.metrics.Gauge(metrics.RetryQueueSize, float64(jw.retryQueue.Len()))
+				jw.datadog.Gauge(metrics.RetryQueueSize, float64(jw.retryQueue.Len()))
+				for _, stats := range jw.Endpoints.Stats() {
+					key := metrics.EndpointKey(metrics.EndpointInflight, stats.Endpoint)
+					jw.metrics.Gauge(key, float64(stats.Outstanding))
+					jw.datadog.Gauge(key, float64(stats.Outstanding))
 				}
+			case <-jw.stopChan:
+				return
 			}
 		}
 	}()
 }
 
-func (jw *JobWorker) Stop() {
+// Stop takes no more jobs and waits for the jobs in flight, those still running after the grace period
+// are cancelled, it returns once every goroutine of the worker has exited
+func (jw *JobWorker) Stop(grace time.Duration) {
+	jw.reportTicker.Stop()
 	close(jw.stopChan)
+
+	done := make(chan struct{})
+	go func() {
+		jw.wg.Wait()
+		close(done)
+	}()
+	timer := jw.clock.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C():
+		slog.Warn("Cancelling jobs in flight after the shutdown grace period", "inflight", jw.inflight.Load())
+		jw.cancel()
+		<-done
+	}
+	jw.cancel()
 }
 
-func (jw *JobWorker) processJob(job Job) {
-	for ; job.Retry < config.C.MaxRetryCount; job.Retry++ {
-		duration, err := api.GenerateImage("http://"+jw.Endpoint.String(), job.Param, job.Id)
+func (jw *JobWorker) InFlight() int {
+	return int(jw.inflight.Load())
+}
 
+// nextJob prefers fresh jobs, so retries only use capacity the replayed trace leaves idle
+func (jw *JobWorker) nextJob() (Job, bool) {
+	select {
+	case job, ok := <-jw.jobChan:
+		return job, ok
+	default:
+	}
+	select {
+	case job, ok := <-jw.jobChan:
+		return job, ok
+	case job := <-jw.retryQueue.ready:
+		return job, true
+	case <-jw.stopChan:
+		return Job{}, false
+	}
+}
+
+// processJob makes one attempt of the job, returns true if the job should be retried
+func (jw *JobWorker) processJob(job *Job) bool {
+	if !jw.begin(job) {
+		return false
+	}
+	ctx := jw.ctx
+	if job.batch != nil {
+		// cancelling the batch aborts the request in flight
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		defer context.AfterFunc(job.batch.ctx, cancel)()
+	}
+	if !job.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, job.Deadline)
+		defer cancel()
+	}
+
+	attempt, err := jw.generateImage(ctx, *job)
+	return jw.complete(ctx, job, attempt, err)
+}
+
+// begin checks a job taken from the queue before its attempt, it returns false if the job is finished already
+func (jw *JobWorker) begin(job *Job) bool {
+	if job.batch != nil && !job.batch.Active() {
+		jw.cancelJob(job) // batch has been cancelled while the job was queued
+		return false
+	}
+	if !job.Deadline.IsZero() && !jw.clock.Now().Before(job.Deadline) {
+		jw.abandonJob(job)
+		return false
+	}
+	return true
+}
+
+// complete records the attempt of the job made with ctx, returns true if the job should be retried
+func (jw *JobWorker) complete(ctx context.Context, job *Job, attempt Attempt, err error) bool {
+	attempt.Number = len(job.Attempts) + 1
+	attempt.QueueDelay = attempt.StartTime.Sub(job.readyAt)
+	if err == nil {
+		job.Attempts = append(job.Attempts, attempt)
+		job.Success = true
+		job.EndTime = jw.clock.Now()
+		job.Duration = attempt.ServerDuration
+		jw.output(*job)
+		return false
+	}
+
+	class := ClassifyError(err)
+	if !job.Deadline.IsZero() && errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+		class = ErrorAbandoned
+	}
+	attempt.ErrorClass = class
+	attempt.Error = truncateError(err.Error())
+	job.Attempts = append(job.Attempts, attempt)
+	if class == ErrorAbandoned {
+		jw.abandonJob(job)
+		return false
+	}
+	if class == ErrorCancelled {
+		jw.cancelJob(job)
+		return false
+	}
+	job.Retry++
+	switch {
+	case !class.Retryable():
+		slog.Error("Error generating image, not retryable", "err", err, "class", class, "jobId", job.Id)
+	case job.Retry >= jw.retryPolicy.MaxAttempts:
+		slog.Error("Error generating image, max retries reached", "err", err, "class", class, "jobId", job.Id)
+	case job.batch != nil && !job.batch.allowRetry(jw.retryPolicy.Budget):
+		slog.Error("Error generating image, retry budget exhausted", "err", err, "class", class, "jobId", job.Id)
+	default:
+		slog.Warn("Error generating image, retrying...", "err", err, "class", class, "jobId", job.Id, "retry", job.Retry)
+		return true
+	}
+	job.EndTime = jw.clock.Now()
+	jw.output(*job)
+	return false
+}
+
+// retryJob queues the job for another attempt after its backoff, the job fails if the retry queue overflows
+func (jw *JobWorker) retryJob(job Job) {
+	delay, ok := jw.backoff(&job)
+	if !ok {
+		return
+	}
+	if jw.retryQueue.push(job, delay, jw.stopChan) {
+		jw.countRetry()
+		return
+	}
+	select {
+	case <-jw.stopChan:
+		// the worker stopped while the queue was full, the retry is cancelled with the queued jobs
+		jw.retryQueue.park(job)
+		return
+	default:
+	}
+	jw.overflowRetry(job)
+}
+
+// backoff sets when the job is ready for its retry and returns the delay, it abandons the job instead
+// if the retry could not start before the deadline
+func (jw *JobWorker) backoff(job *Job) (time.Duration, bool) {
+	delay := jw.retryPolicy.Backoff(job.Retry, jw.randOf(job))
+	job.readyAt = jw.clock.Now().Add(delay)
+	if !job.Deadline.IsZero() && job.readyAt.After(job.Deadline) {
+		jw.abandonJob(job)
+		return 0, false
+	}
+	return delay, true
+}
+
+// randOf is the random source of the batch of the job, seeded by its run manifest
+func (jw *JobWorker) randOf(job *Job) *util.Rand {
+	if job.batch != nil {
+		return job.batch.rand
+	}
+	return jw.rand
+}
+
+func (jw *JobWorker) countRetry() {
+	jw.metrics.Count(metrics.JobRetry)
+	jw.datadog.Count(metrics.JobRetry)
+}
+
+// overflowRetry fails a job the retry queue has no room for
+func (jw *JobWorker) overflowRetry(job Job) {
+	slog.Error("Retry queue is full, job failed", "jobId", job.Id, "overflow", jw.retryQueue.overflow)
+	jw.metrics.Count(metrics.RetryQueueOverflow)
+	jw.datadog.Count(metrics.RetryQueueOverflow)
+	job.EndTime = jw.clock.Now()
+	jw.output(job)
+	if jw.retryQueue.overflow == OverflowFail && job.batch != nil {
+		job.batch.fail("retry queue overflow")
+	}
+}
+
+// abandonJob gives up on a job whose deadline has passed, like a user who stopped waiting
+func (jw *JobWorker) abandonJob(job *Job) {
+	slog.Warn("Job abandoned, deadline exceeded", "jobId", job.Id, "deadline", job.Deadline)
+	job.Abandoned = true
+	job.EndTime = jw.clock.Now()
+	jw.output(*job)
+}
+
+// cancelJob gives up on a job whose batch was cancelled or whose worker stopped before it finished
+func (jw *JobWorker) cancelJob(job *Job) {
+	slog.Warn("Job cancelled", "jobId", job.Id)
+	job.Abandoned = true
+	job.Cancelled = true
+	job.EndTime = jw.clock.Now()
+	jw.output(*job)
+}
+
+// CancelQueued cancels the jobs still queued once the worker stopped, fresh and retried ones, so
+// every dispatched job has a result, it returns how many it cancelled
+func (jw *JobWorker) CancelQueued() int {
+	count := 0
+	for {
+		select {
+		case job := <-jw.jobChan:
+			jw.cancelJob(&job)
+			count++
+		default:
+			for _, job := range jw.retryQueue.drain() {
+				jw.cancelJob(&job)
+				count++
+			}
+			return count
+		}
+	}
+}
+
+// generateImage sends the job to the endpoint picked by the load balance policy, it waits while every
+// endpoint is at MaxInflightPerEndpoint
+func (jw *JobWorker) generateImage(ctx context.Context, job Job) (Attempt, error) {
+	endpoint, err := jw.Endpoints.Acquire(ctx.Done(), jw.randOf(&job))
+	if err != nil {
+		now := jw.clock.Now()
+		return Attempt{StartTime: now, EndTime: now}, err
+	}
+
+	attempt := jw.startAttempt(endpoint)
+	duration, err := jw.client.GenerateImage(ctx, "http://"+endpoint.String(), job.Param, job.Id)
+	jw.endAttempt(endpoint, &attempt, duration, err)
+	return attempt, err
+}
+
+// startAttempt counts a request sent to the endpoint as in flight
+func (jw *JobWorker) startAttempt(endpoint util.Endpoint) Attempt {
+	jw.inflight.Add(1)
+	return Attempt{Endpoint: endpoint.String(), StartTime: jw.clock.Now()}
+}
+
+// endAttempt records the answer of the endpoint to the attempt and releases the endpoint
+func (jw *JobWorker) endAttempt(endpoint util.Endpoint, attempt *Attempt, duration time.Duration, err error) {
+	attempt.EndTime = jw.clock.Now()
+	latency := attempt.EndTime.Sub(attempt.StartTime)
+	jw.inflight.Add(-1)
+	jw.Endpoints.Release(endpoint, latency, err)
+
+	attempt.ServerDuration = duration
+	var statusErr *api.StatusError
+	if err == nil {
+		attempt.StatusCode = http.StatusOK
+	} else if errors.As(err, &statusErr) {
+		attempt.StatusCode = statusErr.StatusCode
+	}
+
+	for _, client := range []metrics.MetricsClient{jw.metrics, jw.datadog} {
+		client.Count(metrics.EndpointKey(metrics.EndpointRequest, endpoint.String()))
+		client.Time(metrics.EndpointKey(metrics.EndpointLatency, endpoint.String()), latency)
 		if err != nil {
-			slog.Error("Error generating image, retrying...", "err", err, "jobId", job.Id, "retry", job.Retry+1)
-		} else {
-			job.Success = true
-			job.EndTime = time.Now()
-			job.Duration = duration
-			break
+			client.Count(metrics.EndpointKey(metrics.EndpointFailure, endpoint.String()))
 		}
 	}
-	if job.Retry >= config.C.MaxRetryCount {
-		slog.Error("Error generating image, max retries reached", "jobId", job.Id)
+}
 
-		job.Success = false
-		job.EndTime = time.Now()
-		jw.outputChan <- job
-		return
+// truncateError cuts the error to maxErrorLength bytes without splitting a character
+func truncateError(s string) string {
+	if len(s) <= maxErrorLength {
+		return s
+	}
+	cut := maxErrorLength
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
 	}
+	return s[:cut]
+}
 
-	jw.outputChan <- job
+func newSlots(n int) chan struct{} {
+	if n <= 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+// acquireSlot blocks until a slot is free, returns false if stopped meanwhile
+func acquireSlot(slots chan struct{}, stopChan chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-stopChan:
+		return false
+	}
+}
+
+// tryAcquireSlot takes a slot if one is free
+func tryAcquireSlot(slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
 }
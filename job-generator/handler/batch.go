@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/paopaoyue/kscale/job-genrator/core"
+	"net/http"
+)
+
+func ListBatchesHandler(c *gin.Context) {
+	batches := core.Scheduler.Batches()
+	statuses := make([]core.JobBatchStatus, 0, len(batches))
+	for _, batch := range batches {
+		statuses = append(statuses, batch.Status())
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"batches": statuses,
+	})
+}
+
+func GetBatchHandler(c *gin.Context) {
+	batch, ok := core.Scheduler.Batch(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": core.ErrBatchNotFound.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, batch.Status())
+}
+
+func PauseBatchHandler(c *gin.Context) {
+	batchAction(c, core.Scheduler.PauseBatch, "Job batch paused")
+}
+
+func ResumeBatchHandler(c *gin.Context) {
+	batchAction(c, core.Scheduler.ResumeBatch, "Job batch resumed")
+}
+
+func CancelBatchHandler(c *gin.Context) {
+	batchAction(c, core.Scheduler.CancelBatch, "Job batch cancelled")
+}
+
+func batchAction(c *gin.Context, action func(string) error, message string) {
+	name := c.Param("name")
+	if err := action(name); err != nil {
+		if errors.Is(err, core.ErrBatchNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": message,
+		"name":    name,
+	})
+}
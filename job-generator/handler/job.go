@@ -1,13 +1,16 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/paopaoyue/kscale/job-genrator/config"
 	"github.com/paopaoyue/kscale/job-genrator/core"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func SubmitJobHandler(c *gin.Context) {
@@ -17,6 +20,12 @@ func SubmitJobHandler(c *gin.Context) {
 		return
 	}
 
+	options, err := parseReplayOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	src, err := file.Open()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error opening file"})
@@ -24,7 +33,12 @@ func SubmitJobHandler(c *gin.Context) {
 	}
 	defer src.Close()
 
-	err = core.Scheduler.SubmitJobs(strings.TrimSuffix(file.Filename, filepath.Ext(file.Filename)), src)
+	err = core.Scheduler.SubmitJobs(strings.TrimSuffix(file.Filename, filepath.Ext(file.Filename)), file.Filename, file.Header.Get("Content-Type"), src, options)
+	var schemaErr *core.SchemaError
+	if errors.As(err, &schemaErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": schemaErr.Error(), "issues": schemaErr.Issues})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -35,7 +49,65 @@ func SubmitJobHandler(c *gin.Context) {
 	})
 }
 
+// parseReplayOptions reads the optional speed, start_offset, end_offset (in seconds), repeat and seed form fields
+func parseReplayOptions(c *gin.Context) (core.ReplayOptions, error) {
+	options := core.DefaultReplayOptions()
+	if v := c.PostForm("speed"); v != "" {
+		speed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return options, fmt.Errorf("invalid speed: %s", v)
+		}
+		options.Speed = speed
+	}
+	for _, field := range []struct {
+		key    string
+		target *time.Duration
+	}{
+		{"start_offset", &options.StartOffset},
+		{"end_offset", &options.EndOffset},
+	} {
+		if v := c.PostForm(field.key); v != "" {
+			seconds, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return options, fmt.Errorf("invalid %s: %s", field.key, v)
+			}
+			*field.target = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	if v := c.PostForm("repeat"); v != "" {
+		repeat, err := strconv.Atoi(v)
+		if err != nil {
+			return options, fmt.Errorf("invalid repeat: %s", v)
+		}
+		options.Repeat = repeat
+	}
+	if v := c.PostForm("seed"); v != "" {
+		seed, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return options, fmt.Errorf("invalid seed: %s", v)
+		}
+		options.Seed = seed
+	}
+	return options, options.Validate()
+}
+
 func DownloadResultHandler(c *gin.Context) {
+	downloadBatchFile(c, "result.csv")
+}
+
+func DownloadManifestHandler(c *gin.Context) {
+	downloadBatchFile(c, "manifest.json")
+}
+
+func DownloadDispatchHandler(c *gin.Context) {
+	downloadBatchFile(c, "dispatch.csv")
+}
+
+func DownloadAttemptsHandler(c *gin.Context) {
+	downloadBatchFile(c, "attempts.csv")
+}
+
+func downloadBatchFile(c *gin.Context, suffix string) {
 	batchName := c.DefaultQuery("batchname", "")
 
 	if batchName == "" {
@@ -43,12 +115,12 @@ func DownloadResultHandler(c *gin.Context) {
 		return
 	}
 
-	filePath := filepath.Join(config.C.OutputFilePath, fmt.Sprintf("%s-result.csv", batchName))
-
-	if _, err := filepath.Abs(filePath); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("File %s not found", filePath)})
+	// the file must stay in the output directory
+	if strings.ContainsAny(batchName, `/\`) || strings.Contains(batchName, "..") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "batchname must not contain path separators or .."})
 		return
 	}
 
+	filePath := filepath.Join(config.C.OutputFilePath, fmt.Sprintf("%s-%s", batchName, suffix))
 	c.File(filePath)
 }
@@ -1,12 +1,11 @@
 package handler
 
 import (
-	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/paopaoyue/kscale/job-genrator/config"
+	"github.com/paopaoyue/kscale/job-genrator/core"
 	"github.com/paopaoyue/kscale/job-genrator/metrics"
 	"net/http"
-	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -23,12 +22,12 @@ func MetricsHandler(c *gin.Context) {
 	}
 
 	var value float64
-	switch req.Key {
-	case metrics.JobRequest, metrics.JobSuccess, metrics.JobFailure:
+	switch baseKey(req.Key) {
+	case metrics.JobRequest, metrics.JobSuccess, metrics.JobFailure, metrics.JobRetry, metrics.JobAbandon, metrics.RetryQueueOverflow, metrics.PolicyFallback, metrics.ScaleClamp, metrics.ScaleSuperseded, metrics.EndpointRequest, metrics.EndpointFailure:
 		value = metrics.Client.(*metrics.InternalClient).ReadCount(time.Now(), req.Key)
-	case metrics.JobDuration, metrics.JobLatency:
+	case metrics.JobDuration, metrics.JobLatency, metrics.EndpointLatency:
 		value = float64(metrics.Client.(*metrics.InternalClient).ReadTime(time.Now(), req.Key))
-	case metrics.QueueSize, metrics.WorkerNum, metrics.RunningWorkerNum, metrics.ExpectedWorkerNum:
+	case metrics.QueueSize, metrics.PredictedWork, metrics.InflightRequest, metrics.RetryQueueSize, metrics.EndpointInflight, metrics.WorkerNum, metrics.RunningWorkerNum, metrics.ExpectedWorkerNum:
 		value = metrics.Client.(*metrics.InternalClient).ReadGauge(time.Now(), req.Key)
 	}
 
@@ -38,20 +37,20 @@ func MetricsHandler(c *gin.Context) {
 	})
 }
 
-func DownloadMetricsHandler(c *gin.Context) {
-	batchName := c.DefaultQuery("batchname", "")
-
-	if batchName == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "batchname is required"})
-		return
-	}
-
-	filePath := filepath.Join(config.C.OutputFilePath, fmt.Sprintf("%s-metrics.csv", batchName))
+func EndpointsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, core.Scheduler.EndpointStats())
+}
 
-	if _, err := filepath.Abs(filePath); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("File %s not found", filePath)})
-		return
+// baseKey strips the endpoint of a per endpoint metric key and the guardrail of a clamp key
+func baseKey(key string) string {
+	for _, k := range []string{metrics.EndpointRequest, metrics.EndpointFailure, metrics.EndpointLatency, metrics.EndpointInflight, metrics.ScaleClamp} {
+		if strings.HasPrefix(key, k+".") {
+			return k
+		}
 	}
+	return key
+}
 
-	c.File(filePath)
+func DownloadMetricsHandler(c *gin.Context) {
+	downloadBatchFile(c, "metrics.csv")
 }
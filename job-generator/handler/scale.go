@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/paopaoyue/kscale/job-genrator/api"
+	"github.com/paopaoyue/kscale/job-genrator/core"
+	"net/http"
+)
+
+type scaleRequest struct {
+	Count  *int `json:"count"`
+	DryRun bool `json:"dry_run"`
+}
+
+// ScaleHandler sets the replicas of the served deployment, with dry_run it only returns the config changes
+func ScaleHandler(c *gin.Context) {
+	var req scaleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if req.Count == nil || *req.Count < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "count must be a non-negative integer"})
+		return
+	}
+
+	result, err := core.Scheduler.Scale(c.Request.Context(), *req.Count, req.DryRun)
+	if err != nil {
+		if errors.Is(err, api.ErrConfigConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
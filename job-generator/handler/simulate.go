@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/paopaoyue/kscale/job-genrator/core"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// SimulateHandler replays an uploaded trace against a simulated worker pool, the optional "sim" field
+// holds the simulation options as JSON and "name" the batch name, the trace name with a -sim suffix
+// by default. It responds once the simulation started, which is then followed and downloaded like a batch
+func SimulateHandler(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File upload failed"})
+		return
+	}
+
+	options, err := parseReplayOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	simOptions := core.DefaultSimOptions()
+	if v := c.PostForm("sim"); v != "" {
+		if err := json.Unmarshal([]byte(v), &simOptions); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid simulation options"})
+			return
+		}
+	}
+	if err := simOptions.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name := c.DefaultPostForm("name", strings.TrimSuffix(file.Filename, filepath.Ext(file.Filename))+"-sim")
+
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error opening file"})
+		return
+	}
+	defer src.Close()
+
+	err = core.Scheduler.Simulate(name, file.Filename, file.Header.Get("Content-Type"), src, options, simOptions)
+	var schemaErr *core.SchemaError
+	if errors.As(err, &schemaErr) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": schemaErr.Error(), "issues": schemaErr.Issues})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Simulation started",
+		"name":    name,
+	})
+}
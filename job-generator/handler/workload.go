@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/paopaoyue/kscale/job-genrator/core"
+	"net/http"
+)
+
+// GenerateJobHandler starts a synthetic workload, the spec is either the JSON body or the "spec" field
+// of a multipart form which may also carry a seed corpus as "file"
+func GenerateJobHandler(c *gin.Context) {
+	var spec core.WorkloadSpec
+	options := core.DefaultReplayOptions()
+
+	if c.ContentType() == "application/json" {
+		if err := c.ShouldBindJSON(&spec); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+			return
+		}
+		if err := spec.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := core.Scheduler.SubmitWorkload(spec, nil, options); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Jobs generated successfully"})
+		return
+	}
+
+	if err := json.Unmarshal([]byte(c.PostForm("spec")), &spec); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid workload spec"})
+		return
+	}
+	if err := spec.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	options, err := parseReplayOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var corpus core.JobSource
+	if file, err := c.FormFile("file"); err == nil {
+		src, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error opening file"})
+			return
+		}
+		defer src.Close()
+
+		corpus, err = core.OpenCorpusSource(file.Filename, file.Header.Get("Content-Type"), src)
+		var schemaErr *core.SchemaError
+		if errors.As(err, &schemaErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": schemaErr.Error(), "issues": schemaErr.Issues})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer corpus.Close()
+	}
+
+	if err := core.Scheduler.SubmitWorkload(spec, corpus, options); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Jobs generated successfully",
+	})
+}
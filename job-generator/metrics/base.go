@@ -1,6 +1,9 @@
 package metrics
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 var Client MetricsClient
 var DatadogClient MetricsClient
@@ -11,14 +14,41 @@ const (
 	JobFailure  = "job_generator.job_failure"
 	JobLatency  = "job_generator.job_latency"
 	JobDuration = "job_generator.job_duration"
+	JobRetry    = "job_generator.job_retry"
+	JobAbandon  = "job_generator.job_abandon"
+
+	QueueSize       = "job_generator.queue_size"
+	InflightRequest = "job_generator.inflight_request"
+	PredictedWork   = "job_generator.predicted_work" // of the queued and running jobs, in GPU seconds, also per batch with BatchKey
+
+	RetryQueueSize     = "job_generator.retry_queue_size"
+	RetryQueueOverflow = "job_generator.retry_queue_overflow"
+
+	// per endpoint metrics, see EndpointKey
+	EndpointRequest  = "job_generator.endpoint.request"
+	EndpointFailure  = "job_generator.endpoint.failure"
+	EndpointLatency  = "job_generator.endpoint.latency"
+	EndpointInflight = "job_generator.endpoint.inflight"
 
-	QueueSize = "job_generator.queue_size"
+	PolicyFallback  = "job_generator.policy_fallback"
+	ScaleClamp      = "job_generator.scale_clamp" // a scale decision changed by the guardrails, per guardrail with a suffix
+	ScaleSuperseded = "job_generator.scale_superseded"
 
 	WorkerNum         = "job_generator.worker_num"
 	RunningWorkerNum  = "job_generator.running_worker_num"
 	ExpectedWorkerNum = "job_generator.expected_worker_num"
 )
 
+// EndpointKey scopes a per endpoint metric to one endpoint, e.g. job_generator.endpoint.request.10_0_0_1_8000
+func EndpointKey(key string, endpoint string) string {
+	return key + "." + strings.NewReplacer(".", "_", ":", "_").Replace(endpoint)
+}
+
+// BatchKey scopes a metric to one job batch, e.g. job_generator.predicted_work.batch.trace_1
+func BatchKey(key string, batch string) string {
+	return key + ".batch." + strings.NewReplacer(".", "_", ":", "_").Replace(batch)
+}
+
 type MetricsClient interface {
 	Count(key string)
 	Gauge(key string, value float64)
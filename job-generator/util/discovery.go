@@ -0,0 +1,65 @@
+package util
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"log/slog"
+	"time"
+)
+
+// DiscoverEndpoints lists the ready pods matching the label selector, every pod serves on the given port
+func DiscoverEndpoints(ctx context.Context, client *kubernetes.Clientset, namespace, labelSelector string, port int32) ([]Endpoint, error) {
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labelSelector,
+	})
+	if err != nil {
+		slog.Error("Failed to list pods using k8s api when discover endpoints", "err", err.Error())
+		return nil, err
+	}
+
+	var endpoints []Endpoint
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue {
+				endpoints = append(endpoints, Endpoint{Host: pod.Status.PodIP, Port: port})
+				break
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+// Watch keeps the group in sync with the discovered pods until stopChan is closed, the group keeps
+// its endpoints when discovery fails or finds nothing. A list taking longer than the interval fails, so
+// a hanging API server cannot stall the refreshes
+func (eg *EndpointGroup) Watch(client *kubernetes.Clientset, namespace, labelSelector string, port int32, interval time.Duration, stopChan <-chan struct{}) {
+	refresh := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		defer cancel()
+		endpoints, err := DiscoverEndpoints(ctx, client, namespace, labelSelector, port)
+		if err != nil || len(endpoints) == 0 {
+			slog.Warn("No endpoint discovered, keeping the current ones", "selector", labelSelector)
+			return
+		}
+		eg.sync(endpoints)
+	}
+	refresh()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				refresh()
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+}
@@ -1,12 +1,23 @@
 package util
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	RoundRobin       = "round_robin"
+	LeastOutstanding = "least_outstanding"
+	PowerOfTwo       = "power_of_two"
+)
+
+var ErrNoEndpoint = errors.New("no endpoint available")
+
 type Endpoint struct {
 	Host string
 	Port int32
@@ -29,29 +40,228 @@ func NewEndpoint(addr string) (Endpoint, bool) {
 	}
 }
 
+// NewEndpoints parses a comma separated list of addresses, invalid ones are skipped
+func NewEndpoints(addrs string) []Endpoint {
+	var endpoints []Endpoint
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if endpoint, ok := NewEndpoint(addr); ok {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
 func (e *Endpoint) String() string {
 	return fmt.Sprintf("%s:%d", e.Host, e.Port)
 }
 
+type EndpointStats struct {
+	Endpoint    string  `json:"endpoint"`
+	Outstanding int     `json:"outstanding"`
+	Requests    int     `json:"requests"`
+	Failures    int     `json:"failures"`
+	AvgLatency  float64 `json:"avg_latency"` // in milliseconds
+}
+
+type endpointState struct {
+	outstanding  int
+	requests     int
+	failures     int
+	totalLatency time.Duration
+}
+
+// EndpointGroup balances requests over a changing set of endpoints, each limited to maxOutstanding
+// concurrent requests, 0 for unlimited
 type EndpointGroup struct {
 	endpoints []Endpoint
+
+	policy         string
+	maxOutstanding int
+
+	mu     *sync.Mutex
+	states map[Endpoint]*endpointState
+	next   int
+	notify chan struct{} // closed whenever capacity may have been freed
 }
 
-func NewEndpointGroup(endpoints []Endpoint) *EndpointGroup {
-	return &EndpointGroup{
-		endpoints: endpoints,
+func NewEndpointGroup(endpoints []Endpoint, policy string, maxOutstanding int) *EndpointGroup {
+	switch policy {
+	case RoundRobin, LeastOutstanding, PowerOfTwo:
+	default:
+		slog.Warn("Unknown load balance policy, using round robin", "policy", policy)
+		policy = RoundRobin
+	}
+	eg := &EndpointGroup{
+		policy:         policy,
+		maxOutstanding: maxOutstanding,
+		mu:             &sync.Mutex{},
+		states:         map[Endpoint]*endpointState{},
+		notify:         make(chan struct{}),
 	}
+	for _, endpoint := range endpoints {
+		eg.addEndpoint(endpoint)
+	}
+	return eg
 }
 
-func (eg *EndpointGroup) addEndpoint(endpoint Endpoint) {
+func (eg *EndpointGroup) Endpoints() []Endpoint {
+	eg.mu.Lock()
+	defer eg.mu.Unlock()
+	return append([]Endpoint{}, eg.endpoints...)
+}
+
+// Acquire picks an endpoint by the group policy and counts a request as outstanding on it,
+// it blocks while every endpoint is at its limit and fails once stopChan is closed. The power of
+// two policy draws its choices from rng
+func (eg *EndpointGroup) Acquire(stopChan <-chan struct{}, rng *Rand) (Endpoint, error) {
+	for {
+		eg.mu.Lock()
+		endpoint, ok, err := eg.tryAcquire(rng)
+		notify := eg.notify
+		eg.mu.Unlock()
+		if ok || err != nil {
+			return endpoint, err
+		}
+
+		select {
+		case <-notify:
+		case <-stopChan:
+			return Endpoint{}, ErrNoEndpoint
+		}
+	}
+}
+
+// TryAcquire is Acquire without waiting, it returns false while every endpoint is at its limit
+func (eg *EndpointGroup) TryAcquire(rng *Rand) (Endpoint, bool, error) {
+	eg.mu.Lock()
+	defer eg.mu.Unlock()
+	return eg.tryAcquire(rng)
+}
+
+// tryAcquire must be called with mu held
+func (eg *EndpointGroup) tryAcquire(rng *Rand) (Endpoint, bool, error) {
+	if len(eg.endpoints) == 0 {
+		return Endpoint{}, false, ErrNoEndpoint
+	}
+	endpoint, ok := eg.pick(rng)
+	if ok {
+		eg.states[endpoint].outstanding++
+	}
+	return endpoint, ok, nil
+}
+
+// Release ends a request started by Acquire
+func (eg *EndpointGroup) Release(endpoint Endpoint, latency time.Duration, err error) {
+	eg.mu.Lock()
+	defer eg.mu.Unlock()
+	if state, ok := eg.states[endpoint]; ok {
+		state.outstanding--
+		state.requests++
+		state.totalLatency += latency
+		if err != nil {
+			state.failures++
+		}
+		if state.outstanding <= 0 && !eg.contains(endpoint) {
+			delete(eg.states, endpoint) // the last request of a removed endpoint
+		}
+	}
+	eg.wake()
+}
+
+func (eg *EndpointGroup) Stats() []EndpointStats {
+	eg.mu.Lock()
+	defer eg.mu.Unlock()
+	stats := make([]EndpointStats, 0, len(eg.endpoints))
+	for _, endpoint := range eg.endpoints {
+		state := eg.states[endpoint]
+		s := EndpointStats{
+			Endpoint:    endpoint.String(),
+			Outstanding: state.outstanding,
+			Requests:    state.requests,
+			Failures:    state.failures,
+		}
+		if state.requests > 0 {
+			s.AvgLatency = float64(state.totalLatency.Milliseconds()) / float64(state.requests)
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// pick must be called with mu held
+func (eg *EndpointGroup) pick(rng *Rand) (Endpoint, bool) {
+	var candidates []Endpoint
+	for i := range eg.endpoints {
+		// rotate so ties are broken round robin
+		endpoint := eg.endpoints[(eg.next+i)%len(eg.endpoints)]
+		if eg.maxOutstanding <= 0 || eg.states[endpoint].outstanding < eg.maxOutstanding {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	if len(candidates) == 0 {
+		return Endpoint{}, false
+	}
+	eg.next = (eg.next + 1) % len(eg.endpoints)
+
+	switch eg.policy {
+	case LeastOutstanding:
+		best := candidates[0]
+		for _, endpoint := range candidates[1:] {
+			if eg.states[endpoint].outstanding < eg.states[best].outstanding {
+				best = endpoint
+			}
+		}
+		return best, true
+	case PowerOfTwo:
+		if len(candidates) == 1 {
+			return candidates[0], true
+		}
+		i := rng.IntN(len(candidates))
+		j := rng.IntN(len(candidates) - 1)
+		if j >= i {
+			j++
+		}
+		if eg.states[candidates[j]].outstanding < eg.states[candidates[i]].outstanding {
+			return candidates[j], true
+		}
+		return candidates[i], true
+	default:
+		return candidates[0], true
+	}
+}
+
+// wake must be called with mu held
+func (eg *EndpointGroup) wake() {
+	close(eg.notify)
+	eg.notify = make(chan struct{})
+}
+
+func (eg *EndpointGroup) contains(endpoint Endpoint) bool {
 	for _, e := range eg.endpoints {
 		if e.Host == endpoint.Host && e.Port == endpoint.Port {
-			return
+			return true
 		}
 	}
+	return false
+}
+
+// addEndpoint starts the stats of a re-added endpoint afresh, only its requests still outstanding carry over
+func (eg *EndpointGroup) addEndpoint(endpoint Endpoint) {
+	if eg.contains(endpoint) {
+		return
+	}
 	eg.endpoints = append(eg.endpoints, endpoint)
+	state := &endpointState{}
+	if old, ok := eg.states[endpoint]; ok {
+		state.outstanding = old.outstanding
+	}
+	eg.states[endpoint] = state
 }
 
+// removeEndpoint keeps the state of the endpoint until its outstanding requests are released
 func (eg *EndpointGroup) removeEndpoint(endpoint Endpoint) {
 	for i, e := range eg.endpoints {
 		if e.Host == endpoint.Host && e.Port == endpoint.Port {
@@ -59,4 +269,30 @@ func (eg *EndpointGroup) removeEndpoint(endpoint Endpoint) {
 			break
 		}
 	}
+	if state, ok := eg.states[endpoint]; ok && state.outstanding <= 0 {
+		delete(eg.states, endpoint)
+	}
+}
+
+// sync replaces the endpoints of the group, outstanding requests on removed endpoints are still released
+func (eg *EndpointGroup) sync(endpoints []Endpoint) {
+	eg.mu.Lock()
+	defer eg.mu.Unlock()
+	keep := map[Endpoint]bool{}
+	for _, endpoint := range endpoints {
+		keep[endpoint] = true
+	}
+	for _, endpoint := range append([]Endpoint{}, eg.endpoints...) {
+		if !keep[endpoint] {
+			slog.Info("Endpoint removed", "endpoint", endpoint.String())
+			eg.removeEndpoint(endpoint)
+		}
+	}
+	for _, endpoint := range endpoints {
+		if !eg.contains(endpoint) {
+			slog.Info("Endpoint added", "endpoint", endpoint.String())
+		}
+		eg.addEndpoint(endpoint)
+	}
+	eg.wake()
 }
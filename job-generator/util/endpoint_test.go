@@ -0,0 +1,173 @@
+package util
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testRand draws the picks of the power of two policy
+var testRand = NewRand(1, 0)
+
+func testEndpoints() []Endpoint {
+	return NewEndpoints("10.0.0.1:8000, 10.0.0.2:8000,10.0.0.3:8000")
+}
+
+func TestNewEndpoints(t *testing.T) {
+	endpoints := NewEndpoints("10.0.0.1:8000,,bad,10.0.0.2:9000")
+	if len(endpoints) != 2 || endpoints[1].Port != 9000 {
+		t.Fatalf("unexpected endpoints %v", endpoints)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	eg := NewEndpointGroup(testEndpoints(), RoundRobin, 0)
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		endpoint, err := eg.Acquire(nil, testRand)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[endpoint.String()]++
+		eg.Release(endpoint, time.Millisecond, nil)
+	}
+	for _, endpoint := range testEndpoints() {
+		if seen[endpoint.String()] != 2 {
+			t.Fatalf("round robin is uneven %v", seen)
+		}
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	for _, policy := range []string{LeastOutstanding, PowerOfTwo} {
+		eg := NewEndpointGroup(testEndpoints()[:2], policy, 0)
+		first, _ := eg.Acquire(nil, testRand)
+		second, _ := eg.Acquire(nil, testRand)
+		if first == second {
+			t.Fatalf("%s picked the busy endpoint twice", policy)
+		}
+	}
+}
+
+func TestPowerOfTwoFollowsSeed(t *testing.T) {
+	picks := func(seed uint64) []Endpoint {
+		eg := NewEndpointGroup(testEndpoints(), PowerOfTwo, 0)
+		rng := NewRand(seed, 0)
+		endpoints := []Endpoint{}
+		for i := 0; i < 20; i++ {
+			endpoint, _ := eg.Acquire(nil, rng)
+			endpoints = append(endpoints, endpoint)
+			if i%3 == 0 {
+				eg.Release(endpoint, time.Millisecond, nil)
+			}
+		}
+		return endpoints
+	}
+	if first, again := picks(7), picks(7); !slices.Equal(first, again) {
+		t.Fatalf("expected the same picks for the same seed, got %v and %v", first, again)
+	}
+}
+
+func TestAcquireWaitsForCapacity(t *testing.T) {
+	eg := NewEndpointGroup(testEndpoints()[:1], RoundRobin, 1)
+	endpoint, _ := eg.Acquire(nil, testRand)
+
+	acquired := make(chan struct{})
+	go func() {
+		_, _ = eg.Acquire(nil, testRand)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired an endpoint beyond its limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	eg.Release(endpoint, time.Millisecond, nil)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("release did not wake the waiting request")
+	}
+
+	stopChan := make(chan struct{})
+	close(stopChan)
+	if _, err := eg.Acquire(stopChan, testRand); err == nil {
+		t.Fatal("acquire should fail once stopped")
+	}
+
+	stats := eg.Stats()
+	if len(stats) != 1 || stats[0].Requests != 1 || stats[0].Outstanding != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestAcquireLimitsEachEndpoint(t *testing.T) {
+	for _, policy := range []string{RoundRobin, LeastOutstanding, PowerOfTwo} {
+		eg := NewEndpointGroup(testEndpoints()[:2], policy, 2)
+		acquired := []Endpoint{}
+		for i := 0; i < 4; i++ {
+			endpoint, ok, err := eg.TryAcquire(testRand)
+			if err != nil || !ok {
+				t.Fatalf("%s refused request %d below the limit: %v", policy, i+1, err)
+			}
+			acquired = append(acquired, endpoint)
+		}
+		for _, stats := range eg.Stats() {
+			if stats.Outstanding != 2 {
+				t.Fatalf("%s overloaded an endpoint %+v", policy, eg.Stats())
+			}
+		}
+		if _, ok, err := eg.TryAcquire(testRand); ok || err != nil {
+			t.Fatalf("%s acquired an endpoint beyond its limit: %v", policy, err)
+		}
+
+		// a released endpoint takes the next request
+		eg.Release(acquired[0], time.Millisecond, nil)
+		if endpoint, ok, _ := eg.TryAcquire(testRand); !ok || endpoint != acquired[0] {
+			t.Fatalf("%s expected the released endpoint %v, got %v", policy, acquired[0], endpoint)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	eg := NewEndpointGroup(testEndpoints(), RoundRobin, 0)
+	eg.sync(testEndpoints()[1:])
+	if len(eg.Endpoints()) != 2 {
+		t.Fatalf("unexpected endpoints %v", eg.Endpoints())
+	}
+	eg.sync(nil)
+	if _, err := eg.Acquire(nil, testRand); err != ErrNoEndpoint {
+		t.Fatalf("expected no endpoint, got %v", err)
+	}
+}
+
+func TestSyncPrunesRemovedEndpoints(t *testing.T) {
+	endpoints := testEndpoints()
+	eg := NewEndpointGroup(endpoints[:1], RoundRobin, 0)
+	busy, _ := eg.Acquire(nil, testRand)
+	eg.Release(busy, time.Millisecond, errors.New("failed"))
+	busy, _ = eg.Acquire(nil, testRand)
+
+	// the busy endpoint is kept until its request is released
+	eg.sync(endpoints[1:])
+	if len(eg.states) != 3 {
+		t.Fatalf("expected the busy endpoint kept while draining, got %d states", len(eg.states))
+	}
+	eg.Release(busy, time.Millisecond, nil)
+	if _, ok := eg.states[busy]; ok || len(eg.states) != 2 {
+		t.Fatalf("expected the drained endpoint pruned, got %d states", len(eg.states))
+	}
+
+	// a re-added endpoint starts with fresh stats
+	eg.sync(endpoints)
+	for _, stats := range eg.Stats() {
+		if stats.Requests != 0 || stats.Failures != 0 {
+			t.Fatalf("expected fresh stats, got %+v", stats)
+		}
+	}
+	eg.sync(nil)
+	if len(eg.states) != 0 {
+		t.Fatalf("expected every state pruned, got %d", len(eg.states))
+	}
+}
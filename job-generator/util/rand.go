@@ -0,0 +1,30 @@
+package util
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// Rand is a seeded source of random numbers safe for concurrent use, so the random choices of a run
+// follow the seed recorded in its manifest
+type Rand struct {
+	mu  *sync.Mutex
+	rng *rand.Rand
+}
+
+// NewRand draws from the PCG stream of the seed, different streams of a seed are independent
+func NewRand(seed, stream uint64) *Rand {
+	return &Rand{mu: &sync.Mutex{}, rng: rand.New(rand.NewPCG(seed, stream))}
+}
+
+func (r *Rand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Float64()
+}
+
+func (r *Rand) IntN(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.IntN(n)
+}
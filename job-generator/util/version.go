@@ -0,0 +1,33 @@
+package util
+
+import "runtime/debug"
+
+// Version can be set at build time with -ldflags "-X github.com/paopaoyue/kscale/job-genrator/util.Version=..."
+var Version = ""
+
+// BuildVersion returns Version, or the vcs revision embedded by the go toolchain if it is not set
+func BuildVersion() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "unknown"
+	}
+	if modified {
+		return revision + "-dirty"
+	}
+	return revision
+}
@@ -28,9 +28,28 @@ class DataPoint(BaseModel):
     num_completed_tasks: int
     avg_duration: float  # in milliseconds
     avg_delay: float     # in milliseconds
+    # observation version 2, the defaults keep version 1 requests valid
+    expected_workers: int = 0
+    total_workers: int = 0
+    pending_workers: int = 0
+    num_failed_tasks: int = 0
+    num_abandoned_tasks: int = 0
+    failure_rate: float = 0.0
+    p50_delay: float = 0.0  # in milliseconds
+    p95_delay: float = 0.0  # in milliseconds
+    p99_delay: float = 0.0  # in milliseconds
+    queue_age: float = 0.0  # of the oldest unfinished task, in milliseconds
+    predicted_work: float = 0.0  # of the queued and running tasks, in gpu seconds
+    reward: float = 0.0
+    time_of_day: float = 0.0  # in seconds since local midnight
+    day_of_week: int = 0  # 0 is sunday
+
+# observation versions the models accept, the job generator sends the newest one it also knows
+OBSERVATION_VERSIONS = [1, 2]
 
 class CalcWorkerCountRequestParam(BaseModel):
     time: int
+    version: int = 1
     points: List[DataPoint]
 
 @serve.deployment(
@@ -103,10 +122,16 @@ class AutoscalerService:
                 "forecasted_requests": self.data_scale * 10,      
             }
 
+    @app.get("/schema")
+    async def schema(self):
+        return {"versions": OBSERVATION_VERSIONS}
+
     @app.post("/calc")
     async def calc(self, req: CalcWorkerCountRequestParam):
         if not req.points:
             raise HTTPException(status_code=400, detail="No data points provided.")
+        if req.version not in OBSERVATION_VERSIONS:
+            raise HTTPException(status_code=422, detail=f"Unsupported observation version {req.version}.")
         if self.scaler_type == "threshold":
             ongoing_tasks = req.points[-1].num_ongoing_tasks + req.points[-1].num_new_tasks
             expected_workers = np.ceil(ongoing_tasks / self.scaler_threshold)
@@ -6,6 +6,58 @@ import os
 
 RAY_DASHBOARD_URL = os.getenv("RAY_DASHBOARD_URL", "http://localhost:8265")
 
+APPLICATION = "text2img"
+DEPLOYMENT = "image_service"
+
+# import paths of the applications deployed by main.py, which have no declarative config in serve
+IMPORT_PATHS = {
+    "text2img": "core.image_service:entrypoint",
+    "controller": "core.controller:controllerEntrypoint",
+    "autoscaler": "core.autoscaler:autoscalerEndpoint",
+}
+
+def build_deploy_config(details: dict) -> dict:
+    """Rebuilds the declarative config of every application from the serve details."""
+    deploy_config = {"applications": []}
+    for key in ("proxy_location", "http_options", "grpc_options"):
+        if details.get(key):
+            deploy_config[key] = details[key]
+
+    applications = details.get("applications", {})
+    if APPLICATION not in applications:
+        raise HTTPException(status_code=404, detail=f"Application '{APPLICATION}' not found.")
+    for name in sorted(applications):
+        application = applications[name]
+        app_config = application.get("deployed_app_config")
+        if app_config is None:
+            if name not in IMPORT_PATHS:
+                raise HTTPException(status_code=409, detail=f"Application '{name}' has no known import path, writing the config would delete it.")
+            app_config = {
+                "name": name,
+                "route_prefix": application.get("route_prefix"),
+                "import_path": IMPORT_PATHS[name],
+            }
+            if name == APPLICATION:
+                # the runtime options of the deployment become overrides
+                deployment = application.get("deployments", {}).get(DEPLOYMENT)
+                if not deployment:
+                    raise HTTPException(status_code=404, detail=f"Deployment '{DEPLOYMENT}' not found.")
+                app_config["deployments"] = [dict(deployment.get("deployment_config", {}), name=DEPLOYMENT)]
+        deploy_config["applications"].append(app_config)
+    return deploy_config
+
+def patch_replicas(deploy_config: dict, count: int):
+    application = next(app for app in deploy_config["applications"] if app["name"] == APPLICATION)
+    deployments = application.setdefault("deployments", [])
+    deployment = next((d for d in deployments if d.get("name") == DEPLOYMENT), None)
+    if deployment is None:
+        # the declarative config only lists the deployments it overrides
+        deployment = {"name": DEPLOYMENT}
+        deployments.append(deployment)
+    if deployment.get("autoscaling_config"):
+        raise HTTPException(status_code=400, detail="Cannot set 'num_replicas' when 'autoscaling_config' is present.")
+    deployment["num_replicas"] = count
+
 app = FastAPI()
 
 @serve.deployment(
@@ -41,34 +93,14 @@ class ControllerService:
             except httpx.HTTPError as e:
                 raise HTTPException(status_code=500, detail="Unable to retrieve application configurations.")
 
-            data = response.json()
-            applications = data.get("applications", {})
-    
-            application = next((app for name, app in applications.items() if name == "text2img"), None)
-            if not application:
-                raise HTTPException(status_code=404, detail="Application 'text2img' not found.")
-    
-            deployments = application.get("deployments", {})
-            deployment = next((d for name, d in deployments.items() if name == "image_service"), None)
-            deployment = deployment.get("deployment_config", {})
-            if not deployment:
-                raise HTTPException(status_code=404, detail="Deployment 'image_service' not found.")
-    
-            if "autoscaling_config" in deployment:
-                raise HTTPException(status_code=400, detail="Cannot set 'num_replicas' when 'autoscaling_config' is present.")
-    
-            deployment["num_replicas"] = count
-    
+            # serve deletes every application missing from the put, so the whole config is written back
+            deploy_config = build_deploy_config(response.json())
+            patch_replicas(deploy_config, count)
+
             try:
                 put_response = await client.put(
                     f"{RAY_DASHBOARD_URL}/api/serve/applications/",
-                    json={"applications": [{
-                        "name": "text2img",
-                        "import_path": "core.image_service:entrypoint",
-                        "deployments": [
-                            deployment
-                        ],
-                    }]},
+                    json=deploy_config,
                 )
                 put_response.raise_for_status()
             except httpx.HTTPError as e: